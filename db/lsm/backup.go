@@ -0,0 +1,431 @@
+package lsm
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+// A backup directory holds any number of backups of a database. SSTables are shared by every
+// backup holding them, deduplicated by the ID in their header, so a backup only copies the
+// SSTables created since the previous one. Each backup also keeps a private copy of the MANIFEST
+// and writeahead logs, and a metadata file that is written last, so that a backup that failed
+// partway through is never listed.
+//
+//	shared/<SSTable ID>.sst  SSTables of every backup
+//	backup_<N>/              private files of backup N
+//	backup_<N>.meta          metadata of backup N, as a BackupInfo
+//	tmp/                     files being copied
+const backupSharedDirName = "shared"
+
+// Describes a backup.
+// ________________________________________________________
+// | 8 bytes   | 8 bytes   | 8 bytes         | (variable) |
+// |------------------------------------------------------|
+// | backup ID | timestamp | number of files | files      |
+// |------------------------------------------------------|
+type BackupInfo struct {
+	ID uint64
+	// When the backup was created, by the clock of the database
+	Timestamp time.Time
+	Files     []BackupFile
+}
+
+// Describes a file of a backed up database. The SSTable ID of any file other than an SSTable is
+// zero.
+// ___________________________________________________
+// | 8 bytes   | (variable) | 16 bytes   | 8 bytes   |
+// |-------------------------------------------------|
+// | path size | path       | SSTable ID | file size |
+// |-------------------------------------------------|
+type BackupFile struct {
+	// Path relative to the database directory
+	Path      string
+	SSTableID [16]byte
+	Size      uint64
+}
+
+// CreateBackup backs up the database to a backup directory, which is created if it does not exist.
+// It must not be called concurrently with PurgeOldBackups on the same backup directory.
+//
+// The database is checkpointed first, so writes are only paused for as long as Checkpoint pauses
+// them, and files are copied from the checkpoint.
+func (me *LSMDB) CreateBackup(backupDir string) (out BackupInfo, err error) {
+	ctx := &dbCtx{}
+	if err := me.checkStateError(ctx); err != nil {
+		return out, err
+	}
+
+	for _, subdir := range []string{backupSharedDirName, "tmp"} {
+		if err := os.MkdirAll(filepath.Join(backupDir, subdir), 0o755); err != nil {
+			return out, errors.WithStack(err)
+		}
+	}
+
+	backups, err := ListBackups(backupDir)
+	if err != nil {
+		return out, err
+	}
+	out.ID = 1
+	if len(backups) > 0 {
+		out.ID = backups[len(backups)-1].ID + 1
+	}
+	out.Timestamp = me.clock()
+
+	// the checkpoint is in the database directory, since its SSTables are hard links
+	checkpointDir, err := os.MkdirTemp(filepath.Join(me.path, "tmp"), "checkpoint_")
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+	_ = os.Remove(checkpointDir)
+	defer os.RemoveAll(checkpointDir)
+
+	if err := me.Checkpoint(checkpointDir); err != nil {
+		return out, err
+	}
+
+	// may be left behind by a backup that failed before writing its metadata
+	privateDir := backupPrivateDir(backupDir, out.ID)
+	if err := os.RemoveAll(privateDir); err != nil {
+		return out, errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(privateDir)
+		}
+	}()
+
+	if err := filepath.WalkDir(checkpointDir, func(
+		path string, dirent fs.DirEntry, err error,
+	) error {
+		if err != nil || dirent.IsDir() {
+			return err
+		}
+		fileInfo, err := dirent.Info()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relativePath, _ := filepath.Rel(checkpointDir, path)
+		file := BackupFile{Path: relativePath, Size: uint64(fileInfo.Size())}
+
+		if strings.HasSuffix(relativePath, ".sst") {
+			if file.SSTableID, err = readSSTableID(path); err != nil {
+				return err
+			}
+			if err := backupSSTable(backupDir, path, file); err != nil {
+				return err
+			}
+		} else {
+			destPath := filepath.Join(privateDir, relativePath)
+			if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := copyFilePrefix(path, destPath, file.Size); err != nil {
+				return err
+			}
+		}
+
+		out.Files = append(out.Files, file)
+		return nil
+	}); err != nil {
+		return out, err
+	}
+
+	bytes, _ := util.ToBytes(&out)
+	if err := writeFileAtomically(
+		filepath.Join(backupDir, "tmp"), backupMetadataPath(backupDir, out.ID), bytes,
+	); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// backupSSTable copies an SSTable to the shared directory of a backup directory, unless an earlier
+// backup already did.
+func backupSSTable(backupDir, path string, file BackupFile) error {
+	sharedPath := sharedSSTablePath(backupDir, file.SSTableID)
+	if fileInfo, err := os.Stat(sharedPath); err == nil && uint64(fileInfo.Size()) == file.Size {
+		return nil
+	}
+
+	// copied under a temporary name first, so that a partial copy is never mistaken for a backup
+	tmpPath := filepath.Join(backupDir, "tmp", filepath.Base(sharedPath))
+	_ = os.Remove(tmpPath)
+	if err := copyFilePrefix(path, tmpPath, file.Size); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, sharedPath); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// ListBackups returns every backup in a backup directory, oldest first.
+func ListBackups(backupDir string) ([]BackupInfo, error) {
+	dirents, err := os.ReadDir(backupDir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var out []BackupInfo
+	for _, dirent := range dirents {
+		id, ok := getFileNumber(dirent.Name(), "backup_", ".meta")
+		if !ok {
+			continue
+		}
+		backup, err := readBackupInfo(backupDir, id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, backup)
+	}
+
+	slices.SortFunc(out, func(a, b BackupInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return out, nil
+}
+
+// Restore restores a backup to a new database directory, which Open can then open.
+func Restore(backupDir string, backupID uint64, targetDir string) (err error) {
+	backup, err := readBackupInfo(backupDir, backupID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(targetDir, os.ModeExclusive|0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(targetDir)
+		}
+	}()
+
+	for _, file := range backup.Files {
+		srcPath := filepath.Join(backupPrivateDir(backupDir, backupID), file.Path)
+		if file.SSTableID != [16]byte{} {
+			srcPath = sharedSSTablePath(backupDir, file.SSTableID)
+		}
+
+		destPath := filepath.Join(targetDir, file.Path)
+		if err := os.MkdirAll(filepath.Dir(destPath), 0o755); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := copyFilePrefix(srcPath, destPath, file.Size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PurgeOldBackups deletes all but the given number of most recent backups in a backup directory,
+// along with the SSTables that no remaining backup holds. It must not be called concurrently with
+// CreateBackup on the same backup directory.
+func PurgeOldBackups(backupDir string, keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("number of backups to keep must not be negative")
+	}
+
+	backups, err := ListBackups(backupDir)
+	if err != nil {
+		return err
+	}
+
+	purged := backups[:max(len(backups)-keep, 0)]
+	for _, backup := range purged {
+		// the metadata goes first, so that a partly deleted backup is no longer listed
+		if err := os.Remove(backupMetadataPath(backupDir, backup.ID)); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := os.RemoveAll(backupPrivateDir(backupDir, backup.ID)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	referenced := map[string]struct{}{}
+	for _, backup := range backups[len(purged):] {
+		for _, file := range backup.Files {
+			if file.SSTableID != [16]byte{} {
+				referenced[filepath.Base(sharedSSTablePath(backupDir, file.SSTableID))] = struct{}{}
+			}
+		}
+	}
+
+	dirents, err := os.ReadDir(filepath.Join(backupDir, backupSharedDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+	for _, dirent := range dirents {
+		if _, ok := referenced[dirent.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(
+			filepath.Join(backupDir, backupSharedDirName, dirent.Name()),
+		); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func readBackupInfo(backupDir string, id uint64) (out BackupInfo, _ error) {
+	bytes, err := os.ReadFile(backupMetadataPath(backupDir, id))
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+	return util.ValueFromBytes[BackupInfo](bytes)
+}
+
+func readSSTableID(path string) (out [16]byte, _ error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	var header sstable.Header
+	if _, err := header.ReadFrom(bufio.NewReader(file)); err != nil {
+		return out, errors.WithStack(err)
+	}
+	return header.ID, nil
+}
+
+// writeFileAtomically writes a file under a temporary name in tmpDir, then renames it into place.
+func writeFileAtomically(tmpDir, path string, contents []byte) error {
+	file, err := os.CreateTemp(tmpDir, filepath.Base(path)+"_")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := file.Write(contents); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func backupPrivateDir(backupDir string, id uint64) string {
+	return filepath.Join(backupDir, fmt.Sprintf("backup_%d", id))
+}
+
+func backupMetadataPath(backupDir string, id uint64) string {
+	return filepath.Join(backupDir, fmt.Sprintf("backup_%d.meta", id))
+}
+
+func sharedSSTablePath(backupDir string, id [16]byte) string {
+	return filepath.Join(backupDir, backupSharedDirName, hex.EncodeToString(id[:])+".sst")
+}
+
+func (me *BackupInfo) SizeOf() uint64 {
+	size := uint64(8 + 8 + 8)
+	for _, file := range me.Files {
+		size += file.SizeOf()
+	}
+	return size
+}
+
+func (me *BackupInfo) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := util.WriteUint64s(
+		writer, me.ID, uint64(me.Timestamp.UnixNano()), uint64(len(me.Files)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, file := range me.Files {
+		dn2, err := file.WriteTo(writer)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (me *BackupInfo) ReadFrom(reader io.Reader) (n int64, _ error) {
+	var timestamp, numFiles uint64
+	dn, err := util.ReadUint64s(reader, &me.ID, &timestamp, &numFiles)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+	me.Timestamp = time.Unix(0, int64(timestamp))
+
+	me.Files = nil
+	for range numFiles {
+		var file BackupFile
+		dn2, err := file.ReadFrom(reader)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+		me.Files = append(me.Files, file)
+	}
+
+	return n, nil
+}
+
+func (me *BackupFile) SizeOf() uint64 {
+	return 8 + uint64(len(me.Path)) + 16 + 8
+}
+
+func (me *BackupFile) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := writeString(writer, me.Path)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = writer.Write(me.SSTableID[:])
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64(writer, me.Size)
+	return n + int64(dn), err
+}
+
+func (me *BackupFile) ReadFrom(reader io.Reader) (n int64, _ error) {
+	path, dn, err := readString(reader)
+	n += int64(dn)
+	me.Path = path
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = io.ReadFull(reader, me.SSTableID[:])
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.ReadUint64s(reader, &me.Size)
+	return n + int64(dn), err
+}
@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Backup(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Backup")
+	defer cleanup()
+
+	backupDir := filepath.Join(dir, "backups")
+	now := time.Unix(1_700_000_000, 0)
+	openArgs := OpenArgs{
+		Path:           filepath.Join(dir, "db"),
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		Clock: util.Some(func() time.Time {
+			return now
+		}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	require.NoError(t, err)
+
+	const numKeys = 10
+	upsertAll := func(t *testing.T, value string) {
+		for i := range numKeys {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			require.NoError(t, db.Upsert(key, []byte(value)))
+			require.NoError(t, users.Upsert(key, []byte(value)))
+		}
+	}
+	sharedFiles := func(t *testing.T) map[string]time.Time {
+		dirents, err := os.ReadDir(filepath.Join(backupDir, backupSharedDirName))
+		require.NoError(t, err)
+		out := map[string]time.Time{}
+		for _, dirent := range dirents {
+			fileInfo, err := dirent.Info()
+			require.NoError(t, err)
+			out[dirent.Name()] = fileInfo.ModTime()
+		}
+		return out
+	}
+
+	upsertAll(t, "first")
+	require.NoError(t, db.CreateSSTable())
+	waitForCompaction(t, db, 1)
+
+	firstBackup, err := db.CreateBackup(backupDir)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, firstBackup.ID)
+	assert.True(t, now.Equal(firstBackup.Timestamp))
+	firstShared := sharedFiles(t)
+	// one SSTable for each column family
+	assert.Len(t, firstShared, 2)
+
+	// writes that are only in the writeahead log are backed up too
+	upsertAll(t, "second")
+	secondBackup, err := db.CreateBackup(backupDir)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, secondBackup.ID)
+	assert.Equal(t, firstShared, sharedFiles(t), "unchanged SSTables are not copied again")
+
+	upsertAll(t, "third")
+	require.NoError(t, db.CreateSSTable())
+	waitForCompaction(t, db, 2)
+	thirdBackup, err := db.CreateBackup(backupDir)
+	require.NoError(t, err)
+	assert.Len(t, sharedFiles(t), 4)
+
+	t.Run("list backups", func(t *testing.T) {
+		backups, err := ListBackups(backupDir)
+		require.NoError(t, err)
+		if assert.Len(t, backups, 3) {
+			for i, backup := range []BackupInfo{firstBackup, secondBackup, thirdBackup} {
+				assert.Equal(t, backup.ID, backups[i].ID)
+				assert.True(t, backup.Timestamp.Equal(backups[i].Timestamp))
+				assert.Equal(t, backup.Files, backups[i].Files)
+			}
+		}
+	})
+
+	assertRestored := func(t *testing.T, backupID uint64, expected string) {
+		t.Helper()
+
+		targetDir := filepath.Join(dir, fmt.Sprintf("restored_%d", backupID))
+		defer os.RemoveAll(targetDir)
+		require.NoError(t, Restore(backupDir, backupID, targetDir))
+
+		args := openArgs
+		args.Path, args.Create = targetDir, false
+		restored, err := Open(args)
+		require.NoError(t, err)
+		require.NoError(t, restored.Start())
+		defer restored.Close()
+
+		restoredUsers, exists := restored.ColumnFamily("users")
+		require.True(t, exists)
+		for i := range numKeys {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			for _, family := range []*ColumnFamily{restored.DefaultColumnFamily(), restoredUsers} {
+				entry, exists, err := family.Lookup(key)
+				_ = assert.NoError(t, err) && assert.True(t, exists) &&
+					assert.Equal(t, expected, string(entry.Value))
+			}
+		}
+	}
+
+	t.Run("restore", func(t *testing.T) {
+		assertRestored(t, firstBackup.ID, "first")
+		assertRestored(t, secondBackup.ID, "second")
+		assertRestored(t, thirdBackup.ID, "third")
+
+		assert.Error(t, Restore(backupDir, 4, filepath.Join(dir, "missing")))
+		assert.NoDirExists(t, filepath.Join(dir, "missing"))
+		assert.Error(t, Restore(backupDir, firstBackup.ID, openArgs.Path))
+	})
+
+	t.Run("purge old backups", func(t *testing.T) {
+		assert.Error(t, PurgeOldBackups(backupDir, -1))
+
+		require.NoError(t, PurgeOldBackups(backupDir, 1))
+		backups, err := ListBackups(backupDir)
+		require.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			assert.Equal(t, thirdBackup.ID, backups[0].ID)
+		}
+		assert.NoDirExists(t, backupPrivateDir(backupDir, firstBackup.ID))
+
+		// only the SSTables of the remaining backup are kept
+		var expected []string
+		for _, file := range thirdBackup.Files {
+			if file.SSTableID != [16]byte{} {
+				path := sharedSSTablePath(backupDir, file.SSTableID)
+				expected = append(expected, filepath.Base(path))
+			}
+		}
+		var actual []string
+		for name := range sharedFiles(t) {
+			actual = append(actual, name)
+		}
+		assert.ElementsMatch(t, expected, actual)
+
+		assert.Error(t, Restore(backupDir, firstBackup.ID, filepath.Join(dir, "purged")))
+		assertRestored(t, thirdBackup.ID, "third")
+
+		// backup IDs are not reused
+		backup, err := db.CreateBackup(backupDir)
+		require.NoError(t, err)
+		assert.EqualValues(t, 4, backup.ID)
+	})
+}
@@ -0,0 +1,136 @@
+package lsm
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint writes a consistent copy of the database to a new directory, which Open can open as a
+// database of its own, without stopping writes for longer than it takes to link its files.
+//
+// SSTables are hard linked rather than copied, so the directory must be on the same file system as
+// the database. Since SSTables are never modified, the checkpoint stays valid after the database
+// merges or deletes them.
+func (me *LSMDB) Checkpoint(dir string) (err error) {
+	ctx := &dbCtx{}
+	if err := me.checkStateError(ctx); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, os.ModeExclusive|0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	if err := os.Mkdir(filepath.Join(dir, "tmp"), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	logs, edit, err := me.linkCheckpointFiles(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	// writeahead logs are only ever appended to, so the synced prefixes of the linked logs are
+	// copied without holding the lock
+	for _, linked := range logs {
+		if err := copyFilePrefix(
+			linked.linkPath, filepath.Join(dir, filepath.Base(linked.linkPath)), linked.size,
+		); err != nil {
+			return err
+		}
+		if err := os.Remove(linked.linkPath); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	checkpointManifest, err := createManifest(dir, edit)
+	if err != nil {
+		return err
+	}
+	if err := checkpointManifest.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "tmp")); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// checkpointLog is a writeahead log linked into the tmp directory of a checkpoint, along with the
+// size it had been synced up to.
+type checkpointLog struct {
+	linkPath string
+	size     uint64
+}
+
+// linkCheckpointFiles hard links the SSTables of every column family into a checkpoint directory,
+// and the writeahead logs into its tmp directory, so that they are not lost when the database
+// deletes them. It returns the MANIFEST as of the same moment.
+func (me *LSMDB) linkCheckpointFiles(
+	ctx *dbCtx, dir string,
+) (logs []checkpointLog, _ VersionEdit, _ error) {
+	// holding the lock pauses the async worker and compactor before they change the set of files
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	// the write group being appended may as well be included
+	me.waitForLogWriter(ctx)
+
+	for _, family := range me.families {
+		familyDir := columnFamilyDir(dir, family.id)
+		if err := os.MkdirAll(familyDir, 0o755); err != nil {
+			return nil, VersionEdit{}, errors.WithStack(err)
+		}
+		for _, table := range family.sstables {
+			if err := os.Link(
+				table.Path(), filepath.Join(familyDir, filepath.Base(table.Path())),
+			); err != nil {
+				return nil, VersionEdit{}, errors.WithStack(err)
+			}
+		}
+	}
+
+	for _, writeAheadLog := range me.writeAheadLogs {
+		if err := writeAheadLog.Sync(); err != nil {
+			return nil, VersionEdit{}, errors.WithStack(err)
+		}
+		linkPath := filepath.Join(dir, "tmp", filepath.Base(writeAheadLog.Path()))
+		if err := os.Link(writeAheadLog.Path(), linkPath); err != nil {
+			return nil, VersionEdit{}, errors.WithStack(err)
+		}
+		logs = append(logs, checkpointLog{linkPath: linkPath, size: writeAheadLog.Size()})
+	}
+
+	return logs, me.manifest.snapshot(), nil
+}
+
+// copyFilePrefix copies the first size bytes of a file to a new file, and syncs it to disk.
+func copyFilePrefix(srcPath, destPath string, size uint64) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer src.Close()
+
+	dest, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer dest.Close()
+
+	if _, err := io.CopyN(dest, src, int64(size)); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := dest.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
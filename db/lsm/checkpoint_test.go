@@ -0,0 +1,85 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Checkpoint(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Checkpoint")
+	defer cleanup()
+
+	dbPath, checkpointPath := dir+"/db", dir+"/checkpoint"
+	openArgs := OpenArgs{
+		Path:           dbPath,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(2),
+		}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	require.NoError(t, err)
+
+	// keys before the checkpoint are spread over an SSTable and the writeahead log
+	const numKeys = 20
+	for i := range numKeys {
+		key := []byte(fmt.Sprintf("key %03d", i))
+		require.NoError(t, db.Upsert(key, []byte("before")))
+		require.NoError(t, users.Upsert(key, []byte("before")))
+		if i == numKeys/2 {
+			require.NoError(t, db.CreateSSTable())
+		}
+	}
+	waitForCompaction(t, db, 1)
+
+	require.NoError(t, db.Checkpoint(checkpointPath))
+	assert.Error(t, db.Checkpoint(checkpointPath), "the directory already exists")
+
+	// merging SSTables away after the checkpoint does not affect it
+	for i := range numKeys {
+		key := []byte(fmt.Sprintf("key %03d", i))
+		require.NoError(t, db.Upsert(key, []byte("after")))
+		require.NoError(t, users.Delete(key))
+	}
+	require.NoError(t, db.CreateSSTable())
+	waitForCompaction(t, db, 1)
+	require.NoError(t, db.Close())
+	require.NoError(t, os.RemoveAll(dbPath))
+
+	openArgs.Path, openArgs.Create = checkpointPath, false
+	checkpoint, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, checkpoint.Start())
+	defer checkpoint.Close()
+
+	checkpointUsers, exists := checkpoint.ColumnFamily("users")
+	require.True(t, exists)
+	for i := range numKeys {
+		key := []byte(fmt.Sprintf("key %03d", i))
+		for _, family := range []*ColumnFamily{checkpoint.DefaultColumnFamily(), checkpointUsers} {
+			entry, exists, err := family.Lookup(key)
+			_ = assert.NoError(t, err) && assert.True(t, exists) &&
+				assert.Equal(t, "before", string(entry.Value))
+		}
+	}
+
+	// the checkpoint is a database of its own
+	require.NoError(t, checkpoint.Upsert([]byte("key"), []byte("value")))
+	require.NoError(t, checkpoint.CreateSSTable())
+	waitForCompaction(t, checkpoint, 1)
+}
@@ -0,0 +1,293 @@
+package lsm
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+const defaultColumnFamilyName = "default"
+
+// ColumnFamilyOptions configures a column family. The options of the default column family are
+// set by the corresponding fields of OpenArgs, which document them.
+type ColumnFamilyOptions struct {
+	BloomFilterBitsPerKey util.Optional[uint64]
+	// An SSTable is created for every column family once any of them reaches its write buffer
+	// size, since column families share the writeahead log.
+	WriteBufferSize      util.Optional[uint64]
+	SizeTieredCompaction util.Optional[SizeTieredCompactionArgs]
+	LeveledCompaction    util.Optional[LeveledCompactionArgs]
+	MergeOperator        util.Optional[MergeOperator]
+	Comparator           util.Optional[Comparator]
+}
+
+// ColumnFamily is a keyspace of an LSMDB with its own in-memory indexes, SSTables, and options.
+// Column families share the writeahead log, so that a WriteBatch may write to several of them
+// atomically, and sequence numbers, so that a Snapshot covers all of them.
+//
+// The SSTables of the default column family are kept in the database directory, and those of
+// every other column family in a subdirectory of their own.
+type ColumnFamily struct {
+	db *LSMDB
+	id uint64
+	// immutable config
+	name                  string
+	bloomFilterBitsPerKey util.Optional[uint64]
+	writeBufferSize       util.Optional[uint64]
+	sizeTieredCompaction  util.Optional[SizeTieredCompactionArgs]
+	leveledCompaction     util.Optional[LeveledCompactionArgs]
+	mergeOperator         MergeOperator
+	comparator            Comparator
+
+	// state tracking, guarded by the DB lock
+	inMemoryIndexes []*InMemoryIndex
+	sstables        []*sstable.SSTable
+	// set once the column family is being dropped, after which it can no longer be written to,
+	// flushed or compacted
+	dropped bool
+}
+
+func newColumnFamily(
+	db *LSMDB, id uint64, name string, options ColumnFamilyOptions,
+) *ColumnFamily {
+	comparator := options.Comparator.Or(sstable.BytewiseComparator)
+	return &ColumnFamily{
+		db:                    db,
+		id:                    id,
+		name:                  name,
+		bloomFilterBitsPerKey: options.BloomFilterBitsPerKey,
+		writeBufferSize:       options.WriteBufferSize,
+		sizeTieredCompaction:  options.SizeTieredCompaction,
+		leveledCompaction:     options.LeveledCompaction,
+		mergeOperator:         options.MergeOperator.Or(nil),
+		comparator:            comparator,
+		// single empty in-memory index
+		inMemoryIndexes: []*InMemoryIndex{NewInMemoryIndex(comparator)},
+	}
+}
+
+func (me *ColumnFamilyOptions) validate() error {
+	_, isSizeTiered := me.SizeTieredCompaction.Unpack()
+	_, isLeveled := me.LeveledCompaction.Unpack()
+	if isSizeTiered && isLeveled {
+		return fmt.Errorf("at most one compaction strategy may be set")
+	}
+	return nil
+}
+
+// mergeOperatorName returns the name of the merge operator to record for a column family whose
+// operands were written for the stored merge operator, if any. Operands cannot be read back
+// without the operator they were written for.
+func (me *ColumnFamilyOptions) mergeOperatorName(family, stored string) (string, error) {
+	var name string
+	if mergeOperator, ok := me.MergeOperator.Unpack(); ok {
+		name = mergeOperator.Name()
+	}
+	if stored != "" && stored != name {
+		return name, fmt.Errorf(
+			"column family %q requires merge operator %q, but was opened with %q",
+			family, stored, name,
+		)
+	}
+	return name, nil
+}
+
+// Return the default column family, which the key-value methods of LSMDB operate on.
+func (me *LSMDB) DefaultColumnFamily() *ColumnFamily {
+	return me.defaultFamily
+}
+
+// Return the column family with the given name, if it exists.
+func (me *LSMDB) ColumnFamily(name string) (_ *ColumnFamily, exists bool) {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	for _, family := range me.families {
+		if family.name == name {
+			return family, true
+		}
+	}
+	return nil, false
+}
+
+// Create a new, empty column family.
+func (me *LSMDB) CreateColumnFamily(
+	name string, options ColumnFamilyOptions,
+) (*ColumnFamily, error) {
+	ctx := &dbCtx{}
+	if err := me.checkStateError(ctx); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	mergeOperatorName, _ := options.mergeOperatorName(name, "")
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	if name == "" {
+		return nil, fmt.Errorf("column family name must not be empty")
+	}
+	for _, family := range me.families {
+		if family.name == name {
+			return nil, fmt.Errorf("column family %q already exists", name)
+		}
+	}
+
+	family := newColumnFamily(me, me.manifest.nextColumnFamilyID, name, options)
+
+	// the directory is created after the MANIFEST lists the column family, or it would be
+	// mistaken for an orphan
+	if err := me.logVersionEdit(ctx, VersionEdit{
+		NextColumnFamilyID: family.id + 1,
+		AddedColumnFamilies: []ColumnFamilyMetadata{{
+			ID:                family.id,
+			Name:              name,
+			MergeOperatorName: mergeOperatorName,
+		}},
+	}); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(family.dir(), 0o755); err != nil {
+		err = errors.WithStack(err)
+		me.stateErr = err
+		return nil, err
+	}
+
+	me.families[family.id] = family
+	return family, nil
+}
+
+// Drop a column family along with all of its data. Pending flushes and merges of the column family
+// are waited for first. The default column family cannot be dropped.
+func (me *LSMDB) DropColumnFamily(family *ColumnFamily) error {
+	ctx := &dbCtx{}
+	if err := me.checkStateError(ctx); err != nil {
+		return err
+	}
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	if err := me.checkColumnFamily(family); err != nil {
+		return err
+	}
+	if family == me.defaultFamily {
+		return fmt.Errorf("the default column family cannot be dropped")
+	}
+
+	// stop new writes, flushes and merges
+	family.dropped = true
+
+	for {
+		// merges that have yet to start are abandoned
+		me.pendingMerges = slices.DeleteFunc(me.pendingMerges, func(entry MergeTablesEntry) bool {
+			if inputFamily, _, _ := me.findMergeInputs(entry); inputFamily != family {
+				return false
+			}
+			for _, number := range entry.InputSSTableNumbers {
+				delete(me.compactingSSTables, number)
+			}
+			return true
+		})
+
+		isFlushing := len(family.inMemoryIndexes) > 1
+		isCompacting := slices.ContainsFunc(family.sstables, func(table *sstable.SSTable) bool {
+			_, ok := me.compactingSSTables[sstableNumber(table)]
+			return ok
+		})
+		if !isFlushing && !isCompacting {
+			break
+		}
+
+		select {
+		case <-me.done:
+			return fmt.Errorf("database is closed")
+		default:
+		}
+
+		if isFlushing {
+			me.flushed.Wait()
+		} else {
+			me.compacted.Wait()
+		}
+	}
+
+	edit := VersionEdit{DroppedColumnFamilies: []uint64{family.id}}
+	for _, table := range family.sstables {
+		edit.RemovedSSTables = append(edit.RemovedSSTables, sstableNumber(table))
+	}
+	if err := me.logVersionEdit(ctx, edit); err != nil {
+		return err
+	}
+	delete(me.families, family.id)
+
+	// SSTables still in use by readers are deleted once they are released, and the directory is
+	// then removed as an orphan when the database is next opened
+	for _, table := range family.sstables {
+		me.obsoleteSSTables[table] = family
+	}
+	me.acquireSSTables(family.sstables)
+	me.releaseSSTables(ctx, family.sstables)
+	family.sstables = nil
+	family.inMemoryIndexes = []*InMemoryIndex{NewInMemoryIndex(family.comparator)}
+
+	if err := os.Remove(family.dir()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to remove column family directory: %s\n", err.Error())
+	}
+
+	return nil
+}
+
+// checkColumnFamily returns an error if a column family cannot be used with the database. The
+// caller must hold the lock.
+func (me *LSMDB) checkColumnFamily(family *ColumnFamily) error {
+	if family.db != me {
+		return fmt.Errorf("column family %q belongs to another database", family.name)
+	}
+	if family.dropped {
+		return fmt.Errorf("column family %q was dropped", family.name)
+	}
+	return nil
+}
+
+// liveColumnFamilies returns the column families that have not been dropped, sorted by ID so that
+// the default column family comes first. The caller must hold the lock.
+func (me *LSMDB) liveColumnFamilies() []*ColumnFamily {
+	out := slices.SortedFunc(maps.Values(me.families), func(a, b *ColumnFamily) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	return slices.DeleteFunc(out, func(family *ColumnFamily) bool {
+		return family.dropped
+	})
+}
+
+func (me *ColumnFamily) Name() string {
+	return me.name
+}
+
+// dir returns the directory holding the column family's SSTables.
+func (me *ColumnFamily) dir() string {
+	return columnFamilyDir(me.db.path, me.id)
+}
+
+func (me *ColumnFamily) sstablePath(tableNumber uint64) string {
+	return filepath.Join(me.dir(), fmt.Sprintf("sstable_%d.sst", tableNumber))
+}
+
+func columnFamilyDir(dbPath string, id uint64) string {
+	if id == 0 {
+		return dbPath
+	}
+	return filepath.Join(dbPath, fmt.Sprintf("column_family_%d", id))
+}
@@ -0,0 +1,215 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_ColumnFamilies(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_ColumnFamilies")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		ColumnFamilies: map[string]ColumnFamilyOptions{
+			"counters": {
+				SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+					MinMergeWidth: util.Some(4),
+				}),
+				MergeOperator: util.Some[MergeOperator](counterOperator{}),
+			},
+		},
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	require.NoError(t, err)
+	counters, err := db.CreateColumnFamily("counters", openArgs.ColumnFamilies["counters"])
+	require.NoError(t, err)
+
+	assertValue := func(t *testing.T, family *ColumnFamily, key, expected string) {
+		t.Helper()
+		entry, exists, err := family.Lookup([]byte(key))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, expected, string(entry.Value))
+	}
+	assertMissing := func(t *testing.T, family *ColumnFamily, key string) {
+		t.Helper()
+		_, exists, err := family.Lookup([]byte(key))
+		_ = assert.NoError(t, err) && assert.False(t, exists)
+	}
+
+	t.Run("create", func(t *testing.T) {
+		_, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+		assert.ErrorContains(t, err, "already exists")
+		_, err = db.CreateColumnFamily(defaultColumnFamilyName, ColumnFamilyOptions{})
+		assert.ErrorContains(t, err, "already exists")
+
+		family, exists := db.ColumnFamily("users")
+		_ = assert.True(t, exists) && assert.Same(t, users, family)
+		assert.Same(t, db.DefaultColumnFamily(), db.defaultFamily)
+		assert.DirExists(t, users.dir())
+	})
+
+	t.Run("keyspaces are isolated", func(t *testing.T) {
+		require.NoError(t, db.Upsert([]byte("shared"), []byte("default")))
+		require.NoError(t, users.Upsert([]byte("shared"), []byte("users")))
+		require.NoError(t, users.Upsert([]byte("alice"), []byte("1")))
+
+		assertValue(t, db.DefaultColumnFamily(), "shared", "default")
+		assertValue(t, users, "shared", "users")
+		assertMissing(t, db.DefaultColumnFamily(), "alice")
+		assertMissing(t, counters, "shared")
+
+		var keys []string
+		for kvp, err := range users.Scan(nil, nil) {
+			require.NoError(t, err)
+			keys = append(keys, string(kvp.Key))
+		}
+		assert.Equal(t, []string{"alice", "shared"}, keys)
+
+		cursor := db.NewCursor(CursorArgs{ColumnFamily: users})
+		defer cursor.Close()
+		if assert.True(t, cursor.First()) {
+			assert.Equal(t, "alice", string(cursor.Entry().Key))
+		}
+
+		// merge operators are per column family
+		assert.Error(t, db.Merge([]byte("alice"), []byte("1")))
+		assert.Error(t, users.Merge([]byte("alice"), []byte("1")))
+	})
+
+	t.Run("write batch across column families", func(t *testing.T) {
+		snapshot := db.NewSnapshot()
+		defer snapshot.Release()
+
+		var batch WriteBatch
+		batch.Put([]byte("batch"), []byte("default"))
+		batch.PutCF(users, []byte("batch"), []byte("users"))
+		batch.DeleteCF(users, []byte("alice"))
+		require.NoError(t, db.Write(&batch))
+
+		assertValue(t, db.DefaultColumnFamily(), "batch", "default")
+		assertValue(t, users, "batch", "users")
+		entry, _, err := users.Lookup([]byte("alice"))
+		_ = assert.NoError(t, err) && assert.True(t, entry.IsDeleted)
+
+		// a snapshot covers every column family
+		_, exists, err := users.LookupAt([]byte("batch"), snapshot)
+		_ = assert.NoError(t, err) && assert.False(t, exists)
+		entry, _, err = users.LookupAt([]byte("alice"), snapshot)
+		_ = assert.NoError(t, err) && assert.Equal(t, "1", string(entry.Value))
+	})
+
+	// every round adds to the same counters, so they end up spread over many SSTables
+	const numRounds, numKeys = 8, 10
+	for range numRounds {
+		for i := range numKeys {
+			require.NoError(t, counters.Merge([]byte(fmt.Sprintf("key %03d", i)), []byte("1")))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+	waitForColumnFamilyCompaction(t, counters, 4)
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		users, _ := db.ColumnFamily("users")
+		counters, _ := db.ColumnFamily("counters")
+
+		assertValue(t, db.DefaultColumnFamily(), "shared", "default")
+		assertValue(t, users, "shared", "users")
+		assertValue(t, users, "batch", "users")
+		for i := range numKeys {
+			assertValue(t, counters, fmt.Sprintf("key %03d", i), fmt.Sprint(numRounds))
+		}
+		assertMissing(t, counters, "shared")
+	}
+
+	t.Run("flush and compaction", func(t *testing.T) {
+		db.lock.RLock()
+		assert.NotEmpty(t, users.sstables)
+		assert.LessOrEqual(t, len(counters.sstables), 4)
+		for _, table := range counters.sstables {
+			assert.Equal(t, counters.dir(), filepath.Dir(table.Path()))
+		}
+		db.lock.RUnlock()
+
+		assertContents(t, db)
+	})
+	require.NoError(t, db.Close())
+
+	openArgs.Create = false
+
+	t.Run("re-open database", func(t *testing.T) {
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assertContents(t, sameDB)
+	})
+
+	t.Run("re-open with the wrong merge operator", func(t *testing.T) {
+		_, err := Open(OpenArgs{Path: dir})
+		assert.ErrorContains(t, err, `column family "counters" requires merge operator "counter"`)
+	})
+
+	t.Run("drop column family", func(t *testing.T) {
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+
+		users, _ := sameDB.ColumnFamily("users")
+		require.NoError(t, sameDB.DropColumnFamily(users))
+		assert.NoDirExists(t, users.dir())
+
+		_, exists := sameDB.ColumnFamily("users")
+		assert.False(t, exists)
+		assert.Error(t, users.Upsert([]byte("key"), []byte("value")))
+		_, _, err = users.Lookup([]byte("shared"))
+		assert.Error(t, err)
+		assert.Error(t, sameDB.DropColumnFamily(users))
+		assert.Error(t, sameDB.DropColumnFamily(sameDB.DefaultColumnFamily()))
+
+		var batch WriteBatch
+		batch.PutCF(users, []byte("key"), []byte("value"))
+		assert.Error(t, sameDB.Write(&batch))
+
+		// a new column family may reuse the name
+		newUsers, err := sameDB.CreateColumnFamily("users", ColumnFamilyOptions{})
+		require.NoError(t, err)
+		assert.NotEqual(t, users.id, newUsers.id)
+		assertMissing(t, newUsers, "shared")
+		require.NoError(t, sameDB.Close())
+
+		// a directory left behind by a crash is removed as an orphan
+		require.NoError(t, os.MkdirAll(users.dir(), 0o755))
+
+		sameDB, err = Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assert.NoDirExists(t, users.dir())
+		newUsers, exists = sameDB.ColumnFamily("users")
+		if assert.True(t, exists) {
+			assertMissing(t, newUsers, "shared")
+		}
+		counters, _ := sameDB.ColumnFamily("counters")
+		assertValue(t, counters, "key 000", fmt.Sprint(numRounds))
+	})
+}
@@ -0,0 +1,559 @@
+package lsm
+
+import (
+	"cmp"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+// Size-tiered compaction merges runs of adjacent SSTables of similar size into a single SSTable,
+// so that the number of SSTables grows logarithmically with the amount of data.
+type SizeTieredCompactionArgs struct {
+	// Minimum number of SSTables to merge at once; defaults to 4
+	MinMergeWidth util.Optional[int]
+	// Maximum number of SSTables to merge at once; defaults to 32
+	MaxMergeWidth util.Optional[int]
+	// SSTables are similarly sized if the largest is at most this many times the size of the
+	// smallest; defaults to 2
+	SizeRatio util.Optional[float64]
+}
+
+// Leveled compaction keeps freshly flushed SSTables in level 0, and merges them into levels of
+// SSTables with non-overlapping key ranges, each several times larger than the previous one.
+type LeveledCompactionArgs struct {
+	// Number of level 0 SSTables that triggers merging them into level 1; defaults to 4
+	Level0MergeTrigger util.Optional[int]
+	// Target total size in bytes of level 1; defaults to 10 MiB
+	BaseLevelSize util.Optional[uint64]
+	// Each level beyond level 1 targets this many times the size of the previous level; defaults
+	// to 10
+	LevelSizeMultiplier util.Optional[uint64]
+}
+
+const (
+	defaultMinMergeWidth = 4
+	defaultMaxMergeWidth = 32
+	defaultSizeRatio     = 2.0
+
+	defaultLevel0MergeTrigger  = 4
+	defaultBaseLevelSize       = 10 << 20
+	defaultLevelSizeMultiplier = 10
+)
+
+// scheduleCompaction wakes up the compactor, unless it has already been woken up.
+func (me *LSMDB) scheduleCompaction() {
+	select {
+	case me.compactionSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (me *LSMDB) runCompactor() {
+	defer me.wg.Done()
+
+	ctx := &dbCtx{}
+	for {
+		select {
+		case <-me.compactionSignal:
+		case <-me.done:
+			return
+		}
+
+		for {
+			entry, exists, err := me.nextMergeTablesEntry(ctx)
+			if err != nil {
+				log.Printf("Failed to start SSTable merge: %s", err.Error())
+				me.events.backgroundError(err)
+				break
+			}
+			if !exists {
+				break
+			}
+
+			if err := me.processMergeTablesEntryAsync(ctx, entry); err != nil {
+				log.Printf("Failed to merge SSTables: %s", err.Error())
+				me.events.backgroundError(err)
+				// retry the same merge when the compactor is next woken up
+				ctx.Lock(&me.lock)
+				me.pendingMerges = slices.Insert(me.pendingMerges, 0, entry)
+				// a column family being dropped abandons the merge instead
+				me.compacted.Broadcast()
+				ctx.Unlock(&me.lock)
+				break
+			}
+
+			select {
+			case <-me.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// nextMergeTablesEntry returns the next merge to perform: either one recovered from the
+// writeahead log, or a new one picked by the compaction strategy of a column family. New merges
+// are logged before being returned.
+func (me *LSMDB) nextMergeTablesEntry(ctx *dbCtx) (out MergeTablesEntry, exists bool, _ error) {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+	me.waitForLogWriter(ctx)
+
+	if me.stateErr != nil {
+		return out, false, nil
+	}
+
+	if len(me.pendingMerges) > 0 {
+		out = me.pendingMerges[0]
+		me.pendingMerges = me.pendingMerges[1:]
+		return out, true, nil
+	}
+
+	var (
+		inputs []*sstable.SSTable
+		level  uint64
+	)
+	for _, family := range me.liveColumnFamilies() {
+		if args, ok := family.sizeTieredCompaction.Unpack(); ok {
+			inputs = me.pickSizeTieredMerge(family, args)
+		} else if args, ok := family.leveledCompaction.Unpack(); ok {
+			inputs, level = me.pickLeveledMerge(family, args)
+		}
+		if len(inputs) > 0 {
+			break
+		}
+	}
+	if len(inputs) == 0 {
+		return out, false, nil
+	}
+
+	out = MergeTablesEntry{
+		SSTableNumber:       me.nextSSTableNumber,
+		Level:               level,
+		InputSSTableNumbers: make([]uint64, 0, len(inputs)),
+	}
+	for _, input := range inputs {
+		out.InputSSTableNumbers = append(out.InputSSTableNumbers, sstableNumber(input))
+	}
+
+	if err := me.appendEntry(ctx, &out); err != nil {
+		me.stateErr = err
+		return out, false, err
+	}
+	me.nextSSTableNumber++
+
+	for _, number := range out.InputSSTableNumbers {
+		me.compactingSSTables[number] = struct{}{}
+	}
+
+	return out, true, nil
+}
+
+// pickSizeTieredMerge returns the oldest run of adjacent, similarly sized level 0 SSTables of a
+// column family that are not already being merged, or nil if no run is long enough. Only adjacent
+// SSTables may be merged, so that SSTables remain ordered by the age of their data.
+func (me *LSMDB) pickSizeTieredMerge(
+	family *ColumnFamily, args SizeTieredCompactionArgs,
+) []*sstable.SSTable {
+	tables := family.sstables
+	var (
+		minWidth  = max(args.MinMergeWidth.Or(defaultMinMergeWidth), 2)
+		maxWidth  = max(args.MaxMergeWidth.Or(defaultMaxMergeWidth), minWidth)
+		sizeRatio = args.SizeRatio.Or(defaultSizeRatio)
+	)
+
+	isCompacting := func(idx int) bool {
+		_, ok := me.compactingSSTables[sstableNumber(tables[idx])]
+		return ok
+	}
+
+	// level 0 SSTables come first, sorted newest first, so walk backwards to find the oldest run
+	numLevel0 := 0
+	for numLevel0 < len(tables) && tables[numLevel0].Level() == 0 {
+		numLevel0++
+	}
+	for hi := numLevel0 - 1; hi >= minWidth-1; hi-- {
+		if isCompacting(hi) {
+			continue
+		}
+
+		minSize := tables[hi].Header().FileSize
+		maxSize := minSize
+		lo := hi
+		for lo > 0 && hi-lo+1 < maxWidth && !isCompacting(lo-1) {
+			size := tables[lo-1].Header().FileSize
+			if float64(max(maxSize, size)) > sizeRatio*float64(min(minSize, size)) {
+				break
+			}
+			minSize, maxSize = min(minSize, size), max(maxSize, size)
+			lo--
+		}
+
+		if hi-lo+1 >= minWidth {
+			return slices.Clone(tables[lo : hi+1])
+		}
+	}
+
+	return nil
+}
+
+// pickLeveledMerge returns the SSTables of a column family to merge and the level to merge them
+// into, or nil if every level is within its target. Level 0 is merged into level 1 once it has enough SSTables;
+// otherwise the oldest SSTable of the first level over its target size is merged into the next
+// level. Either way, the SSTables of the next level overlapping the inputs are merged too, so that
+// levels beyond level 0 never overlap.
+func (me *LSMDB) pickLeveledMerge(
+	family *ColumnFamily, args LeveledCompactionArgs,
+) (_ []*sstable.SSTable, level uint64) {
+	var (
+		level0MergeTrigger  = max(args.Level0MergeTrigger.Or(defaultLevel0MergeTrigger), 1)
+		targetSize          = args.BaseLevelSize.Or(defaultBaseLevelSize)
+		levelSizeMultiplier = max(args.LevelSizeMultiplier.Or(defaultLevelSizeMultiplier), 1)
+	)
+
+	var levels [][]*sstable.SSTable
+	for _, table := range family.sstables {
+		for uint64(len(levels)) <= table.Level() {
+			levels = append(levels, nil)
+		}
+		levels[table.Level()] = append(levels[table.Level()], table)
+	}
+	tablesAt := func(level uint64) []*sstable.SSTable {
+		if level < uint64(len(levels)) {
+			return levels[level]
+		}
+		return nil
+	}
+
+	withOverlapping := func(inputs []*sstable.SSTable, level uint64) []*sstable.SSTable {
+		if firstKey, lastKey, ok := sstablesKeyRange(family.comparator, inputs); ok {
+			for _, table := range tablesAt(level) {
+				if sstableOverlaps(family.comparator, table, firstKey, lastKey) {
+					inputs = append(inputs, table)
+				}
+			}
+		}
+		// wait for pending merges of the same SSTables to finish first
+		if slices.ContainsFunc(inputs, func(table *sstable.SSTable) bool {
+			_, ok := me.compactingSSTables[sstableNumber(table)]
+			return ok
+		}) {
+			return nil
+		}
+		return inputs
+	}
+
+	if level0 := tablesAt(0); len(level0) >= level0MergeTrigger {
+		return withOverlapping(slices.Clone(level0), 1), 1
+	}
+
+	for level := uint64(1); level < uint64(len(levels)); level++ {
+		var size uint64
+		for _, table := range levels[level] {
+			size += table.Header().FileSize
+		}
+		if size > targetSize {
+			oldest := slices.MinFunc(levels[level], func(a, b *sstable.SSTable) int {
+				return cmp.Compare(a.MaxSequenceNumber(), b.MaxSequenceNumber())
+			})
+			return withOverlapping([]*sstable.SSTable{oldest}, level+1), level + 1
+		}
+		targetSize *= levelSizeMultiplier
+	}
+
+	return nil, 0
+}
+
+// processMergeTablesEntry recovers a merge logged in the writeahead log. Unless the MANIFEST
+// already lists the merged SSTable, the merge is handed to the compactor to be redone.
+func (me *LSMDB) processMergeTablesEntry(ctx *dbCtx, entry MergeTablesEntry) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	me.nextSSTableNumber = max(me.nextSSTableNumber, entry.SSTableNumber+1)
+
+	// the inputs were removed from the MANIFEST along with the merged SSTable being added, so
+	// any remaining input files were removed as orphans
+	if me.manifest.hasSSTable(entry.SSTableNumber) {
+		return nil
+	}
+
+	if _, _, ok := me.findMergeInputs(entry); !ok {
+		// the merged SSTable must have been merged again since
+		log.Printf("Inputs of SSTable %d no longer exist; skipping", entry.SSTableNumber)
+		return nil
+	}
+
+	for _, number := range entry.InputSSTableNumbers {
+		me.compactingSSTables[number] = struct{}{}
+	}
+	me.pendingMerges = append(me.pendingMerges, entry)
+
+	return nil
+}
+
+// processMergeTablesEntryAsync merges the input SSTables without holding the lock, then swaps
+// the merged SSTable in for the inputs.
+func (me *LSMDB) processMergeTablesEntryAsync(ctx *dbCtx, entry MergeTablesEntry) (err error) {
+	ctx.Lock(&me.lock)
+	family, inputs, ok := me.findMergeInputs(entry)
+	if !ok {
+		for _, number := range entry.InputSSTableNumbers {
+			delete(me.compactingSSTables, number)
+		}
+		me.compacted.Broadcast()
+		ctx.Unlock(&me.lock)
+		log.Printf("Inputs of SSTable %d no longer exist; skipping", entry.SSTableNumber)
+		return nil
+	}
+	me.acquireSSTables(inputs)
+	snapshots := me.liveSnapshots(ctx)
+	dropTombstones := holdsOldestData(family, inputs)
+	ctx.Unlock(&me.lock)
+
+	defer me.releaseSSTables(ctx, inputs)
+
+	start := time.Now()
+	info := MergeInfo{
+		ColumnFamily:        family.name,
+		InputSSTableNumbers: entry.InputSSTableNumbers,
+		OutputSSTableNumber: entry.SSTableNumber,
+		OutputLevel:         entry.Level,
+	}
+	for _, input := range inputs {
+		info.InputBytes += sstableSize(input)
+	}
+	me.events.mergeBegin(info)
+	defer func() {
+		info.Duration = time.Since(start)
+		info.Err = err
+		me.events.mergeEnd(info)
+	}()
+
+	// first merge the inputs into a temporary SSTable
+	file, err := os.CreateTemp(filepath.Join(me.path, "tmp"), "sstable_")
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(file.Name())
+	defer os.Remove(file.Name())
+	_ = file.Close()
+
+	sstableFile, err := sstable.Open(sstable.OpenArgs{
+		Path:                  file.Name(),
+		Create:                true,
+		IndexChunkSize:        me.indexChunkSize,
+		BloomFilterBitsPerKey: family.bloomFilterBitsPerKey,
+		BlockCache:            me.blockCache,
+		Level:                 entry.Level,
+		Comparator:            util.Some(family.comparator),
+	})
+	if err != nil {
+		return err
+	}
+
+	// add the oldest inputs first, so that newer inputs win ties
+	srcs := slices.Clone(inputs)
+	slices.Reverse(srcs)
+	if err := sstableFile.MergeTables(sstable.MergeTablesArgs{
+		Srcs:           srcs,
+		Snapshots:      snapshots,
+		DropTombstones: dropTombstones,
+		Now:            util.Some(me.clock()),
+		MergeOperator:  family.mergeOperator,
+	}); err != nil {
+		_ = sstableFile.Close()
+		return err
+	}
+	info.OutputBytes = sstableSize(&sstableFile)
+
+	// then move the file to the SSTable canonical location
+	if err := sstableFile.Rename(family.sstablePath(entry.SSTableNumber)); err != nil {
+		_ = sstableFile.Close()
+		return err
+	}
+	me.stats.merges.observe(time.Since(start).Seconds())
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	edit := VersionEdit{
+		NextSSTableNumber: entry.SSTableNumber + 1,
+		AddedSSTables:     []SSTableMetadata{newSSTableMetadata(&sstableFile)},
+	}
+	for _, input := range inputs {
+		edit.RemovedSSTables = append(edit.RemovedSSTables, sstableNumber(input))
+	}
+	if err := me.logVersionEdit(ctx, edit); err != nil {
+		_ = sstableFile.Close()
+		return err
+	}
+	me.events.sstableCreated(newSSTableInfo(family, &sstableFile))
+
+	family.sstables = slices.DeleteFunc(family.sstables, func(table *sstable.SSTable) bool {
+		return slices.Contains(inputs, table)
+	})
+	family.sstables = append(family.sstables, &sstableFile)
+	sortSSTables(family.comparator, family.sstables)
+
+	for _, input := range inputs {
+		delete(me.compactingSSTables, sstableNumber(input))
+		me.obsoleteSSTables[input] = family
+	}
+	me.compacted.Broadcast()
+
+	// the merged SSTable may now be similar in size to its neighbors, or overflow its level
+	me.scheduleCompaction()
+
+	return nil
+}
+
+// findMergeInputs returns the inputs of a merge, newest first, along with their column family, if
+// they all still exist.
+func (me *LSMDB) findMergeInputs(
+	entry MergeTablesEntry,
+) (family *ColumnFamily, out []*sstable.SSTable, ok bool) {
+	for _, family := range me.families {
+		for _, table := range family.sstables {
+			if slices.Contains(entry.InputSSTableNumbers, sstableNumber(table)) {
+				out = append(out, table)
+			}
+		}
+		if len(out) > 0 {
+			return family, out, len(out) == len(entry.InputSSTableNumbers)
+		}
+	}
+	return nil, nil, false
+}
+
+// holdsOldestData reports whether no SSTable of a column family besides the given ones holds older
+// data for their key range, in which case merging them leaves nothing for tombstones to shadow.
+func holdsOldestData(family *ColumnFamily, tables []*sstable.SSTable) bool {
+	firstKey, lastKey, ok := sstablesKeyRange(family.comparator, tables)
+	if !ok {
+		return true
+	}
+
+	// SSTables are sorted in search order, so older data can only come after the newest table
+	start := slices.Index(family.sstables, tables[0])
+	for _, table := range family.sstables[start:] {
+		if !slices.Contains(tables, table) &&
+			sstableOverlaps(family.comparator, table, firstKey, lastKey) {
+			return false
+		}
+	}
+	return true
+}
+
+// acquireSSTables prevents SSTables from being deleted until they are released. The caller must
+// hold the lock, if only for reading.
+func (me *LSMDB) acquireSSTables(tables []*sstable.SSTable) {
+	me.pinLock.Lock()
+	defer me.pinLock.Unlock()
+
+	for _, table := range tables {
+		me.sstableRefs[table]++
+	}
+}
+
+// releaseSSTables releases SSTables acquired by acquireSSTables, deleting those that have been
+// replaced by a merge and are no longer in use.
+func (me *LSMDB) releaseSSTables(ctx *dbCtx, tables []*sstable.SSTable) {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	for _, table := range tables {
+		me.sstableRefs[table]--
+		if me.sstableRefs[table] > 0 {
+			continue
+		}
+		delete(me.sstableRefs, table)
+
+		if family, ok := me.obsoleteSSTables[table]; ok {
+			delete(me.obsoleteSSTables, table)
+			me.blockCache.EvictTable(table.Header().ID)
+			_ = table.Close()
+			if err := os.Remove(table.Path()); err != nil {
+				log.Printf("Failed to remove merged SSTable: %s\n", err.Error())
+			} else {
+				me.events.sstableDeleted(newSSTableInfo(family, table))
+			}
+		}
+	}
+}
+
+// sortSSTables sorts SSTables in the order they must be searched: by level, then level 0 newest
+// first, then higher levels by key range.
+func sortSSTables(comparator Comparator, tables []*sstable.SSTable) {
+	slices.SortFunc(tables, func(a, b *sstable.SSTable) int {
+		if levelComp := cmp.Compare(a.Level(), b.Level()); levelComp != 0 {
+			return levelComp
+		}
+		if a.Level() > 0 {
+			firstKey1, _ := a.KeyRange()
+			firstKey2, _ := b.KeyRange()
+			return comparator.Compare(firstKey1, firstKey2)
+		}
+		// a merged SSTable gets a higher number than SSTables created after its inputs, so the
+		// age of the data it holds decides its position
+		if seqComp := cmp.Compare(b.MaxSequenceNumber(), a.MaxSequenceNumber()); seqComp != 0 {
+			return seqComp
+		}
+		return cmp.Compare(sstableNumber(b), sstableNumber(a))
+	})
+}
+
+// sstableContainsKey reports whether a key falls within the key range of an SSTable.
+func sstableContainsKey(comparator Comparator, table *sstable.SSTable, key []byte) bool {
+	return sstableOverlaps(comparator, table, key, key)
+}
+
+// sstableOverlaps reports whether the key range of an SSTable overlaps the given key range.
+func sstableOverlaps(
+	comparator Comparator, table *sstable.SSTable, firstKey, lastKey []byte,
+) bool {
+	if table.Header().NumEntries == 0 {
+		return false
+	}
+	tableFirstKey, tableLastKey := table.KeyRange()
+	return comparator.Compare(tableFirstKey, lastKey) <= 0 &&
+		comparator.Compare(firstKey, tableLastKey) <= 0
+}
+
+// sstablesKeyRange returns the lowest and highest keys of several SSTables, or ok=false if they
+// are all empty.
+func sstablesKeyRange(
+	comparator Comparator, tables []*sstable.SSTable,
+) (firstKey, lastKey []byte, ok bool) {
+	for _, table := range tables {
+		if table.Header().NumEntries == 0 {
+			continue
+		}
+		tableFirstKey, tableLastKey := table.KeyRange()
+		if !ok || comparator.Compare(tableFirstKey, firstKey) < 0 {
+			firstKey = tableFirstKey
+		}
+		if !ok || comparator.Compare(tableLastKey, lastKey) > 0 {
+			lastKey = tableLastKey
+		}
+		ok = true
+	}
+	return firstKey, lastKey, ok
+}
+
+func sstableNumber(table *sstable.SSTable) uint64 {
+	number, _ := getFileNumber(table.Path(), "sstable_", ".sst")
+	return number
+}
+
+// sstableSize returns the size of an SSTable file, including its bloom filter.
+func sstableSize(table *sstable.SSTable) uint64 {
+	header := table.Header()
+	return header.FileSize + header.FilterSize
+}
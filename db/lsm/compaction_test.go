@@ -0,0 +1,500 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_SizeTieredCompaction(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_SizeTieredCompaction")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(4),
+		}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+
+	// every round overwrites the same keys, and deletes the keys of the previous round
+	const numRounds, numKeys = 12, 20
+	for round := range numRounds {
+		for i := range numKeys {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d-%d", round, i)),
+			))
+			if round > 0 {
+				require.NoError(t, db.Delete([]byte(fmt.Sprintf("old %d-%03d", round-1, i))))
+			}
+			require.NoError(t, db.Upsert([]byte(fmt.Sprintf("old %d-%03d", round, i)), []byte("v")))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+
+	waitForCompaction(t, db, 4)
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		for i := range numKeys {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			entry, exists, err := db.Lookup(key)
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, fmt.Sprintf("value %d-%d", numRounds-1, i), string(entry.Value))
+			}
+		}
+
+		var keys []string
+		for kvp, err := range db.Scan(nil, nil) {
+			require.NoError(t, err)
+			keys = append(keys, string(kvp.Key))
+		}
+		assert.Len(t, keys, 2*numKeys)
+	}
+
+	t.Run("contents after compaction", func(t *testing.T) {
+		assertContents(t, db)
+		assertSSTableFiles(t, db)
+	})
+	require.NoError(t, db.Close())
+
+	openArgs.Create = false
+	sameDB, err := Open(openArgs)
+	require.NoError(t, err)
+
+	require.NoError(t, sameDB.Start())
+	defer sameDB.Close()
+
+	t.Run("contents after reopening", func(t *testing.T) {
+		assertContents(t, sameDB)
+		assertSSTableFiles(t, sameDB)
+	})
+}
+
+func TestLSMDB_LeveledCompaction(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_LeveledCompaction")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		LeveledCompaction: util.Some(LeveledCompactionArgs{
+			Level0MergeTrigger:  util.Some(2),
+			BaseLevelSize:       util.Some(uint64(2000)),
+			LevelSizeMultiplier: util.Some(uint64(2)),
+		}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+
+	// every round overwrites a sliding window of keys
+	const numRounds, numKeys = 16, 20
+	for round := range numRounds {
+		for i := range numKeys {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", round*5+i)),
+				[]byte(fmt.Sprintf("value %d-%d", round, i)),
+			))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+
+	waitForCompaction(t, db, numRounds)
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		const numDistinctKeys = (numRounds-1)*5 + numKeys
+		for key := range numDistinctKeys {
+			// the last round to write a key wins
+			round := min(key/5, numRounds-1)
+			entry, exists, err := db.Lookup([]byte(fmt.Sprintf("key %03d", key)))
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, fmt.Sprintf("value %d-%d", round, key-round*5), string(entry.Value))
+			}
+		}
+
+		var keys []string
+		for kvp, err := range db.Scan(nil, nil) {
+			require.NoError(t, err)
+			keys = append(keys, string(kvp.Key))
+		}
+		assert.Len(t, keys, numDistinctKeys)
+	}
+
+	assertLevels := func(t *testing.T, db *LSMDB) {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+
+		var maxLevel uint64
+		for i, table := range db.defaultFamily.sstables {
+			maxLevel = max(maxLevel, table.Level())
+			if i == 0 || table.Level() == 0 || table.Level() != db.defaultFamily.sstables[i-1].Level() {
+				continue
+			}
+			// SSTables beyond level 0 are sorted by key range and must not overlap
+			_, prevLastKey := db.defaultFamily.sstables[i-1].KeyRange()
+			firstKey, _ := table.KeyRange()
+			assert.Less(t, string(prevLastKey), string(firstKey))
+		}
+		assert.Greater(t, maxLevel, uint64(1))
+	}
+
+	t.Run("contents after compaction", func(t *testing.T) {
+		assertContents(t, db)
+		assertLevels(t, db)
+		assertSSTableFiles(t, db)
+	})
+	require.NoError(t, db.Close())
+
+	openArgs.Create = false
+	sameDB, err := Open(openArgs)
+	require.NoError(t, err)
+
+	require.NoError(t, sameDB.Start())
+	defer sameDB.Close()
+
+	t.Run("contents after reopening", func(t *testing.T) {
+		assertContents(t, sameDB)
+		assertLevels(t, sameDB)
+		assertSSTableFiles(t, sameDB)
+	})
+
+	t.Run("multiple compaction strategies", func(t *testing.T) {
+		_, err := Open(OpenArgs{
+			Path:                 dir,
+			SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{}),
+			LeveledCompaction:    util.Some(LeveledCompactionArgs{}),
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestLSMDB_DropTombstones(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_DropTombstones")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(2),
+			SizeRatio:     util.Some(100.0),
+		}),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	const numKeys = 20
+	for i := range numKeys {
+		require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("value")))
+	}
+	require.NoError(t, db.CreateSSTable())
+
+	// the snapshot is taken after deleting the first key, but before deleting the others
+	require.NoError(t, db.Delete([]byte("key 000")))
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	for i := 1; i < numKeys; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key %03d", i))))
+	}
+	require.NoError(t, db.CreateSSTable())
+
+	waitForCompaction(t, db, 1)
+
+	db.lock.RLock()
+	require.Len(t, db.defaultFamily.sstables, 1)
+	// the tombstone of the first key is visible to the snapshot, and so is dropped along with the
+	// versions it shadows; the other keys are still visible to the snapshot
+	assert.EqualValues(t, 2*(numKeys-1), db.defaultFamily.sstables[0].Header().NumEntries)
+	db.lock.RUnlock()
+
+	_, exists, err := db.Lookup([]byte("key 000"))
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	for i := 1; i < numKeys; i++ {
+		entry, exists, err := db.LookupAt([]byte(fmt.Sprintf("key %03d", i)), snapshot)
+		if assert.NoError(t, err) && assert.True(t, exists) {
+			assert.Equal(t, "value", string(entry.Value))
+		}
+	}
+	for kvp, err := range db.Scan(nil, nil) {
+		require.NoError(t, err)
+		assert.Fail(t, "unexpected key", string(kvp.Key))
+	}
+}
+
+func TestLSMDB_MergeTablesRecovery(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_MergeTablesRecovery")
+	cleanup()
+	defer cleanup()
+
+	const numTables = 3
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+
+	for table := range numTables {
+		for i := range 10 {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d-%d", table, i)),
+			))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// log a merge of every SSTable without performing it, as if the database crashed right after
+	// logging it
+	ctx := &dbCtx{}
+	ctx.Lock(&db.lock)
+	require.Len(t, db.defaultFamily.sstables, numTables)
+	entry := MergeTablesEntry{SSTableNumber: db.nextSSTableNumber}
+	for _, table := range db.defaultFamily.sstables {
+		entry.InputSSTableNumbers = append(entry.InputSSTableNumbers, sstableNumber(table))
+	}
+	require.NoError(t, db.appendEntry(ctx, &entry))
+	ctx.Unlock(&db.lock)
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		for i := range 10 {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			entry, exists, err := db.Lookup(key)
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, fmt.Sprintf("value %d-%d", numTables-1, i), string(entry.Value))
+			}
+		}
+	}
+
+	t.Run("crash before merged SSTable is created", func(t *testing.T) {
+		require.NoError(t, db.Close())
+
+		sameDB, err := Open(OpenArgs{Path: dir, IndexChunkSize: util.Some(uint64(100))})
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		waitForCompaction(t, sameDB, 1)
+		assert.Equal(t, entry.SSTableNumber, sstableNumber(sameDB.defaultFamily.sstables[0]))
+		assertContents(t, sameDB)
+		assertSSTableFiles(t, sameDB)
+	})
+
+	t.Run("replaying completed merge", func(t *testing.T) {
+		sameDB, err := Open(OpenArgs{Path: dir, IndexChunkSize: util.Some(uint64(100))})
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		waitForCompaction(t, sameDB, 1)
+		assertContents(t, sameDB)
+		assertSSTableFiles(t, sameDB)
+	})
+
+	t.Run("crash before inputs are deleted", func(t *testing.T) {
+		sameDB, err := Open(OpenArgs{Path: dir, IndexChunkSize: util.Some(uint64(100))})
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+
+		// recreate a stale input next to the merged SSTable
+		input, err := sstable.Open(sstable.OpenArgs{
+			Path:   sameDB.defaultFamily.sstablePath(entry.InputSSTableNumbers[0]),
+			Create: true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, input.AppendEntries(util.SeqOf(KeyValuePair{
+			Key:            []byte("key 000"),
+			Value:          []byte("stale"),
+			SequenceNumber: 1,
+		})))
+		require.NoError(t, input.Close())
+		require.NoError(t, sameDB.Close())
+
+		sameDB, err = Open(OpenArgs{Path: dir, IndexChunkSize: util.Some(uint64(100))})
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		waitForCompaction(t, sameDB, 1)
+		assertContents(t, sameDB)
+		assertSSTableFiles(t, sameDB)
+	})
+}
+
+type backgroundErrorListener struct {
+	NoopEventListener
+	errs chan error
+}
+
+func (me backgroundErrorListener) OnBackgroundError(err error) {
+	select {
+	case me.errs <- err:
+	default:
+	}
+}
+
+func TestLSMDB_FailedMerge(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_FailedMerge")
+	cleanup()
+	defer cleanup()
+
+	const numTables = 3
+
+	listener := backgroundErrorListener{errs: make(chan error, 1)}
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		EventListener:  util.Some[EventListener](listener),
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	for table := range numTables {
+		for i := range 10 {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d-%d", table, i)),
+			))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+	waitForCompaction(t, db, numTables)
+
+	ctx := &dbCtx{}
+	ctx.Lock(&db.lock)
+	require.Len(t, db.defaultFamily.sstables, numTables)
+
+	// cut the oldest SSTable short, as if its last blocks could not be read
+	oldest := db.defaultFamily.sstables[numTables-1]
+	header := oldest.Header()
+	require.NoError(t, os.Truncate(oldest.Path(), int64(header.SizeOf()+
+		(header.FileSize-header.SizeOf())/2)))
+
+	entry := MergeTablesEntry{SSTableNumber: db.nextSSTableNumber}
+	for _, table := range db.defaultFamily.sstables {
+		entry.InputSSTableNumbers = append(entry.InputSSTableNumbers, sstableNumber(table))
+		db.compactingSSTables[sstableNumber(table)] = struct{}{}
+	}
+	db.nextSSTableNumber++
+	require.NoError(t, db.appendEntry(ctx, &entry))
+	db.pendingMerges = append(db.pendingMerges, entry)
+	ctx.Unlock(&db.lock)
+	db.scheduleCompaction()
+
+	select {
+	case err := <-listener.errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timed out waiting for the merge to fail")
+	}
+
+	// the inputs are kept, and the truncated output is discarded
+	ctx.RLock(&db.lock)
+	defer ctx.RUnlock(&db.lock)
+	assert.Len(t, db.defaultFamily.sstables, numTables)
+	for _, number := range entry.InputSSTableNumbers {
+		assert.True(t, db.manifest.hasSSTable(number))
+	}
+	assert.False(t, db.manifest.hasSSTable(entry.SSTableNumber))
+	assert.Empty(t, db.obsoleteSSTables)
+	assert.NoFileExists(t, db.defaultFamily.sstablePath(entry.SSTableNumber))
+	for _, table := range db.defaultFamily.sstables {
+		assert.FileExists(t, table.Path())
+	}
+	tmpFiles, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	_ = assert.NoError(t, err) && assert.Empty(t, tmpFiles)
+}
+
+// waitForCompaction waits until all flushes and merges are done, and the database has at most the
+// given number of SSTables.
+func waitForCompaction(t *testing.T, db *LSMDB, maxSSTables int) {
+	t.Helper()
+	waitForColumnFamilyCompaction(t, db.defaultFamily, maxSSTables)
+}
+
+func waitForColumnFamilyCompaction(t *testing.T, family *ColumnFamily, maxSSTables int) {
+	t.Helper()
+
+	db := family.db
+	isDone := func() bool {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+
+		return len(family.sstables) <= maxSSTables && len(family.inMemoryIndexes) == 1 &&
+			len(db.pendingMerges) == 0 && len(db.compactingSSTables) == 0
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		// the compactor may not have picked up its latest signal yet, so make sure nothing
+		// changes for a little while
+		if isDone() {
+			time.Sleep(50 * time.Millisecond)
+			if isDone() {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Fail(t, "timed out waiting for compaction")
+}
+
+// assertSSTableFiles asserts that the SSTable files on disk are exactly the database's SSTables.
+func assertSSTableFiles(t *testing.T, db *LSMDB) {
+	t.Helper()
+
+	db.lock.RLock()
+	var expected []string
+	for _, table := range db.defaultFamily.sstables {
+		expected = append(expected, filepath.Base(table.Path()))
+	}
+	db.lock.RUnlock()
+
+	paths, err := filepath.Glob(filepath.Join(db.path, "*.sst"))
+	require.NoError(t, err)
+	var actual []string
+	for _, path := range paths {
+		actual = append(actual, filepath.Base(path))
+	}
+
+	assert.ElementsMatch(t, expected, actual)
+}
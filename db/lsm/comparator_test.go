@@ -0,0 +1,120 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Comparator(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Comparator")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		Comparator:     util.Some(sstable.ReverseBytewiseComparator),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(2),
+		}),
+		ColumnFamilies: map[string]ColumnFamilyOptions{
+			"integers": {Comparator: util.Some(sstable.BigEndianIntegerComparator)},
+		},
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	integers, err := db.CreateColumnFamily("integers", openArgs.ColumnFamilies["integers"])
+	require.NoError(t, err)
+
+	// keys are spread over the in-memory index and several SSTables
+	const numKeys = 30
+	for i := range numKeys {
+		require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprint(i))))
+		require.NoError(t, integers.Upsert([]byte{byte(i)}, []byte(fmt.Sprint(i))))
+		if i%10 == 9 {
+			require.NoError(t, db.CreateSSTable())
+		}
+	}
+	require.NoError(t, integers.Upsert([]byte{1, 0}, []byte("256")))
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		var keys []string
+		for kvp, err := range db.Scan([]byte("key 020"), []byte("key 010")) {
+			require.NoError(t, err)
+			keys = append(keys, string(kvp.Key))
+		}
+		if assert.Len(t, keys, 10) {
+			assert.Equal(t, "key 020", keys[0])
+			assert.Equal(t, "key 011", keys[9])
+		}
+
+		cursor := db.NewCursor(CursorArgs{})
+		defer cursor.Close()
+		if assert.True(t, cursor.First()) {
+			assert.Equal(t, fmt.Sprintf("key %03d", numKeys-1), string(cursor.Entry().Key))
+		}
+		if assert.True(t, cursor.Last()) {
+			assert.Equal(t, "key 000", string(cursor.Entry().Key))
+		}
+
+		for i := range numKeys {
+			entry, exists, err := db.Lookup([]byte(fmt.Sprintf("key %03d", i)))
+			_ = assert.NoError(t, err) && assert.True(t, exists) &&
+				assert.Equal(t, fmt.Sprint(i), string(entry.Value))
+		}
+
+		// a two-byte integer sorts after every one-byte integer
+		integers, _ := db.ColumnFamily("integers")
+		var values []string
+		for kvp, err := range integers.Scan([]byte{numKeys - 2}, nil) {
+			require.NoError(t, err)
+			values = append(values, string(kvp.Value))
+		}
+		assert.Equal(t, []string{fmt.Sprint(numKeys - 2), fmt.Sprint(numKeys - 1), "256"}, values)
+	}
+
+	t.Run("reads follow the comparator", func(t *testing.T) {
+		assertContents(t, db)
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		waitForCompaction(t, db, 1)
+		assertContents(t, db)
+	})
+	require.NoError(t, db.Close())
+
+	openArgs.Create = false
+
+	t.Run("re-open database", func(t *testing.T) {
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assertContents(t, sameDB)
+	})
+
+	t.Run("re-open with another comparator", func(t *testing.T) {
+		args := openArgs
+		args.Comparator = util.Optional[Comparator]{}
+		_, err := Open(args)
+		assert.ErrorContains(t, err, `was created with comparator "reverse bytewise"`)
+
+		args = openArgs
+		args.ColumnFamilies = nil
+		_, err = Open(args)
+		assert.ErrorContains(t, err, `was created with comparator "big-endian integer"`)
+	})
+}
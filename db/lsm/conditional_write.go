@@ -0,0 +1,88 @@
+package lsm
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/navijation/njsimple/storage/keyvaluepair"
+	"github.com/pkg/errors"
+)
+
+// ConditionalWriteResult is the outcome of a conditional write.
+type ConditionalWriteResult struct {
+	// Whether the condition held, in which case the write was applied.
+	Applied bool
+	// If the write was not applied, the current version of the key, if it exists. Deleted and
+	// expired keys do not exist.
+	Current keyvaluepair.KeyValuePair
+	Exists  bool
+}
+
+var errConditionNotMet = errors.New("condition not met")
+
+// Replace the value of a key, if it exists and its value equals expected.
+func (me *LSMDB) CompareAndSwap(key, expected, value []byte) (ConditionalWriteResult, error) {
+	return me.writeIf(
+		keyvaluepair.KeyValuePair{Key: key, Value: value},
+		func(current keyvaluepair.KeyValuePair, exists bool) bool {
+			return exists && bytes.Equal(current.Value, expected)
+		},
+	)
+}
+
+// Insert a key-value pair, if the key does not exist.
+func (me *LSMDB) PutIfAbsent(key, value []byte) (ConditionalWriteResult, error) {
+	return me.writeIf(
+		keyvaluepair.KeyValuePair{Key: key, Value: value},
+		func(_ keyvaluepair.KeyValuePair, exists bool) bool {
+			return !exists
+		},
+	)
+}
+
+// Delete a key, if it exists and its value equals expected.
+func (me *LSMDB) DeleteIfEquals(key, expected []byte) (ConditionalWriteResult, error) {
+	return me.writeIf(
+		keyvaluepair.KeyValuePair{Key: key, IsDeleted: true},
+		func(current keyvaluepair.KeyValuePair, exists bool) bool {
+			return exists && bytes.Equal(current.Value, expected)
+		},
+	)
+}
+
+// writeIf writes a key-value pair if the condition holds for the latest version of its key. The
+// condition is checked while holding the lock, right before the write is logged, so no other
+// write can come in between.
+func (me *LSMDB) writeIf(
+	kvp keyvaluepair.KeyValuePair,
+	condition func(current keyvaluepair.KeyValuePair, exists bool) bool,
+) (out ConditionalWriteResult, _ error) {
+	err := me.write(&pendingWrite{
+		keyValues: []keyvaluepair.KeyValuePair{kvp},
+		precondition: func(ctx *dbCtx) error {
+			current, exists, err := me.lookup(me.defaultFamily, kvp.Key, math.MaxUint64)
+			if err != nil {
+				return err
+			}
+			exists = exists && !current.IsDeleted
+
+			if !condition(current, exists) {
+				if exists {
+					out.Current = current
+					out.Exists = true
+				}
+				return errConditionNotMet
+			}
+			return nil
+		},
+	})
+	if errors.Is(err, errConditionNotMet) {
+		return out, nil
+	}
+	if err != nil {
+		return out, err
+	}
+
+	out.Applied = true
+	return out, nil
+}
@@ -0,0 +1,117 @@
+package lsm
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_ConditionalWrites(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_ConditionalWrites")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:   dir,
+		Create: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	assertValue := func(t *testing.T, key, value string) {
+		entry, exists, err := db.Lookup([]byte(key))
+		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.False(t, entry.IsDeleted) &&
+			assert.Equal(t, value, string(entry.Value))
+	}
+
+	t.Run("put if absent", func(t *testing.T) {
+		result, err := db.PutIfAbsent([]byte("key1"), []byte("value1"))
+		require.NoError(t, err)
+		assert.Equal(t, ConditionalWriteResult{Applied: true}, result)
+
+		result, err = db.PutIfAbsent([]byte("key1"), []byte("value1+"))
+		require.NoError(t, err)
+		assert.False(t, result.Applied)
+		assert.True(t, result.Exists)
+		assert.Equal(t, "value1", string(result.Current.Value))
+
+		assertValue(t, "key1", "value1")
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		result, err := db.CompareAndSwap([]byte("key1"), []byte("wrong"), []byte("value1+"))
+		require.NoError(t, err)
+		assert.False(t, result.Applied)
+		assert.Equal(t, "value1", string(result.Current.Value))
+
+		result, err = db.CompareAndSwap([]byte("key1"), []byte("value1"), []byte("value1+"))
+		require.NoError(t, err)
+		assert.True(t, result.Applied)
+		assertValue(t, "key1", "value1+")
+
+		result, err = db.CompareAndSwap([]byte("missing"), nil, []byte("value"))
+		require.NoError(t, err)
+		assert.Equal(t, ConditionalWriteResult{}, result)
+	})
+
+	t.Run("delete if equals", func(t *testing.T) {
+		result, err := db.DeleteIfEquals([]byte("key1"), []byte("value1"))
+		require.NoError(t, err)
+		assert.False(t, result.Applied)
+		assert.Equal(t, "value1+", string(result.Current.Value))
+
+		result, err = db.DeleteIfEquals([]byte("key1"), []byte("value1+"))
+		require.NoError(t, err)
+		assert.True(t, result.Applied)
+
+		entry, _, err := db.Lookup([]byte("key1"))
+		require.NoError(t, err)
+		assert.True(t, entry.IsDeleted)
+
+		// deleted keys are absent
+		result, err = db.PutIfAbsent([]byte("key1"), []byte("value1++"))
+		require.NoError(t, err)
+		assert.True(t, result.Applied)
+		assertValue(t, "key1", "value1++")
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		const (
+			numWriters    = 8
+			numIncrements = 20
+		)
+		_, err := db.PutIfAbsent([]byte("counter"), []byte("0"))
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for range numWriters {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range numIncrements {
+					current := []byte("0")
+					for {
+						next, _ := strconv.Atoi(string(current))
+						result, err := db.CompareAndSwap(
+							[]byte("counter"), current, []byte(strconv.Itoa(next+1)),
+						)
+						if !assert.NoError(t, err) || result.Applied {
+							break
+						}
+						current = result.Current.Value
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		assertValue(t, "counter", strconv.Itoa(numWriters*numIncrements))
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -26,36 +27,116 @@ func (me *LSMDB) CreateSSTable() error {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
+	if err := me.waitForFlushes(ctx); err != nil {
+		return err
+	}
+
+	return me.createSSTable(ctx)
+}
+
+// makeRoomForWrite creates new SSTables once the primary in-memory index of a column family or
+// the writeahead log reaches the column family's write buffer size. It stalls while too many
+// in-memory indexes are waiting to be flushed, during which the lock is released.
+func (me *LSMDB) makeRoomForWrite(ctx *dbCtx) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	isFull := func() bool {
+		for _, family := range me.families {
+			writeBufferSize, ok := family.writeBufferSize.Unpack()
+			if ok && (family.inMemoryIndexes[0].SizeOf() >= writeBufferSize ||
+				me.writeAheadLogs[0].Size() >= writeBufferSize) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isFull() {
+		return nil
+	}
+	if err := me.waitForFlushes(ctx); err != nil {
+		return err
+	}
+	// another writer may have created an SSTable while this one was stalled
+	if !isFull() {
+		return nil
+	}
+
+	return me.createSSTable(ctx)
+}
+
+// waitForFlushes stalls until fewer than the maximum number of in-memory indexes are waiting to
+// be flushed, so that one more may be created.
+func (me *LSMDB) waitForFlushes(ctx *dbCtx) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	// every flush includes the default column family
+	for len(me.defaultFamily.inMemoryIndexes)-1 >= me.maxImmutableIndexes {
+		select {
+		case <-me.done:
+			return fmt.Errorf("database is closed")
+		default:
+		}
+		if me.stateErr != nil {
+			return me.stateErr
+		}
+
+		me.flushed.Wait()
+	}
+
+	return nil
+}
+
+func (me *LSMDB) createSSTable(ctx *dbCtx) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+	// a write group may still be appending to the writeahead log that is about to be replaced
+	me.waitForLogWriter(ctx)
+
 	entry := CreateSSTableEntry{
 		SSTableNumber:       me.nextSSTableNumber,
 		WriteAheadLogNumber: me.nextWriteAheadLogNumber,
 	}
+	// the writeahead log is shared, so every column family is flushed along with the default one
+	for _, family := range me.liveColumnFamilies()[1:] {
+		if family.inMemoryIndexes[0].SizeOf() > 0 {
+			entry.ColumnFamilyIDs = append(entry.ColumnFamilyIDs, family.id)
+		}
+	}
 
 	if err := me.appendEntry(ctx, &entry); err != nil {
 		me.stateErr = err
 		return err
 	}
 
-	me.nextSSTableNumber++
+	me.nextSSTableNumber += 1 + uint64(len(entry.ColumnFamilyIDs))
 	me.nextWriteAheadLogNumber++
 
 	return me.processCreateSSTableEntry(ctx, entry)
 }
 
-// processCreateSSTableEntry creates a new in-memory index and triggers asynchronous creation
-// of a new SSTable
+// processCreateSSTableEntry creates new in-memory indexes and triggers asynchronous creation
+// of new SSTables
 func (me *LSMDB) processCreateSSTableEntry(ctx *dbCtx, entry CreateSSTableEntry) error {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
-	if exists, err := util.FileExists(me.sstablePath(entry.SSTableNumber)); err != nil {
-		return errors.WithStack(err)
-	} else if exists {
+	// replayed entries may refer to files that were never created
+	me.nextSSTableNumber = max(
+		me.nextSSTableNumber, entry.SSTableNumber+1+uint64(len(entry.ColumnFamilyIDs)),
+	)
+	me.nextWriteAheadLogNumber = max(me.nextWriteAheadLogNumber, entry.WriteAheadLogNumber+1)
+
+	if me.manifest.hasSSTable(entry.SSTableNumber) {
 		log.Printf("SSTable file %d already exists; skipping", entry.SSTableNumber)
-		if err := me.removeSecondaryWriteaheadLog(ctx); err != nil {
+		if err := me.removeSecondaryWriteaheadLog(ctx, entry); err != nil {
 			return err
 		}
-		me.inMemoryIndexes = me.inMemoryIndexes[:1]
+		for _, family := range me.families {
+			family.inMemoryIndexes = family.inMemoryIndexes[:1]
+		}
 		return nil
 	}
 
@@ -63,10 +144,24 @@ func (me *LSMDB) processCreateSSTableEntry(ctx *dbCtx, entry CreateSSTableEntry)
 		return err
 	}
 
-	// first create new in-memory index, moving old primary to secondary
+	// first create new in-memory indexes, moving old primaries to secondary; column families
+	// dropped since the entry was logged are skipped
 
-	entry.index = me.inMemoryIndexes[0]
-	me.inMemoryIndexes = slices.Insert(me.inMemoryIndexes, 0, &InMemoryIndex{})
+	familyIDs := append([]uint64{0}, entry.ColumnFamilyIDs...)
+	for i, familyID := range familyIDs {
+		family, ok := me.families[familyID]
+		if !ok {
+			continue
+		}
+		entry.flushes = append(entry.flushes, memtableFlush{
+			family:        family,
+			index:         family.inMemoryIndexes[0],
+			sstableNumber: entry.SSTableNumber + uint64(i),
+		})
+		family.inMemoryIndexes = slices.Insert(
+			family.inMemoryIndexes, 0, NewInMemoryIndex(family.comparator),
+		)
+	}
 
 	// now process SSTable creation asynchronously
 	select {
@@ -78,59 +173,137 @@ func (me *LSMDB) processCreateSSTableEntry(ctx *dbCtx, entry CreateSSTableEntry)
 	return nil
 }
 
-func (me *LSMDB) processCreateSSTableEntryAsync(ctx *dbCtx, entry CreateSSTableEntry) error {
+// processCreateSSTableEntryAsync writes the in-memory indexes of the entry to new SSTables, then
+// installs them and removes the obsolete writeahead logs. Progress is recorded on the entry, so
+// that a retry resumes from the step that failed.
+func (me *LSMDB) processCreateSSTableEntryAsync(ctx *dbCtx, entry *CreateSSTableEntry) error {
+	for i := range entry.flushes {
+		flush := &entry.flushes[i]
+		if flush.table != nil {
+			continue
+		}
+
+		info := FlushInfo{
+			ColumnFamily:      flush.family.name,
+			SSTableNumber:     flush.sstableNumber,
+			InMemoryIndexSize: flush.index.SizeOf(),
+		}
+		me.events.flushBegin(info)
+
+		start := time.Now()
+		table, err := me.flushMemtable(*flush)
+		info.Duration, info.Err = time.Since(start), err
+		if err == nil {
+			info.FileSize = sstableSize(table)
+			me.stats.flushes.observe(info.Duration.Seconds())
+		}
+		me.events.flushEnd(info)
+
+		if err != nil {
+			return err
+		}
+		flush.table = table
+	}
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	if !entry.installed {
+		// the writeahead logs preceding the new one are obsolete once the SSTables are in the
+		// MANIFEST
+		edit := VersionEdit{
+			WriteAheadLogNumber: entry.WriteAheadLogNumber,
+			NextSSTableNumber:   entry.SSTableNumber + 1 + uint64(len(entry.ColumnFamilyIDs)),
+		}
+		for _, flush := range entry.flushes {
+			edit.AddedSSTables = append(edit.AddedSSTables, newSSTableMetadata(flush.table))
+		}
+		if err := me.logVersionEdit(ctx, edit); err != nil {
+			return err
+		}
+		for _, flush := range entry.flushes {
+			me.events.sstableCreated(newSSTableInfo(flush.family, flush.table))
+		}
+
+		// remove the flushed in-memory indexes and insert new sstables into the lists; other
+		// secondary in-memory indexes may still be waiting to be flushed, so they must be kept
+		for _, flush := range entry.flushes {
+			family := flush.family
+			family.sstables = slices.Insert(family.sstables, 0, flush.table)
+			family.inMemoryIndexes = slices.DeleteFunc(
+				family.inMemoryIndexes, func(index *InMemoryIndex) bool {
+					return index == flush.index
+				},
+			)
+		}
+		entry.installed = true
+		me.flushed.Broadcast()
+	}
+
+	// remove secondary writeahead logs covered by the new SSTables
+	if err := me.removeSecondaryWriteaheadLog(ctx, *entry); err != nil {
+		return err
+	}
+
+	me.scheduleCompaction()
+	return nil
+}
+
+// abandonCreateSSTableEntry closes the SSTables written for an entry that will not be retried,
+// unless they were already installed. The flush is replayed from the writeahead log once the
+// database is re-opened.
+func (me *LSMDB) abandonCreateSSTableEntry(ctx *dbCtx, entry *CreateSSTableEntry) {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	if !entry.installed {
+		for i := range entry.flushes {
+			if table := entry.flushes[i].table; table != nil {
+				_ = table.Close()
+				entry.flushes[i].table = nil
+			}
+		}
+	}
+	// wake up writers stalled on the flush, which will not happen
+	me.flushed.Broadcast()
+}
+
+// flushMemtable writes an in-memory index to a new SSTable of its column family.
+func (me *LSMDB) flushMemtable(flush memtableFlush) (*sstable.SSTable, error) {
 	// first create temporary SSTable to store items from in-memory index
 	file, err := os.CreateTemp(filepath.Join(me.path, "tmp"), "sstable_")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_ = os.Remove(file.Name())
 	defer os.Remove(file.Name())
 	_ = file.Close()
 
 	sstableFile, err := sstable.Open(sstable.OpenArgs{
-		Path:           filepath.Join(file.Name()),
-		Create:         true,
-		IndexChunkSize: me.indexChunkSize,
+		Path:                  filepath.Join(file.Name()),
+		Create:                true,
+		IndexChunkSize:        me.indexChunkSize,
+		BloomFilterBitsPerKey: flush.family.bloomFilterBitsPerKey,
+		BlockCache:            me.blockCache,
+		Comparator:            util.Some(flush.family.comparator),
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// write entries from old in memory index to temporary file
-	if err := sstableFile.AppendEntries(func(yield func(sstable.KeyValuePair) bool) {
-		for _, kvp := range entry.index.KeyValues {
-			if !yield(sstable.KeyValuePair{
-				Key:       kvp.Key,
-				Value:     kvp.Value,
-				IsDeleted: kvp.IsDeleted,
-			}) {
-				return
-			}
-		}
-	}); err != nil {
-		me.stateErr = err
-		return err
+	if err := sstableFile.AppendEntries(flush.index.All()); err != nil {
+		_ = sstableFile.Close()
+		return nil, err
 	}
 
 	// then move the file to the SSTable canonical location
-	if err := sstableFile.Rename(me.sstablePath(entry.SSTableNumber)); err != nil {
-		return err
+	if err := sstableFile.Rename(flush.family.sstablePath(flush.sstableNumber)); err != nil {
+		_ = sstableFile.Close()
+		return nil, err
 	}
 
-	ctx.Lock(&me.lock)
-	defer ctx.Unlock(&me.lock)
-
-	// remove secondary in-memory index and insert new sstable into list
-	me.sstables = slices.Insert(me.sstables, 0, &sstableFile)
-	me.inMemoryIndexes = me.inMemoryIndexes[:1]
-
-	// remove secondary writeahead log
-	if err := me.removeSecondaryWriteaheadLog(ctx); err != nil {
-		return err
-	}
-
-	return nil
+	return &sstableFile, nil
 }
 
 func (me *LSMDB) createNewWriteaheadLog(ctx *dbCtx, entry CreateSSTableEntry) error {
@@ -146,6 +319,14 @@ func (me *LSMDB) createNewWriteaheadLog(ctx *dbCtx, entry CreateSSTableEntry) er
 		return nil
 	}
 
+	// the MANIFEST must list the new writeahead log before it is created, or it would be
+	// mistaken for an orphan
+	if err := me.logVersionEdit(ctx, VersionEdit{
+		NextWriteAheadLogNumber: entry.WriteAheadLogNumber + 1,
+	}); err != nil {
+		return err
+	}
+
 	// first create temporary write-ahead log
 
 	file, err := os.CreateTemp(filepath.Join(me.path, "tmp"), "writeahead_log_")
@@ -159,6 +340,11 @@ func (me *LSMDB) createNewWriteaheadLog(ctx *dbCtx, entry CreateSSTableEntry) er
 	writeAheadLog, err := journal.Open(journal.OpenArgs{
 		Path:   file.Name(),
 		Create: true,
+		// entry numbers carry on from the previous writeahead log, so that they identify a point
+		// in the history of the database
+		StartAt:    me.writeAheadLogs[0].NextEntryNumber(),
+		SyncPolicy: me.writeAheadLogSync,
+		OnSync:     util.Some(me.stats.observeWriteAheadLogSync),
 	})
 	if err != nil {
 		err = errors.WithStack(err)
@@ -177,7 +363,10 @@ func (me *LSMDB) createNewWriteaheadLog(ctx *dbCtx, entry CreateSSTableEntry) er
 	return nil
 }
 
-func (me *LSMDB) removeSecondaryWriteaheadLog(ctx *dbCtx) error {
+// removeSecondaryWriteaheadLog removes the writeahead logs whose entries are all reflected in the
+// SSTable created by the given entry, i.e. the logs preceding the entry's new writeahead log. They
+// are moved to the archive directory instead, if there is one.
+func (me *LSMDB) removeSecondaryWriteaheadLog(ctx *dbCtx, entry CreateSSTableEntry) error {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
@@ -185,18 +374,44 @@ func (me *LSMDB) removeSecondaryWriteaheadLog(ctx *dbCtx) error {
 		log.Printf("No secondary writeahead log to close\n")
 	}
 
-	for _, writeAheadLog := range me.writeAheadLogs[1:] {
+	var remainingLogs []*journal.JournalFile
+	info := WriteAheadLogRotationInfo{WriteAheadLogNumber: entry.WriteAheadLogNumber}
+	// logs removed before a failure are gone, so they must not be removed again by a retry
+	keepUnremoved := func(i int) {
+		me.writeAheadLogs = append(remainingLogs, me.writeAheadLogs[i:]...)
+	}
+	for i, writeAheadLog := range me.writeAheadLogs {
+		logNumber, _ := getFileNumber(writeAheadLog.Path(), "writeahead_log_", ".jrn")
+		if logNumber >= entry.WriteAheadLogNumber {
+			remainingLogs = append(remainingLogs, writeAheadLog)
+			continue
+		}
+		info.DeletedWriteAheadLogNumbers = append(info.DeletedWriteAheadLogNumbers, logNumber)
+		info.DeletedBytes += writeAheadLog.Size()
+
 		if err := writeAheadLog.Close(); err != nil {
 			log.Printf("Failed to close writeahead log: %s\n", err.Error())
 			_ = err
 		}
-		if err := os.Remove(writeAheadLog.Path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		if archiveDir := me.writeAheadLogArchiveDir; archiveDir != "" {
+			if err := archiveWriteAheadLog(archiveDir, writeAheadLog.Path()); err != nil {
+				keepUnremoved(i)
+				me.stateErr = err
+				return err
+			}
+			info.Archived = true
+		} else if err := os.Remove(writeAheadLog.Path()); err != nil &&
+			!errors.Is(err, os.ErrNotExist) {
+			keepUnremoved(i)
 			err = errors.WithStack(err)
 			me.stateErr = err
 			return err
 		}
 	}
-	me.writeAheadLogs = me.writeAheadLogs[:1]
+	me.writeAheadLogs = remainingLogs
 
+	if len(info.DeletedWriteAheadLogNumbers) > 0 {
+		me.events.writeAheadLogRotated(info)
+	}
 	return nil
 }
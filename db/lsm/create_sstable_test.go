@@ -2,6 +2,8 @@ package lsm
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -38,8 +40,14 @@ func TestLSMDB_CreateSSTable(t *testing.T) {
 		)
 	}
 
+	db.lock.RLock()
 	writeAheadLog := db.writeAheadLogs[0]
+	// a directory in place of the new SSTable holds up the flush, which would otherwise close
+	// the old writeahead log while it is being read
+	blockingDir := db.defaultFamily.sstablePath(db.nextSSTableNumber)
+	db.lock.RUnlock()
 	assert.Equal(t, numTestKeyValues, writeAheadLog.NumEntries())
+	require.NoError(t, os.MkdirAll(filepath.Join(blockingDir, "file"), 0o755))
 
 	require.NoError(t, db.CreateSSTable())
 
@@ -59,22 +67,26 @@ func TestLSMDB_CreateSSTable(t *testing.T) {
 				entry := entry.(CreateSSTableEntry)
 				assert.EqualValues(t, 1, entry.SSTableNumber)
 				assert.EqualValues(t, 2, entry.WriteAheadLogNumber)
-				assert.Nil(t, entry.index)
+				assert.Nil(t, entry.flushes)
 			}
 		}
 	})
 
-	time.Sleep(500 * time.Millisecond)
+	require.NoError(t, os.RemoveAll(blockingDir))
+	waitForCompaction(t, db, 1)
 
 	t.Run("Fields after file is committed", func(t *testing.T) {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+
 		if assert.Len(t, db.writeAheadLogs, 1) {
 			assert.Zero(t, db.writeAheadLogs[0].NumEntries())
 		}
-		if assert.Len(t, db.inMemoryIndexes, 1) {
-			assert.Empty(t, db.inMemoryIndexes[0].KeyValues)
+		if assert.Len(t, db.defaultFamily.inMemoryIndexes, 1) {
+			assert.Zero(t, db.defaultFamily.inMemoryIndexes[0].SizeOf())
 		}
-		if assert.Len(t, db.sstables, 1) {
-			assert.Equal(t, numTestKeyValues, db.sstables[0].NumEntries())
+		if assert.Len(t, db.defaultFamily.sstables, 1) {
+			assert.Equal(t, numTestKeyValues, db.defaultFamily.sstables[0].NumEntries())
 		}
 		assert.NoError(t, db.stateErr)
 	})
@@ -101,11 +113,11 @@ func TestLSMDB_CreateSSTable(t *testing.T) {
 		if assert.Len(t, sameDB.writeAheadLogs, 1) {
 			assert.Zero(t, sameDB.writeAheadLogs[0].NumEntries())
 		}
-		if assert.Len(t, sameDB.inMemoryIndexes, 1) {
-			assert.Empty(t, sameDB.inMemoryIndexes[0].KeyValues)
+		if assert.Len(t, sameDB.defaultFamily.inMemoryIndexes, 1) {
+			assert.Zero(t, sameDB.defaultFamily.inMemoryIndexes[0].SizeOf())
 		}
-		if assert.Len(t, sameDB.sstables, 1) {
-			assert.Equal(t, numTestKeyValues, sameDB.sstables[0].NumEntries())
+		if assert.Len(t, sameDB.defaultFamily.sstables, 1) {
+			assert.Equal(t, numTestKeyValues, sameDB.defaultFamily.sstables[0].NumEntries())
 		}
 		assert.EqualValues(t, 2, sameDB.nextSSTableNumber)
 		assert.EqualValues(t, 3, sameDB.nextWriteAheadLogNumber)
@@ -193,13 +205,16 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	t.Run("Fields after file is committed", func(t *testing.T) {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+
 		assert.EqualValues(t, 3, db.nextSSTableNumber)
 		assert.EqualValues(t, 4, db.nextWriteAheadLogNumber)
-		if assert.Len(t, db.inMemoryIndexes, 1) {
-			assert.Empty(t, db.inMemoryIndexes[0].KeyValues)
+		if assert.Len(t, db.defaultFamily.inMemoryIndexes, 1) {
+			assert.Zero(t, db.defaultFamily.inMemoryIndexes[0].SizeOf())
 		}
 		assert.Len(t, db.writeAheadLogs, 1)
-		assert.Len(t, db.sstables, 2)
+		assert.Len(t, db.defaultFamily.sstables, 2)
 
 		assert.True(t, db.isRunning.Load())
 		assert.NoError(t, db.stateErr)
@@ -214,8 +229,9 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 			require.NoError(t, err, string(keyX))
 			require.True(t, ok, string(keyX))
 			require.Equal(t, KeyValuePair{
-				Key:   keyX,
-				Value: value,
+				Key:            keyX,
+				Value:          value,
+				SequenceNumber: entry.SequenceNumber,
 			}, entry, string(keyX))
 
 			keyY := []byte(fmt.Sprintf("keyY %03d", i))
@@ -225,8 +241,9 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 			require.NoError(t, err, string(keyY))
 			require.True(t, ok, string(keyY))
 			require.Equal(t, KeyValuePair{
-				Key:       keyY,
-				IsDeleted: true,
+				Key:            keyY,
+				IsDeleted:      true,
+				SequenceNumber: entry.SequenceNumber,
 			}, entry, string(keyY))
 		}
 	})
@@ -243,11 +260,11 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 	t.Run("Fields after file is committed", func(t *testing.T) {
 		assert.EqualValues(t, 3, sameDB.nextSSTableNumber)
 		assert.EqualValues(t, 4, sameDB.nextWriteAheadLogNumber)
-		if assert.Len(t, sameDB.inMemoryIndexes, 1) {
-			assert.Empty(t, sameDB.inMemoryIndexes[0].KeyValues)
+		if assert.Len(t, sameDB.defaultFamily.inMemoryIndexes, 1) {
+			assert.Zero(t, sameDB.defaultFamily.inMemoryIndexes[0].SizeOf())
 		}
 		assert.Len(t, sameDB.writeAheadLogs, 1)
-		assert.Len(t, sameDB.sstables, 2)
+		assert.Len(t, sameDB.defaultFamily.sstables, 2)
 
 		assert.True(t, sameDB.isRunning.Load())
 		assert.NoError(t, sameDB.stateErr)
@@ -262,8 +279,9 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 			require.NoError(t, err, string(keyX))
 			require.True(t, ok, string(keyX))
 			require.Equal(t, KeyValuePair{
-				Key:   keyX,
-				Value: value,
+				Key:            keyX,
+				Value:          value,
+				SequenceNumber: entry.SequenceNumber,
 			}, entry, string(keyX))
 
 			keyY := []byte(fmt.Sprintf("keyY %03d", i))
@@ -273,9 +291,329 @@ func TestLSMDB_ConcurrentSSTableAndCUD(t *testing.T) {
 			require.NoError(t, err, string(keyY))
 			require.True(t, ok, string(keyY))
 			require.Equal(t, KeyValuePair{
-				Key:       keyY,
-				IsDeleted: true,
+				Key:            keyY,
+				IsDeleted:      true,
+				SequenceNumber: entry.SequenceNumber,
 			}, entry, string(keyY))
 		}
 	})
 }
+
+func TestLSMDB_WriteBufferSize(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_WriteBufferSize")
+	cleanup()
+	defer cleanup()
+
+	const numTestKeyValues = 500
+
+	db, err := Open(OpenArgs{
+		Path:                dir,
+		Create:              true,
+		IndexChunkSize:      util.Some(uint64(1000)),
+		WriteBufferSize:     util.Some(uint64(2048)),
+		MaxImmutableIndexes: util.Some(1),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	for i := range numTestKeyValues {
+		require.NoError(t, db.Upsert(
+			[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d", i))),
+		)
+
+		db.lock.RLock()
+		numInMemoryIndexes := len(db.defaultFamily.inMemoryIndexes)
+		db.lock.RUnlock()
+		require.LessOrEqual(t, numInMemoryIndexes, 2)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	t.Run("Fields after flushes", func(t *testing.T) {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+
+		// each key-value pair takes up about 40 bytes
+		assert.Greater(t, len(db.defaultFamily.sstables), 5)
+		if assert.Len(t, db.defaultFamily.inMemoryIndexes, 1) {
+			assert.Less(t, db.defaultFamily.inMemoryIndexes[0].SizeOf(), uint64(2048))
+		}
+		assert.Len(t, db.writeAheadLogs, 1)
+		assert.NoError(t, db.stateErr)
+	})
+
+	t.Run("Key lookup after flushes", func(t *testing.T) {
+		for i := range numTestKeyValues {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			entry, ok, err := db.Lookup(key)
+			require.NoError(t, err, string(key))
+			require.True(t, ok, string(key))
+			require.Equal(t, fmt.Sprintf("value %d", i), string(entry.Value), string(key))
+		}
+	})
+}
+
+func TestLSMDB_FailedFlush(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_FailedFlush")
+	cleanup()
+	defer cleanup()
+
+	listener := backgroundErrorListener{errs: make(chan error, 10)}
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		EventListener:  util.Some[EventListener](listener),
+	}
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	// a directory in place of the new SSTable stops it from being moved into place
+	db.lock.RLock()
+	blockingDir := db.defaultFamily.sstablePath(db.nextSSTableNumber)
+	db.lock.RUnlock()
+	require.NoError(t, os.MkdirAll(filepath.Join(blockingDir, "file"), 0o755))
+	require.NoError(t, db.Upsert([]byte("key"), []byte("value")))
+	require.NoError(t, db.CreateSSTable())
+
+	for range 2 {
+		select {
+		case err := <-listener.errs:
+			assert.Error(t, err)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "the flush was not retried")
+		}
+	}
+
+	entry, exists, err := db.Lookup([]byte("key"))
+	_ = assert.NoError(t, err) && assert.True(t, exists) &&
+		assert.Equal(t, "value", string(entry.Value))
+
+	// closing stops the retries, which would otherwise go on forever
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the database did not close")
+	}
+
+	t.Run("re-open database", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(blockingDir))
+		openArgs.Create = false
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		// the flush is replayed from the writeahead log
+		waitForCompaction(t, sameDB, 1)
+		sameDB.lock.RLock()
+		assert.Len(t, sameDB.defaultFamily.sstables, 1)
+		sameDB.lock.RUnlock()
+
+		entry, exists, err := sameDB.Lookup([]byte("key"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value", string(entry.Value))
+	})
+}
+
+func TestLSMDB_RetriedFlush(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_RetriedFlush")
+	cleanup()
+	defer cleanup()
+
+	listener := backgroundErrorListener{errs: make(chan error, 10)}
+	openArgs := OpenArgs{
+		Path:          dir,
+		Create:        true,
+		EventListener: util.Some[EventListener](listener),
+	}
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	users, err := db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	require.NoError(t, err)
+
+	// only the SSTable of the second column family is blocked, so the first one is written
+	db.lock.RLock()
+	blockingDir := users.sstablePath(db.nextSSTableNumber + 1)
+	db.lock.RUnlock()
+	require.NoError(t, os.MkdirAll(filepath.Join(blockingDir, "file"), 0o755))
+
+	require.NoError(t, db.Upsert([]byte("key"), []byte("value")))
+	require.NoError(t, users.Upsert([]byte("user"), []byte("name")))
+	require.NoError(t, db.CreateSSTable())
+
+	select {
+	case err := <-listener.errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the flush did not fail")
+	}
+	require.NoError(t, os.RemoveAll(blockingDir))
+
+	// the retry only writes the SSTable that failed
+	waitForCompaction(t, db, 1)
+	waitForColumnFamilyCompaction(t, users, 1)
+
+	db.lock.RLock()
+	assert.Len(t, db.defaultFamily.sstables, 1)
+	assert.Len(t, users.sstables, 1)
+	assert.Len(t, db.manifest.sstables, 2)
+	assert.Len(t, db.writeAheadLogs, 1)
+	assert.NoError(t, db.stateErr)
+	db.lock.RUnlock()
+
+	entry, exists, err := users.Lookup([]byte("user"))
+	_ = assert.NoError(t, err) && assert.True(t, exists) &&
+		assert.Equal(t, "name", string(entry.Value))
+	require.NoError(t, db.Close())
+}
+
+func TestLSMDB_FailedWriteAheadLogRemoval(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_FailedWriteAheadLogRemoval")
+	cleanup()
+	defer cleanup()
+
+	archiveDir, cleanupArchive := testing_util.MkdirTemp(t, "TestLSMDB_FailedWriteAheadLogRemoval")
+	defer cleanupArchive()
+
+	listener := backgroundErrorListener{errs: make(chan error, 10)}
+	openArgs := OpenArgs{
+		Path:                    dir,
+		Create:                  true,
+		WriteAheadLogArchiveDir: util.Some(archiveDir),
+		EventListener:           util.Some[EventListener](listener),
+	}
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	// a non-empty directory in place of the archived log stops it from being moved there
+	blockingDir := filepath.Join(archiveDir, "writeahead_log_1.jrn")
+	require.NoError(t, os.MkdirAll(filepath.Join(blockingDir, "file"), 0o755))
+
+	require.NoError(t, db.Upsert([]byte("key"), []byte("value")))
+	require.NoError(t, db.CreateSSTable())
+
+	select {
+	case err := <-listener.errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "removing the writeahead log did not fail")
+	}
+
+	// the database is in an unknown state, so neither the flush nor the removal is retried
+	select {
+	case err := <-listener.errs:
+		assert.Fail(t, "the flush was retried", "%s", err)
+	case <-time.After(10 * minFlushRetryDelay):
+	}
+	assert.Error(t, db.Upsert([]byte("key"), []byte("other value")))
+
+	db.lock.RLock()
+	assert.Len(t, db.defaultFamily.sstables, 1)
+	assert.Len(t, db.defaultFamily.inMemoryIndexes, 1)
+	assert.Len(t, db.manifest.sstables, 1)
+	db.lock.RUnlock()
+	require.NoError(t, db.Close())
+
+	t.Run("re-open database", func(t *testing.T) {
+		require.NoError(t, os.RemoveAll(blockingDir))
+		openArgs.Create = false
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		waitForCompaction(t, sameDB, 1)
+		sameDB.lock.RLock()
+		assert.Len(t, sameDB.defaultFamily.sstables, 1)
+		sameDB.lock.RUnlock()
+
+		entry, exists, err := sameDB.Lookup([]byte("key"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value", string(entry.Value))
+	})
+}
+
+func TestLSMDB_BloomFilterBitsPerKey(t *testing.T) {
+	t.Parallel()
+
+	const numKeys = uint64(100)
+
+	for _, tc := range []struct {
+		name                  string
+		bloomFilterBitsPerKey util.Optional[uint64]
+		bitsPerKey            uint64
+	}{
+		{name: "default", bitsPerKey: 10},
+		{name: "explicit", bloomFilterBitsPerKey: util.Some(uint64(4)), bitsPerKey: 4},
+		{name: "disabled", bloomFilterBitsPerKey: util.Some(uint64(0)), bitsPerKey: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_BloomFilterBitsPerKey_"+tc.name)
+			cleanup()
+			defer cleanup()
+
+			db, err := Open(OpenArgs{
+				Path:                  dir,
+				Create:                true,
+				BloomFilterBitsPerKey: tc.bloomFilterBitsPerKey,
+			})
+			require.NoError(t, err)
+
+			require.NoError(t, db.Start())
+			defer db.Close()
+
+			for i := range numKeys {
+				require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("value")))
+			}
+			require.NoError(t, db.CreateSSTable())
+			waitForCompaction(t, db, 1)
+
+			// the filter holds the number of hashes followed by bitsPerKey bits per key, with a
+			// minimum of 64 bits
+			var expectedFilterSize uint64
+			if tc.bitsPerKey > 0 {
+				expectedFilterSize = 8 + (max(numKeys*tc.bitsPerKey, 64)+7)/8
+			}
+
+			db.lock.RLock()
+			if assert.Len(t, db.defaultFamily.sstables, 1) {
+				header := db.defaultFamily.sstables[0].Header()
+				assert.Equal(t, numKeys, header.NumEntries)
+				assert.Equal(t, expectedFilterSize, header.FilterSize)
+			}
+			db.lock.RUnlock()
+
+			for i := range numKeys {
+				_, exists, err := db.Lookup([]byte(fmt.Sprintf("key %03d", i)))
+				assert.NoError(t, err)
+				assert.True(t, exists)
+
+				_, exists, err = db.Lookup([]byte(fmt.Sprintf("missing %03d", i)))
+				assert.NoError(t, err)
+				assert.False(t, exists)
+			}
+		})
+	}
+}
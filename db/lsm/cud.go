@@ -1,61 +1,90 @@
 package lsm
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/navijation/njsimple/storage/keyvaluepair"
 )
 
 func (me *LSMDB) Upsert(key, value []byte) error {
-	ctx := &dbCtx{}
+	return me.defaultFamily.Upsert(key, value)
+}
 
-	ctx.Lock(&me.lock)
-	defer ctx.Unlock(&me.lock)
+// Upsert a key-value pair that reads as deleted once the TTL has passed, according to the clock
+// the database was opened with.
+func (me *LSMDB) UpsertWithTTL(key, value []byte, ttl time.Duration) error {
+	return me.defaultFamily.UpsertWithTTL(key, value, ttl)
+}
 
-	if err := me.checkStateError(ctx); err != nil {
-		return err
-	}
+// Merge an operand into the value of a key without reading it first. The operand is merged by the
+// merge operator the database was opened with, once the key is read or compacted.
+func (me *LSMDB) Merge(key, operand []byte) error {
+	return me.defaultFamily.Merge(key, operand)
+}
 
-	entry := CUDKeyValueEntry{
-		StoredKeyValuePair: (&keyvaluepair.KeyValuePair{
+func (me *LSMDB) Delete(key []byte) error {
+	return me.defaultFamily.Delete(key)
+}
+
+func (me *ColumnFamily) Upsert(key, value []byte) error {
+	return me.db.write(&pendingWrite{
+		families: []*ColumnFamily{me},
+		keyValues: []keyvaluepair.KeyValuePair{{
 			Key:   key,
 			Value: value,
-		}).ToStoredKeyValuePair(),
-	}
-	if err := me.appendEntry(ctx, &entry); err != nil {
-		return err
-	}
-
-	me.processCUDKeyValueEntry(ctx, entry)
-	return nil
+		}},
+	})
 }
 
-func (me *LSMDB) Delete(key []byte) error {
-	ctx := &dbCtx{}
-
-	ctx.Lock(&me.lock)
-	defer ctx.Unlock(&me.lock)
+// Upsert a key-value pair in the column family that reads as deleted once the TTL has passed.
+func (me *ColumnFamily) UpsertWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("TTL must be positive, got %s", ttl)
+	}
+	return me.db.write(&pendingWrite{
+		families: []*ColumnFamily{me},
+		keyValues: []keyvaluepair.KeyValuePair{{
+			Key:       key,
+			Value:     value,
+			ExpiresAt: uint64(me.db.clock().Add(ttl).UnixNano()),
+		}},
+	})
+}
 
-	if me.stateErr != nil {
-		return me.stateErr
+// Merge an operand into the value of a key in the column family, using the column family's merge
+// operator.
+func (me *ColumnFamily) Merge(key, operand []byte) error {
+	if me.mergeOperator == nil {
+		return fmt.Errorf("column family %q was opened without a merge operator", me.name)
 	}
+	return me.db.write(&pendingWrite{
+		families: []*ColumnFamily{me},
+		keyValues: []keyvaluepair.KeyValuePair{{
+			Key:            key,
+			Value:          operand,
+			IsMergeOperand: true,
+		}},
+	})
+}
 
-	entry := CUDKeyValueEntry{
-		StoredKeyValuePair: (&keyvaluepair.KeyValuePair{
+func (me *ColumnFamily) Delete(key []byte) error {
+	return me.db.write(&pendingWrite{
+		families: []*ColumnFamily{me},
+		keyValues: []keyvaluepair.KeyValuePair{{
 			Key:       key,
 			IsDeleted: true,
-		}).ToStoredKeyValuePair(),
-	}
-
-	if err := me.appendEntry(ctx, &entry); err != nil {
-		me.stateErr = err
-		return err
-	}
-	me.processCUDKeyValueEntry(ctx, entry)
-	return nil
+		}},
+	})
 }
 
 func (me *LSMDB) processCUDKeyValueEntry(ctx *dbCtx, entry CUDKeyValueEntry) {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
-	me.inMemoryIndexes[0].Upsert(entry.StoredKeyValuePair.ToKeyValuePair())
+	// writes to dropped column families are discarded
+	if family, ok := me.families[entry.ColumnFamilyID]; ok {
+		family.inMemoryIndexes[0].UpsertVersion(entry.ToKeyValuePair(), me.liveSnapshots(ctx))
+	}
+	me.lastSequenceNumber = max(me.lastSequenceNumber, entry.SequenceNumber)
 }
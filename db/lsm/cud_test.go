@@ -1,7 +1,9 @@
 package lsm
 
 import (
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/navijation/njsimple/util"
 	testing_util "github.com/navijation/njsimple/util/testing"
@@ -41,26 +43,30 @@ func TestLSMDB_CUDOperations(t *testing.T) {
 
 		entry1, exists, err := db.Lookup([]byte("key1"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key1"),
-			Value: []byte("value1"),
+			Key:            []byte("key1"),
+			Value:          []byte("value1"),
+			SequenceNumber: 2,
 		}, entry1)
 
 		entry2, exists, err := db.Lookup([]byte("key2"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:       []byte("key2"),
-			IsDeleted: true,
+			Key:            []byte("key2"),
+			IsDeleted:      true,
+			SequenceNumber: 6,
 		}, entry2)
 
 		entry3, exists, err := db.Lookup([]byte("key3"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key3"),
-			Value: []byte("value3+"),
+			Key:            []byte("key3"),
+			Value:          []byte("value3+"),
+			SequenceNumber: 9,
 		}, entry3)
 
 		entry4, exists, err := db.Lookup([]byte("key4"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key4"),
-			Value: []byte("value4"),
+			Key:            []byte("key4"),
+			Value:          []byte("value4"),
+			SequenceNumber: 5,
 		}, entry4)
 	})
 	require.NoError(t, db.Close())
@@ -76,27 +82,132 @@ func TestLSMDB_CUDOperations(t *testing.T) {
 	t.Run("lookup entries", func(t *testing.T) {
 		entry1, exists, err := sameDB.Lookup([]byte("key1"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key1"),
-			Value: []byte("value1"),
+			Key:            []byte("key1"),
+			Value:          []byte("value1"),
+			SequenceNumber: 2,
 		}, entry1)
 
 		entry2, exists, err := sameDB.Lookup([]byte("key2"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:       []byte("key2"),
-			IsDeleted: true,
+			Key:            []byte("key2"),
+			IsDeleted:      true,
+			SequenceNumber: 6,
 		}, entry2)
 
 		entry3, exists, err := sameDB.Lookup([]byte("key3"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key3"),
-			Value: []byte("value3+"),
+			Key:            []byte("key3"),
+			Value:          []byte("value3+"),
+			SequenceNumber: 9,
 		}, entry3)
 
 		entry4, exists, err := sameDB.Lookup([]byte("key4"))
 		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
-			Key:   []byte("key4"),
-			Value: []byte("value4"),
+			Key:            []byte("key4"),
+			Value:          []byte("value4"),
+			SequenceNumber: 5,
 		}, entry4)
 	})
 	require.NoError(t, sameDB.Close())
 }
+
+func TestLSMDB_UpsertWithTTL(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_UpsertWithTTL")
+	cleanup()
+	defer cleanup()
+
+	var now atomic.Int64
+	now.Store(time.Unix(1000, 0).UnixNano())
+	clock := func() time.Time {
+		return time.Unix(0, now.Load())
+	}
+
+	openArgs := OpenArgs{
+		Path:   dir,
+		Create: true,
+		Clock:  util.Some(clock),
+	}
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	require.NoError(t, db.Upsert([]byte("key1"), []byte("value1")))
+	require.NoError(t, db.Upsert([]byte("key2"), []byte("value2")))
+	require.NoError(t, db.UpsertWithTTL([]byte("key1"), []byte("value1+"), time.Minute))
+	require.NoError(t, db.UpsertWithTTL([]byte("key3"), []byte("value3"), time.Hour))
+	assert.Error(t, db.UpsertWithTTL([]byte("key4"), []byte("value4"), 0))
+
+	assertVisible := func(t *testing.T, db *LSMDB, expected map[string]string) {
+		for _, key := range []string{"key1", "key2", "key3", "key4"} {
+			entry, exists, err := db.Lookup([]byte(key))
+			require.NoError(t, err)
+			if value, ok := expected[key]; ok {
+				_ = assert.True(t, exists) && assert.False(t, entry.IsDeleted) &&
+					assert.Equal(t, value, string(entry.Value))
+			} else {
+				assert.True(t, !exists || entry.IsDeleted, key)
+			}
+		}
+
+		scanned := map[string]string{}
+		for kvp, err := range db.Scan(nil, nil) {
+			require.NoError(t, err)
+			scanned[string(kvp.Key)] = string(kvp.Value)
+		}
+		assert.Equal(t, expected, scanned)
+	}
+
+	t.Run("before expiry", func(t *testing.T) {
+		assertVisible(t, db, map[string]string{
+			"key1": "value1+",
+			"key2": "value2",
+			"key3": "value3",
+		})
+	})
+
+	t.Run("expired in memory", func(t *testing.T) {
+		now.Add(int64(time.Minute))
+		// the expired version still hides the older version of key1
+		assertVisible(t, db, map[string]string{
+			"key2": "value2",
+			"key3": "value3",
+		})
+	})
+
+	t.Run("expired in SSTables", func(t *testing.T) {
+		require.NoError(t, db.CreateSSTable())
+		require.Eventually(t, func() bool {
+			db.lock.RLock()
+			defer db.lock.RUnlock()
+			return len(db.defaultFamily.sstables) == 1
+		}, 5*time.Second, time.Millisecond)
+
+		now.Add(int64(time.Hour))
+		assertVisible(t, db, map[string]string{
+			"key2": "value2",
+		})
+	})
+
+	require.NoError(t, db.Close())
+
+	t.Run("re-open database", func(t *testing.T) {
+		openArgs.Create = false
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assertVisible(t, sameDB, map[string]string{
+			"key2": "value2",
+		})
+
+		now.Store(time.Unix(1000, 0).UnixNano())
+		assertVisible(t, sameDB, map[string]string{
+			"key1": "value1+",
+			"key2": "value2",
+			"key3": "value3",
+		})
+	})
+}
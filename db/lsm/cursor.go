@@ -0,0 +1,257 @@
+package lsm
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+// One end of a key range. An inclusive bound admits keys equal to Key.
+type Bound struct {
+	Key       []byte
+	Inclusive bool
+}
+
+type CursorArgs struct {
+	LowerBound util.Optional[Bound]
+	UpperBound util.Optional[Bound]
+	// Read the versions visible to a snapshot instead of the latest versions
+	Snapshot *Snapshot
+	// Column family to read; defaults to the default column family
+	ColumnFamily *ColumnFamily
+}
+
+// Cursor allows seeking and bidirectional iteration over the live key-value pairs of an LSMDB,
+// optionally restricted to a key range. Like Scan, a cursor reads from the in-memory indexes and
+// SSTables that existed when it was created.
+//
+// A cursor is not safe for concurrent use, and must be closed once it is no longer needed. If the
+// cursor could not be created, or once it is closed, every positioning method returns false and
+// Err reports why.
+type Cursor struct {
+	lowerBound util.Optional[Bound]
+	upperBound util.Optional[Bound]
+	sources    readSources
+
+	// merged stream in the current direction
+	mux     sstable.IteratorMux
+	stop    func()
+	reverse bool
+
+	current KeyValuePair
+	valid   bool
+	err     error
+}
+
+var errCursorClosed = errors.New("cursor closed")
+
+func (me *LSMDB) NewCursor(args CursorArgs) *Cursor {
+	var start []byte
+	if lowerBound, ok := args.LowerBound.Unpack(); ok {
+		start = lowerBound.Key
+	}
+
+	family := args.ColumnFamily
+	if family == nil {
+		family = me.defaultFamily
+	}
+
+	sources, err := me.captureReadSources(family, start, args.Snapshot)
+
+	return &Cursor{
+		lowerBound: args.LowerBound,
+		upperBound: args.UpperBound,
+		sources:    sources,
+		stop:       func() {},
+		err:        err,
+	}
+}
+
+// Position the cursor at the first key within bounds.
+func (me *Cursor) First() bool {
+	if me.err != nil {
+		return false
+	}
+	lowerBound, ok := me.lowerBound.Unpack()
+	if !ok {
+		return me.seek(nil, false, false)
+	}
+	return me.seek(lowerBound.Key, false, !lowerBound.Inclusive)
+}
+
+// Position the cursor at the last key within bounds.
+func (me *Cursor) Last() bool {
+	if me.err != nil {
+		return false
+	}
+	upperBound, ok := me.upperBound.Unpack()
+	if !ok {
+		return me.seek(nil, true, false)
+	}
+	return me.seek(upperBound.Key, true, !upperBound.Inclusive)
+}
+
+// Position the cursor at the first key greater than or equal to the given key.
+func (me *Cursor) SeekGE(key []byte) bool {
+	if me.err != nil {
+		return false
+	}
+	if !me.isAboveLowerBound(key) {
+		return me.First()
+	}
+	return me.seek(key, false, false)
+}
+
+// Position the cursor at the last key strictly less than the given key.
+func (me *Cursor) SeekLT(key []byte) bool {
+	if me.err != nil {
+		return false
+	}
+	if !me.isBelowUpperBound(key) {
+		return me.Last()
+	}
+	return me.seek(key, true, true)
+}
+
+// Move the cursor to the next key. Returns false if there are no more keys within bounds, or
+// the cursor is not positioned.
+func (me *Cursor) Next() bool {
+	if me.err != nil || !me.valid {
+		return false
+	}
+	if me.reverse {
+		return me.seek(me.current.Key, false, true)
+	}
+	return me.step(nil)
+}
+
+// Move the cursor to the previous key. Returns false if there are no more keys within bounds, or
+// the cursor is not positioned.
+func (me *Cursor) Prev() bool {
+	if me.err != nil || !me.valid {
+		return false
+	}
+	if !me.reverse {
+		return me.seek(me.current.Key, true, true)
+	}
+	return me.step(nil)
+}
+
+// Indicates whether the cursor is positioned at a key.
+func (me *Cursor) Valid() bool {
+	return me.err == nil && me.valid
+}
+
+// Return the key-value pair the cursor is positioned at.
+func (me *Cursor) Entry() KeyValuePair {
+	if me.err != nil {
+		return KeyValuePair{}
+	}
+	return me.current
+}
+
+// Return the error, if any, that caused the cursor to become invalid.
+func (me *Cursor) Err() error {
+	return me.err
+}
+
+// Close the cursor, after which Err reports that it is closed. Closing it again has no effect.
+func (me *Cursor) Close() error {
+	if errors.Is(me.err, errCursorClosed) {
+		return nil
+	}
+	me.stop()
+	me.stop = func() {}
+	me.valid = false
+	me.current = KeyValuePair{}
+
+	if me.sources.release != nil {
+		me.sources.release()
+	}
+	// the released SSTables may be deleted, so nothing can be read anymore
+	me.sources = readSources{}
+	me.err = errCursorClosed
+
+	return nil
+}
+
+// seek rebuilds the merged stream in the given direction, starting at key. If exclusive is set,
+// an entry with exactly the given key is skipped.
+func (me *Cursor) seek(key []byte, reverse, exclusive bool) bool {
+	if me.err != nil {
+		return false
+	}
+	me.stop()
+
+	var err error
+	if reverse {
+		me.mux, me.stop, err = me.sources.reverseMux(key)
+	} else {
+		me.mux, me.stop, err = me.sources.forwardMux(key)
+	}
+	me.reverse = reverse
+	if err != nil {
+		return me.fail(err)
+	}
+
+	var skipKey []byte
+	if exclusive {
+		skipKey = key
+	}
+	return me.step(skipKey)
+}
+
+func (me *Cursor) step(skipKey []byte) bool {
+	for {
+		entry, hasNext, err := me.mux.NextEntry()
+		if err != nil {
+			return me.fail(err)
+		}
+		if !hasNext {
+			me.valid = false
+			return false
+		}
+		if skipKey != nil && bytes.Equal(entry.Key, skipKey) {
+			continue
+		}
+		if (me.reverse && !me.isAboveLowerBound(entry.Key)) ||
+			(!me.reverse && !me.isBelowUpperBound(entry.Key)) {
+			me.valid = false
+			return false
+		}
+		if entry.IsDeleted {
+			continue
+		}
+
+		me.current = entry.ToKeyValuePair()
+		me.valid = true
+		return true
+	}
+}
+
+func (me *Cursor) fail(err error) bool {
+	me.err = err
+	me.valid = false
+	return false
+}
+
+func (me *Cursor) isAboveLowerBound(key []byte) bool {
+	lowerBound, ok := me.lowerBound.Unpack()
+	if !ok {
+		return true
+	}
+	comp := me.sources.comparator.Compare(key, lowerBound.Key)
+	return comp > 0 || (comp == 0 && lowerBound.Inclusive)
+}
+
+func (me *Cursor) isBelowUpperBound(key []byte) bool {
+	upperBound, ok := me.upperBound.Unpack()
+	if !ok {
+		return true
+	}
+	comp := me.sources.comparator.Compare(key, upperBound.Key)
+	return comp < 0 || (comp == 0 && upperBound.Inclusive)
+}
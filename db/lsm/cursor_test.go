@@ -0,0 +1,147 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Cursor(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Cursor")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(64)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	// even keys end up in an SSTable, odd keys in memory, and multiples of 3 are deleted
+	for i := range 100 {
+		if i%2 == 0 {
+			require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("v")))
+		}
+	}
+	require.NoError(t, db.CreateSSTable())
+	for i := range 100 {
+		if i%2 == 1 {
+			require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("v")))
+		}
+		if i%3 == 0 {
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key %03d", i))))
+		}
+	}
+
+	key := func(i int) string {
+		return fmt.Sprintf("key %03d", i)
+	}
+
+	collect := func(cursor *Cursor, positioned bool, advance func() bool) (keys []string) {
+		for ok := positioned; ok; ok = advance() {
+			keys = append(keys, string(cursor.Entry().Key))
+		}
+		require.NoError(t, cursor.Err())
+		return keys
+	}
+
+	expected := func(from, to, step int) (keys []string) {
+		for i := from; i != to; i += step {
+			if i%3 != 0 {
+				keys = append(keys, key(i))
+			}
+		}
+		return keys
+	}
+
+	t.Run("forward and backward without bounds", func(t *testing.T) {
+		cursor := db.NewCursor(CursorArgs{})
+		defer cursor.Close()
+
+		assert.Equal(t, expected(0, 100, 1), collect(cursor, cursor.First(), cursor.Next))
+		assert.Equal(t, expected(99, -1, -1), collect(cursor, cursor.Last(), cursor.Prev))
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		cursor := db.NewCursor(CursorArgs{})
+		defer cursor.Close()
+
+		if assert.True(t, cursor.SeekGE([]byte(key(30)))) {
+			assert.Equal(t, key(31), string(cursor.Entry().Key))
+		}
+		if assert.True(t, cursor.SeekGE([]byte(key(31)))) {
+			assert.Equal(t, key(31), string(cursor.Entry().Key))
+		}
+		if assert.True(t, cursor.SeekLT([]byte(key(31)))) {
+			assert.Equal(t, key(29), string(cursor.Entry().Key))
+		}
+		assert.False(t, cursor.SeekGE([]byte("key 999")))
+		assert.False(t, cursor.SeekLT([]byte("key 000")))
+	})
+
+	t.Run("change direction", func(t *testing.T) {
+		cursor := db.NewCursor(CursorArgs{})
+		defer cursor.Close()
+
+		require.True(t, cursor.SeekGE([]byte(key(50))))
+		assert.Equal(t, key(50), string(cursor.Entry().Key))
+
+		var keys []string
+		for _, forward := range []bool{true, true, false, false, false, true} {
+			if forward {
+				require.True(t, cursor.Next())
+			} else {
+				require.True(t, cursor.Prev())
+			}
+			keys = append(keys, string(cursor.Entry().Key))
+		}
+		assert.Equal(t, []string{key(52), key(53), key(52), key(50), key(49), key(50)}, keys)
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		cursor := db.NewCursor(CursorArgs{
+			LowerBound: util.Some(Bound{Key: []byte(key(20)), Inclusive: false}),
+			UpperBound: util.Some(Bound{Key: []byte(key(41)), Inclusive: true}),
+		})
+		defer cursor.Close()
+
+		assert.Equal(t, expected(21, 42, 1), collect(cursor, cursor.First(), cursor.Next))
+		assert.Equal(t, expected(41, 20, -1), collect(cursor, cursor.Last(), cursor.Prev))
+
+		if assert.True(t, cursor.SeekGE([]byte(key(0)))) {
+			assert.Equal(t, key(22), string(cursor.Entry().Key))
+		}
+		if assert.True(t, cursor.SeekLT([]byte(key(99)))) {
+			assert.Equal(t, key(41), string(cursor.Entry().Key))
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		cursor := db.NewCursor(CursorArgs{
+			LowerBound: util.Some(Bound{Key: []byte(key(20)), Inclusive: true}),
+			UpperBound: util.Some(Bound{Key: []byte(key(40)), Inclusive: true}),
+		})
+		require.True(t, cursor.First())
+		require.NoError(t, cursor.Close())
+
+		assert.False(t, cursor.Next())
+		assert.False(t, cursor.Prev())
+		assert.False(t, cursor.First())
+		assert.False(t, cursor.Last())
+		assert.False(t, cursor.SeekGE([]byte(key(0))))
+		assert.False(t, cursor.SeekLT([]byte(key(99))))
+		assert.False(t, cursor.Valid())
+		assert.Empty(t, cursor.Entry().Key)
+		assert.ErrorIs(t, cursor.Err(), errCursorClosed)
+		assert.NoError(t, cursor.Close())
+	})
+}
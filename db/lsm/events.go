@@ -0,0 +1,245 @@
+package lsm
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/navijation/njsimple/storage/sstable"
+)
+
+// EventListener is notified of the background work of an LSMDB, such as to plug in alerting or
+// auditing. Callbacks are called one at a time and in order from a goroutine of their own, never
+// while the database holds its lock, so they may call back into the database; they must not call
+// Close, however, which waits for the remaining callbacks to finish. A slow callback delays later
+// callbacks, but not the database; events are dropped while thousands are waiting to be
+// delivered, and a background error is dropped while another one is.
+//
+// Embed NoopEventListener to only implement some of the callbacks.
+type EventListener interface {
+	// Called before an in-memory index is written to a new SSTable
+	OnFlushBegin(FlushInfo)
+	// Called once an in-memory index has been written to a new SSTable, or failed to be
+	OnFlushEnd(FlushInfo)
+	// Called once a new SSTable has been added to the database by a flush or merge
+	OnSSTableCreated(SSTableInfo)
+	// Called once an SSTable replaced by a merge or belonging to a dropped column family has been
+	// deleted, which is only after no reader uses it
+	OnSSTableDeleted(SSTableInfo)
+	// Called once the writeahead logs made obsolete by a new writeahead log have been deleted or
+	// archived
+	OnWriteAheadLogRotated(WriteAheadLogRotationInfo)
+	// Called before SSTables are merged into a new SSTable
+	OnMergeBegin(MergeInfo)
+	// Called once SSTables have been merged into a new SSTable, or failed to be
+	OnMergeEnd(MergeInfo)
+	// Called when background work fails; it is retried later, and the errors of attempts made
+	// before the previous error was delivered are dropped
+	OnBackgroundError(error)
+}
+
+type FlushInfo struct {
+	ColumnFamily  string
+	SSTableNumber uint64
+	// Size in bytes of the in-memory index being flushed
+	InMemoryIndexSize uint64
+	// Set once the flush has ended
+	FileSize uint64
+	Duration time.Duration
+	Err      error
+}
+
+type SSTableInfo struct {
+	ColumnFamily  string
+	SSTableNumber uint64
+	Path          string
+	Level         uint64
+	NumEntries    uint64
+	FileSize      uint64
+}
+
+type WriteAheadLogRotationInfo struct {
+	// Number of the writeahead log now being written to
+	WriteAheadLogNumber uint64
+	// Numbers of the deleted writeahead logs, whose writes are all in SSTables
+	DeletedWriteAheadLogNumbers []uint64
+	// Total size of the deleted writeahead logs
+	DeletedBytes uint64
+	// Whether the deleted writeahead logs were moved to the archive directory
+	Archived bool
+}
+
+type MergeInfo struct {
+	ColumnFamily        string
+	InputSSTableNumbers []uint64
+	// Total size of the input SSTables
+	InputBytes          uint64
+	OutputSSTableNumber uint64
+	OutputLevel         uint64
+	// Set once the merge has ended
+	OutputBytes uint64
+	Duration    time.Duration
+	Err         error
+}
+
+// NoopEventListener ignores every event.
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(FlushInfo)                           {}
+func (NoopEventListener) OnFlushEnd(FlushInfo)                             {}
+func (NoopEventListener) OnSSTableCreated(SSTableInfo)                     {}
+func (NoopEventListener) OnSSTableDeleted(SSTableInfo)                     {}
+func (NoopEventListener) OnWriteAheadLogRotated(WriteAheadLogRotationInfo) {}
+func (NoopEventListener) OnMergeBegin(MergeInfo)                           {}
+func (NoopEventListener) OnMergeEnd(MergeInfo)                             {}
+func (NoopEventListener) OnBackgroundError(error)                          {}
+
+// Maximum number of events waiting to be delivered, past which new events are dropped
+const maxPendingEvents = 1 << 12
+
+// eventQueue delivers events to an EventListener from a goroutine of its own. Queueing an event
+// never blocks on the listener, so that events can be queued while holding the DB lock. Instead,
+// events are dropped while the listener falls too far behind, and a background error is dropped
+// while another one is still waiting to be delivered, since failing work is retried repeatedly.
+type eventQueue struct {
+	listener EventListener
+
+	lock    sync.Mutex
+	pending []func(EventListener)
+	queued  *sync.Cond
+	started bool
+	stopped bool
+	wg      sync.WaitGroup
+
+	hasPendingBackgroundError bool
+	numDropped                uint64
+}
+
+// newEventQueue returns a queue delivering events to the given listener, which may be nil to
+// drop every event.
+func newEventQueue(listener EventListener) *eventQueue {
+	out := &eventQueue{listener: listener}
+	out.queued = sync.NewCond(&out.lock)
+	return out
+}
+
+// start starts delivering events, including any queued beforehand.
+func (me *eventQueue) start() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.listener == nil || me.started || me.stopped {
+		return
+	}
+	me.started = true
+
+	me.wg.Add(1)
+	go func() {
+		defer me.wg.Done()
+
+		for {
+			me.lock.Lock()
+			for len(me.pending) == 0 && !me.stopped {
+				me.queued.Wait()
+			}
+			events := me.pending
+			me.pending = nil
+			me.hasPendingBackgroundError = false
+			if me.numDropped > 0 {
+				log.Printf("Dropped %d events queued for a slow event listener", me.numDropped)
+				me.numDropped = 0
+			}
+			me.lock.Unlock()
+
+			if len(events) == 0 {
+				return
+			}
+			for _, event := range events {
+				event(me.listener)
+			}
+		}
+	}()
+}
+
+// stop waits for every queued event to be delivered, after which events are dropped.
+func (me *eventQueue) stop() {
+	me.lock.Lock()
+	me.stopped = true
+	me.queued.Broadcast()
+	me.lock.Unlock()
+
+	me.wg.Wait()
+}
+
+func (me *eventQueue) push(event func(EventListener)) {
+	me.pushUnlessPending(event, nil)
+}
+
+// pushUnlessPending queues an event unless the flag is set, in which case an event of the same
+// kind is already waiting to be delivered. The flag is set until the event is delivered.
+func (me *eventQueue) pushUnlessPending(event func(EventListener), isPending *bool) {
+	if me.listener == nil {
+		return
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.stopped || (isPending != nil && *isPending) {
+		return
+	}
+	if len(me.pending) >= maxPendingEvents {
+		me.numDropped++
+		return
+	}
+	if isPending != nil {
+		*isPending = true
+	}
+	me.pending = append(me.pending, event)
+	me.queued.Signal()
+}
+
+func (me *eventQueue) flushBegin(info FlushInfo) {
+	me.push(func(listener EventListener) { listener.OnFlushBegin(info) })
+}
+
+func (me *eventQueue) flushEnd(info FlushInfo) {
+	me.push(func(listener EventListener) { listener.OnFlushEnd(info) })
+}
+
+func (me *eventQueue) sstableCreated(info SSTableInfo) {
+	me.push(func(listener EventListener) { listener.OnSSTableCreated(info) })
+}
+
+func (me *eventQueue) sstableDeleted(info SSTableInfo) {
+	me.push(func(listener EventListener) { listener.OnSSTableDeleted(info) })
+}
+
+func (me *eventQueue) writeAheadLogRotated(info WriteAheadLogRotationInfo) {
+	me.push(func(listener EventListener) { listener.OnWriteAheadLogRotated(info) })
+}
+
+func (me *eventQueue) mergeBegin(info MergeInfo) {
+	me.push(func(listener EventListener) { listener.OnMergeBegin(info) })
+}
+
+func (me *eventQueue) mergeEnd(info MergeInfo) {
+	me.push(func(listener EventListener) { listener.OnMergeEnd(info) })
+}
+
+func (me *eventQueue) backgroundError(err error) {
+	me.pushUnlessPending(func(listener EventListener) {
+		listener.OnBackgroundError(err)
+	}, &me.hasPendingBackgroundError)
+}
+
+func newSSTableInfo(family *ColumnFamily, table *sstable.SSTable) SSTableInfo {
+	return SSTableInfo{
+		ColumnFamily:  family.name,
+		SSTableNumber: sstableNumber(table),
+		Path:          table.Path(),
+		Level:         table.Level(),
+		NumEntries:    table.NumEntries(),
+		FileSize:      sstableSize(table),
+	}
+}
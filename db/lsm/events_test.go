@@ -0,0 +1,225 @@
+package lsm
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingListener struct {
+	NoopEventListener
+
+	db     *LSMDB
+	lock   sync.Mutex
+	events []string
+
+	flushes   []FlushInfo
+	created   []SSTableInfo
+	deleted   []SSTableInfo
+	rotations []WriteAheadLogRotationInfo
+	merges    []MergeInfo
+}
+
+func (me *recordingListener) record(event string) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.events = append(me.events, event)
+}
+
+func (me *recordingListener) OnFlushBegin(info FlushInfo) {
+	me.record(fmt.Sprintf("flush begin %d", info.SSTableNumber))
+}
+
+func (me *recordingListener) OnFlushEnd(info FlushInfo) {
+	me.record(fmt.Sprintf("flush end %d", info.SSTableNumber))
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.flushes = append(me.flushes, info)
+}
+
+func (me *recordingListener) OnSSTableCreated(info SSTableInfo) {
+	// callbacks may call back into the database
+	_ = me.db.Stats()
+
+	me.record(fmt.Sprintf("created %d", info.SSTableNumber))
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.created = append(me.created, info)
+}
+
+func (me *recordingListener) OnSSTableDeleted(info SSTableInfo) {
+	me.record(fmt.Sprintf("deleted %d", info.SSTableNumber))
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.deleted = append(me.deleted, info)
+}
+
+func (me *recordingListener) OnWriteAheadLogRotated(info WriteAheadLogRotationInfo) {
+	me.record(fmt.Sprintf("rotated %d", info.WriteAheadLogNumber))
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.rotations = append(me.rotations, info)
+}
+
+func (me *recordingListener) OnMergeBegin(info MergeInfo) {
+	me.record(fmt.Sprintf("merge begin %d", info.OutputSSTableNumber))
+}
+
+func (me *recordingListener) OnMergeEnd(info MergeInfo) {
+	me.record(fmt.Sprintf("merge end %d", info.OutputSSTableNumber))
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.merges = append(me.merges, info)
+}
+
+func TestLSMDB_EventListener(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_EventListener")
+	cleanup()
+	defer cleanup()
+
+	listener := &recordingListener{}
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(2),
+		}),
+		EventListener: util.Some[EventListener](listener),
+	})
+	require.NoError(t, err)
+	listener.db = db
+	require.NoError(t, db.Start())
+
+	for i := range 20 {
+		require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("value")))
+		if i%10 == 9 {
+			require.NoError(t, db.CreateSSTable())
+		}
+	}
+	waitForCompaction(t, db, 1)
+	require.NoError(t, db.Close())
+
+	// every event has been delivered once Close returns
+	listener.lock.Lock()
+	defer listener.lock.Unlock()
+
+	if assert.Len(t, listener.flushes, 2) {
+		for i, info := range listener.flushes {
+			assert.Equal(t, defaultColumnFamilyName, info.ColumnFamily)
+			assert.EqualValues(t, i+1, info.SSTableNumber)
+			assert.NotZero(t, info.InMemoryIndexSize)
+			assert.NotZero(t, info.FileSize)
+			assert.NoError(t, info.Err)
+		}
+	}
+
+	if assert.Len(t, listener.merges, 1) {
+		merge := listener.merges[0]
+		assert.ElementsMatch(t, []uint64{1, 2}, merge.InputSSTableNumbers)
+		assert.EqualValues(t, 3, merge.OutputSSTableNumber)
+		assert.NotZero(t, merge.InputBytes)
+		assert.NotZero(t, merge.OutputBytes)
+		assert.NoError(t, merge.Err)
+	}
+
+	if assert.Len(t, listener.created, 3) {
+		assert.EqualValues(t, 3, listener.created[2].SSTableNumber)
+		assert.EqualValues(t, 20, listener.created[2].NumEntries)
+		assert.Equal(t, db.defaultFamily.sstablePath(3), listener.created[2].Path)
+	}
+	deletedNumbers := []uint64{}
+	for _, info := range listener.deleted {
+		deletedNumbers = append(deletedNumbers, info.SSTableNumber)
+	}
+	assert.ElementsMatch(t, []uint64{1, 2}, deletedNumbers)
+
+	if assert.Len(t, listener.rotations, 2) {
+		assert.Equal(t, WriteAheadLogRotationInfo{
+			WriteAheadLogNumber:         2,
+			DeletedWriteAheadLogNumbers: []uint64{1},
+			DeletedBytes:                listener.rotations[0].DeletedBytes,
+		}, listener.rotations[0])
+		assert.NotZero(t, listener.rotations[0].DeletedBytes)
+	}
+
+	// a flush ends before its SSTable is created, and a merge's inputs are deleted after it ends
+	for _, pair := range [][2]string{
+		{"flush begin 1", "flush end 1"},
+		{"flush end 1", "created 1"},
+		{"created 1", "rotated 2"},
+		{"merge begin 3", "created 3"},
+		{"created 3", "merge end 3"},
+		{"merge end 3", "deleted 1"},
+	} {
+		first, second := slices.Index(listener.events, pair[0]), slices.Index(listener.events, pair[1])
+		_ = assert.NotEqual(t, -1, first, pair[0]) && assert.NotEqual(t, -1, second, pair[1]) &&
+			assert.Less(t, first, second, pair)
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	t.Parallel()
+
+	t.Run("events queued before start are delivered", func(t *testing.T) {
+		listener := &recordingListener{}
+		queue := newEventQueue(listener)
+		queue.flushBegin(FlushInfo{SSTableNumber: 1})
+		queue.start()
+		queue.flushBegin(FlushInfo{SSTableNumber: 2})
+		queue.stop()
+
+		assert.Equal(t, []string{"flush begin 1", "flush begin 2"}, listener.events)
+
+		// events are dropped once stopped
+		queue.flushBegin(FlushInfo{SSTableNumber: 3})
+		assert.Len(t, listener.events, 2)
+	})
+
+	t.Run("events are dropped while the listener falls behind", func(t *testing.T) {
+		listener := &recordingListener{}
+		queue := newEventQueue(listener)
+		for i := range maxPendingEvents + 10 {
+			queue.flushBegin(FlushInfo{SSTableNumber: uint64(i)})
+		}
+		queue.start()
+		queue.stop()
+
+		if assert.Len(t, listener.events, maxPendingEvents) {
+			assert.Equal(t, fmt.Sprintf("flush begin %d", maxPendingEvents-1),
+				listener.events[maxPendingEvents-1])
+		}
+	})
+
+	t.Run("repeated background errors are coalesced", func(t *testing.T) {
+		listener := backgroundErrorListener{errs: make(chan error, 10)}
+		queue := newEventQueue(listener)
+		for i := range 5 {
+			queue.backgroundError(fmt.Errorf("error %d", i))
+		}
+		queue.start()
+		require.EqualError(t, <-listener.errs, "error 0")
+
+		// errors are queued again once the pending one has been delivered
+		queue.backgroundError(fmt.Errorf("error 5"))
+		queue.stop()
+		if assert.Len(t, listener.errs, 1) {
+			assert.EqualError(t, <-listener.errs, "error 5")
+		}
+	})
+
+	t.Run("without a listener", func(t *testing.T) {
+		queue := newEventQueue(nil)
+		queue.start()
+		queue.backgroundError(fmt.Errorf("error"))
+		queue.stop()
+	})
+}
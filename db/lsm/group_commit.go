@@ -0,0 +1,203 @@
+package lsm
+
+import (
+	"io"
+
+	"github.com/navijation/njsimple/storage/keyvaluepair"
+)
+
+// upper bound on the size of the writes a group leader appends on behalf of other writers, so
+// that a small write is not held up behind too large a group
+const maxWriteGroupSize = 1 << 20
+
+// pendingWrite is a write waiting in the writer queue. The writer at the front of the queue leads
+// the next group: it appends its own write and those queued behind it to the writeahead log in a
+// single entry with a single sync, then releases every writer in the group.
+type pendingWrite struct {
+	keyValues []keyvaluepair.KeyValuePair
+	// column family of each key-value pair, where nil is the default column family; nil if every
+	// pair is written to the default column family
+	families []*ColumnFamily
+	// checked by the group leader while holding the lock, after every earlier write has been
+	// applied; if it fails, nothing is written. A write with a precondition always leads its group.
+	precondition func(ctx *dbCtx) error
+
+	// set by the group leader once the write is durable and applied, or has failed
+	finished bool
+	err      error
+}
+
+// write queues the given write and returns once it has been committed, either by this writer
+// leading a group or by joining the group of another.
+func (me *LSMDB) write(write *pendingWrite) error {
+	me.writersLock.Lock()
+	me.writers = append(me.writers, write)
+	for !write.finished && me.writers[0] != write {
+		me.writersQueued.Wait()
+	}
+	if write.finished {
+		me.writersLock.Unlock()
+		return write.err
+	}
+	me.writersLock.Unlock()
+
+	group, err := me.commitWriteGroup(write)
+
+	me.writersLock.Lock()
+	defer me.writersLock.Unlock()
+
+	for _, member := range group {
+		member.finished = true
+		member.err = err
+	}
+	me.writers = me.writers[len(group):]
+	me.writersQueued.Broadcast()
+
+	return write.err
+}
+
+// commitWriteGroup appends the leader's write and as many queued writes as fit in a group to the
+// writeahead log, then applies them to the primary in-memory index. The lock is released while
+// the writeahead log is written and synced, so that readers and queueing writers are not blocked
+// on I/O.
+func (me *LSMDB) commitWriteGroup(leader *pendingWrite) (group []*pendingWrite, _ error) {
+	ctx := &dbCtx{}
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	group = []*pendingWrite{leader}
+
+	if err := me.checkStateError(ctx); err != nil {
+		return group, err
+	}
+	if err := me.makeRoomForWrite(ctx); err != nil {
+		return group, err
+	}
+	if err := me.checkWriteFamilies(leader); err != nil {
+		return group, err
+	}
+	if leader.precondition != nil {
+		if err := leader.precondition(ctx); err != nil {
+			return group, err
+		}
+	}
+
+	me.writersLock.Lock()
+	size := pendingWriteSize(leader)
+	for _, follower := range me.writers[1:] {
+		size += pendingWriteSize(follower)
+		// a follower that cannot be written fails on its own once it leads a group
+		if follower.precondition != nil || size > maxWriteGroupSize ||
+			me.checkWriteFamilies(follower) != nil {
+			break
+		}
+		group = append(group, follower)
+	}
+	me.writersLock.Unlock()
+
+	var (
+		entry         = WriteBatchEntry{FirstSequenceNumber: me.lastSequenceNumber + 1}
+		familyIDs     []uint64
+		isDefaultOnly = true
+	)
+	for _, member := range group {
+		for i, kvp := range member.keyValues {
+			entry.StoredKeyValuePairs = append(entry.StoredKeyValuePairs, kvp.ToStoredKeyValuePair())
+			var familyID uint64
+			if family := member.family(i); family != nil {
+				familyID = family.id
+			}
+			familyIDs = append(familyIDs, familyID)
+			isDefaultOnly = isDefaultOnly && familyID == 0
+		}
+	}
+	if !isDefaultOnly {
+		entry.ColumnFamilyIDs = familyIDs
+	}
+
+	// a lone write keeps its own entry type, which is smaller than a batch of one
+	var journalEntry io.WriterTo = &entry
+	switch len(entry.StoredKeyValuePairs) {
+	case 0:
+		return group, nil
+	case 1:
+		journalEntry = &CUDKeyValueEntry{
+			SequenceNumber:     entry.FirstSequenceNumber,
+			StoredKeyValuePair: entry.StoredKeyValuePairs[0],
+			ColumnFamilyID:     entry.ColumnFamilyID(0),
+		}
+	}
+
+	if err := me.appendEntryUnlocked(ctx, journalEntry); err != nil {
+		me.stateErr = err
+		return group, err
+	}
+
+	me.processWriteBatchEntry(ctx, entry)
+	return group, nil
+}
+
+// family returns the column family the i-th key-value pair of the write is written to, or nil for
+// the default column family.
+func (me *pendingWrite) family(i int) *ColumnFamily {
+	if i < len(me.families) {
+		return me.families[i]
+	}
+	return nil
+}
+
+// checkWriteFamilies returns an error if a write cannot be applied to one of its column families.
+// The caller must hold the lock.
+func (me *LSMDB) checkWriteFamilies(write *pendingWrite) error {
+	for i := range write.keyValues {
+		if family := write.family(i); family != nil {
+			if err := me.checkColumnFamily(family); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pendingWriteSize(write *pendingWrite) (out uint64) {
+	for _, kvp := range write.keyValues {
+		out += keyValueSize(kvp)
+	}
+	return out
+}
+
+// appendEntryUnlocked appends an entry to the current writeahead log like appendEntry, but
+// releases the lock while doing so. Anything else that appends to the writeahead log or replaces
+// it must first call waitForLogWriter.
+func (me *LSMDB) appendEntryUnlocked(ctx *dbCtx, entry io.WriterTo) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	writeAheadLog := me.writeAheadLogs[0]
+	bytes := timestampJournalEntry(entry, me.clock())
+
+	me.isWritingLog = true
+	ctx.LiftLock(&me.lock)
+	journalEntry, err := writeAheadLog.AppendEntry(bytes)
+	ctx.ReinstateLock(&me.lock)
+	me.isWritingLog = false
+	me.logWritten.Broadcast()
+
+	if err != nil {
+		return err
+	}
+	me.stats.writeAheadLogBytesWritten.Add(journalEntry.SizeOf())
+	return nil
+}
+
+// waitForLogWriter stalls until no write group leader is appending to the writeahead log, during
+// which the lock is released.
+func (me *LSMDB) waitForLogWriter(ctx *dbCtx) {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	for me.isWritingLog {
+		me.logWritten.Wait()
+	}
+}
@@ -0,0 +1,148 @@
+package lsm
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_GroupCommit(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_GroupCommit")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	const numWriters = 8
+
+	t.Run("queued writers share one entry", func(t *testing.T) {
+		// hold the lock so that the first writer cannot commit until every writer is queued
+		db.lock.Lock()
+		numEntries := db.writeAheadLogs[0].NumEntries()
+
+		var wg sync.WaitGroup
+		for i := range numWriters {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if i%2 == 0 {
+					assert.NoError(t, db.Upsert(
+						[]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)),
+					))
+				} else {
+					var batch WriteBatch
+					batch.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+					batch.Put([]byte(fmt.Sprintf("other%d", i)), []byte("other"))
+					assert.NoError(t, db.Write(&batch))
+				}
+			}()
+		}
+
+		for {
+			db.writersLock.Lock()
+			numQueued := len(db.writers)
+			db.writersLock.Unlock()
+			if numQueued == numWriters {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		db.lock.Unlock()
+		wg.Wait()
+
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		assert.Equal(t, numEntries+1, db.writeAheadLogs[0].NumEntries())
+		assert.EqualValues(t, numWriters+numWriters/2, db.lastSequenceNumber)
+	})
+
+	t.Run("transaction conflicts are checked against earlier groups", func(t *testing.T) {
+		txn := db.Begin()
+		_, _, err := txn.Get([]byte("key0"))
+		require.NoError(t, err)
+		txn.Put([]byte("key0"), []byte("txn"))
+
+		require.NoError(t, db.Upsert([]byte("key0"), []byte("value0+")))
+
+		var conflictErr *TxnConflictError
+		assert.ErrorAs(t, txn.Commit(), &conflictErr)
+	})
+
+	require.NoError(t, db.Close())
+
+	t.Run("re-open database", func(t *testing.T) {
+		sameDB, err := Open(OpenArgs{
+			Path:           dir,
+			IndexChunkSize: util.Some(uint64(100)),
+		})
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		for i := 1; i < numWriters; i++ {
+			entry, exists, err := sameDB.Lookup([]byte(fmt.Sprintf("key%d", i)))
+			_ = assert.NoError(t, err) && assert.True(t, exists) &&
+				assert.Equal(t, fmt.Sprintf("value%d", i), string(entry.Value))
+		}
+		entry, exists, err := sameDB.Lookup([]byte("key0"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value0+", string(entry.Value))
+	})
+}
+
+func BenchmarkLSMDB_Upsert(b *testing.B) {
+	for _, numWriters := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("writers=%d", numWriters), func(b *testing.B) {
+			dir, cleanup := testing_util.MkdirTemp(b, "BenchmarkLSMDB_Upsert")
+			cleanup()
+			defer cleanup()
+
+			db, err := Open(OpenArgs{
+				Path:            dir,
+				Create:          true,
+				WriteBufferSize: util.Some(uint64(4 << 20)),
+			})
+			require.NoError(b, err)
+			require.NoError(b, db.Start())
+			defer db.Close()
+
+			var counter atomic.Int64
+			value := make([]byte, 100)
+
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for range numWriters {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						i := counter.Add(1)
+						if i > int64(b.N) {
+							return
+						}
+						if err := db.Upsert([]byte(fmt.Sprintf("key%d", i)), value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
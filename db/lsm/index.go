@@ -2,38 +2,302 @@ package lsm
 
 import (
 	"bytes"
+	"cmp"
+	"iter"
+	"math/rand/v2"
 	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/navijation/njsimple/storage/keyvaluepair"
 )
 
-// TODO: replace this with a binary search tree for added realism
+const (
+	// enough levels for millions of keys with a branching factor of 4
+	maxSkipListHeight = 12
+	skipListBranching = 4
+)
+
+// InMemoryIndex is a skip list of keys, each holding its versions sorted by descending sequence
+// number. Writers are serialized, but readers never block: a node is fully built before being
+// linked in, and the versions of a key are replaced as a whole rather than modified in place.
+//
+// The zero value is an empty index ordered by sstable.BytewiseComparator.
 type InMemoryIndex struct {
-	KeyValues []keyvaluepair.KeyValuePair
+	comparator Comparator
+	writeLock  sync.Mutex
+	head       atomic.Pointer[skipListNode]
+	size       atomic.Uint64
 }
 
+// Return an empty index ordered by the given comparator.
+func NewInMemoryIndex(comparator Comparator) *InMemoryIndex {
+	return &InMemoryIndex{comparator: comparator}
+}
+
+type skipListNode struct {
+	key []byte
+	// sorted by descending sequence number; never modified once stored
+	versions atomic.Pointer[[]keyvaluepair.KeyValuePair]
+	next     []atomic.Pointer[skipListNode]
+}
+
+// Insert a key-value pair, replacing all existing versions of the key, unless it is a merge
+// operand.
 func (me *InMemoryIndex) Upsert(kvp keyvaluepair.KeyValuePair) {
-	idx, exists := slices.BinarySearchFunc(
-		me.KeyValues, kvp.Key, func(pair keyvaluepair.KeyValuePair, target []byte) int {
-			return bytes.Compare(pair.Key, target)
+	me.UpsertVersion(kvp, nil)
+}
+
+// Insert a new version of a key, replacing any version with the same sequence number. Older
+// versions of the key are discarded unless they are still visible to one of the given snapshot
+// sequence numbers, which must be sorted, or merge operands still need them.
+func (me *InMemoryIndex) UpsertVersion(kvp keyvaluepair.KeyValuePair, snapshots []uint64) {
+	me.writeLock.Lock()
+	defer me.writeLock.Unlock()
+
+	head := me.head.Load()
+	if head == nil {
+		head = &skipListNode{next: make([]atomic.Pointer[skipListNode], maxSkipListHeight)}
+		me.head.Store(head)
+	}
+
+	var prevs [maxSkipListHeight]*skipListNode
+	node := me.seek(head, kvp.Key, &prevs)
+
+	var oldVersions []keyvaluepair.KeyValuePair
+	if node != nil && bytes.Equal(node.key, kvp.Key) {
+		oldVersions = *node.versions.Load()
+	} else {
+		node = nil
+	}
+
+	versions := make([]keyvaluepair.KeyValuePair, 0, len(oldVersions)+1)
+	versions = append(versions, oldVersions...)
+	versions = slices.DeleteFunc(versions, func(version keyvaluepair.KeyValuePair) bool {
+		return version.SequenceNumber == kvp.SequenceNumber
+	})
+	idx, _ := slices.BinarySearchFunc(
+		versions, kvp.SequenceNumber, func(version keyvaluepair.KeyValuePair, target uint64) int {
+			// descending order
+			return cmp.Compare(target, version.SequenceNumber)
 		},
 	)
-	if exists {
-		me.KeyValues[idx] = kvp
-	} else {
-		me.KeyValues = slices.Insert(me.KeyValues, idx, kvp)
+	versions = slices.Insert(versions, idx, kvp)
+
+	// keep only the newest version visible to each snapshot, along with the versions below it up
+	// to the first one that is not a merge operand, since operands are merged into them
+	var (
+		kept          = versions[:0]
+		lastStripe    = -1
+		lastIsOperand = false
+	)
+	for _, version := range versions {
+		stripe, _ := slices.BinarySearch(snapshots, version.SequenceNumber)
+		if stripe != lastStripe || lastIsOperand {
+			kept = append(kept, version)
+			lastStripe = stripe
+			lastIsOperand = version.IsMergeOperand
+		}
+	}
+
+	var oldSize, newSize uint64
+	for _, version := range oldVersions {
+		oldSize += keyValueSize(version)
+	}
+	for _, version := range kept {
+		newSize += keyValueSize(version)
+	}
+	me.size.Add(newSize - oldSize)
+
+	if node != nil {
+		node.versions.Store(&kept)
+		return
+	}
+
+	// link the new node in from the bottom up, so that readers at every level only ever see
+	// fully linked nodes
+	node = &skipListNode{
+		key:  kvp.Key,
+		next: make([]atomic.Pointer[skipListNode], randomSkipListHeight()),
 	}
+	node.versions.Store(&kept)
+	for level := range node.next {
+		node.next[level].Store(prevs[level].next[level].Load())
+		prevs[level].next[level].Store(node)
+	}
+}
+
+// Return the approximate number of bytes the index's key-value pairs take up.
+func (me *InMemoryIndex) SizeOf() uint64 {
+	return me.size.Load()
 }
 
+// Lookup the newest version of a key.
 func (me *InMemoryIndex) Lookup(key []byte) (out keyvaluepair.KeyValuePair, exists bool) {
-	idx, exists := slices.BinarySearchFunc(
-		me.KeyValues, key, func(pair keyvaluepair.KeyValuePair, target []byte) int {
-			return bytes.Compare(pair.Key, target)
-		},
-	)
-	if !exists {
+	versions := me.versions(key)
+	if len(versions) == 0 {
 		return out, false
 	}
 
-	return me.KeyValues[idx], true
+	return versions[0], true
+}
+
+// Lookup the newest version of a key whose sequence number is at most the given sequence number.
+func (me *InMemoryIndex) LookupAt(
+	key []byte, sequenceNumber uint64,
+) (out keyvaluepair.KeyValuePair, exists bool) {
+	for _, version := range me.versions(key) {
+		if version.SequenceNumber <= sequenceNumber {
+			return version, true
+		}
+	}
+
+	return out, false
+}
+
+// Return an iterator over the versions of a key whose sequence numbers are at most the given
+// sequence number, newest first.
+func (me *InMemoryIndex) VersionsAt(
+	key []byte, sequenceNumber uint64,
+) iter.Seq[keyvaluepair.KeyValuePair] {
+	return func(yield func(keyvaluepair.KeyValuePair) bool) {
+		for _, version := range me.versions(key) {
+			if version.SequenceNumber <= sequenceNumber && !yield(version) {
+				return
+			}
+		}
+	}
+}
+
+// Return an iterator over all versions of all keys, sorted by key and then by descending sequence
+// number.
+func (me *InMemoryIndex) All() iter.Seq[keyvaluepair.KeyValuePair] {
+	return me.EntriesFrom(nil)
+}
+
+// Return an iterator over all versions of the keys greater than or equal to the given key, sorted
+// by key and then by descending sequence number. A nil key starts from the first key.
+//
+// The iterator does not block writers, and observes any keys inserted ahead of it.
+func (me *InMemoryIndex) EntriesFrom(start []byte) iter.Seq[keyvaluepair.KeyValuePair] {
+	return func(yield func(keyvaluepair.KeyValuePair) bool) {
+		head := me.head.Load()
+		if head == nil {
+			return
+		}
+
+		// a nil key sorts first only by some comparators
+		node := head.next[0].Load()
+		if start != nil {
+			node = me.seek(head, start, nil)
+		}
+		for ; node != nil; node = node.next[0].Load() {
+			for _, version := range *node.versions.Load() {
+				if !yield(version) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Return an iterator over all versions of the keys less than or equal to the given key, in
+// descending key order, with the versions of each key still sorted by descending sequence number.
+// A nil key starts from the last key.
+//
+// Like EntriesFrom, the iterator does not block writers. Nodes only link forward, so every step
+// back searches for the previous key from the head.
+func (me *InMemoryIndex) ReverseEntriesFrom(end []byte) iter.Seq[keyvaluepair.KeyValuePair] {
+	return func(yield func(keyvaluepair.KeyValuePair) bool) {
+		head := me.head.Load()
+		if head == nil {
+			return
+		}
+
+		for node := me.seekLast(head, end, true); node != head; {
+			for _, version := range *node.versions.Load() {
+				if !yield(version) {
+					return
+				}
+			}
+			node = me.seekLast(head, node.key, false)
+		}
+	}
+}
+
+// versions returns every version of a key, newest first.
+func (me *InMemoryIndex) versions(key []byte) []keyvaluepair.KeyValuePair {
+	head := me.head.Load()
+	if head == nil {
+		return nil
+	}
+
+	node := me.seek(head, key, nil)
+	if node == nil || !bytes.Equal(node.key, key) {
+		return nil
+	}
+	return *node.versions.Load()
+}
+
+// seek returns the first node with a key greater than or equal to the given key, or nil if there
+// is none. If prevs is set, it receives the last node before that key at every level.
+func (me *InMemoryIndex) seek(
+	head *skipListNode, key []byte, prevs *[maxSkipListHeight]*skipListNode,
+) *skipListNode {
+	node := head
+	for level := maxSkipListHeight - 1; level >= 0; level-- {
+		for {
+			next := node.next[level].Load()
+			if next == nil || me.compare(next.key, key) >= 0 {
+				break
+			}
+			node = next
+		}
+		if prevs != nil {
+			prevs[level] = node
+		}
+	}
+	return node.next[0].Load()
+}
+
+// seekLast returns the last node with a key less than the given key, or less than or equal to it
+// if inclusive is set, or head if there is none. A nil key returns the last node.
+func (me *InMemoryIndex) seekLast(head *skipListNode, key []byte, inclusive bool) *skipListNode {
+	node := head
+	for level := maxSkipListHeight - 1; level >= 0; level-- {
+		for {
+			next := node.next[level].Load()
+			if next == nil {
+				break
+			}
+			if key != nil {
+				if order := me.compare(next.key, key); order > 0 || order == 0 && !inclusive {
+					break
+				}
+			}
+			node = next
+		}
+	}
+	return node
+}
+
+func (me *InMemoryIndex) compare(a, b []byte) int {
+	if me.comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return me.comparator.Compare(a, b)
+}
+
+func randomSkipListHeight() int {
+	height := 1
+	for height < maxSkipListHeight && rand.IntN(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// keyValueSize returns the approximate size of a key-value pair, including the key size, value
+// size, and sequence number fields it takes up once flushed to an SSTable.
+func keyValueSize(kvp keyvaluepair.KeyValuePair) uint64 {
+	return uint64(len(kvp.Key)+len(kvp.Value)) + 8 + 8 + 8
 }
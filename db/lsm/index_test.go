@@ -1,7 +1,10 @@
 package lsm
 
 import (
+	"bytes"
 	"fmt"
+	"slices"
+	"sync"
 	"testing"
 
 	"github.com/navijation/njsimple/storage/keyvaluepair"
@@ -20,17 +23,11 @@ func TestInMemoryIndex_Upsert(t *testing.T) {
 	index.Upsert(kvp1)
 	index.Upsert(kvp2)
 
-	if assert.Equal(t, 2, len(index.KeyValues)) {
-		assert.Equal(t, kvp1, index.KeyValues[0])
-		assert.Equal(t, kvp2, index.KeyValues[1])
-	}
+	assert.Equal(t, []keyvaluepair.KeyValuePair{kvp1, kvp2}, slices.Collect(index.All()))
 
 	index.Upsert(kvp1Plus)
 
-	if assert.Equal(t, 2, len(index.KeyValues)) {
-		assert.Equal(t, kvp1Plus, index.KeyValues[0])
-		assert.Equal(t, kvp2, index.KeyValues[1])
-	}
+	assert.Equal(t, []keyvaluepair.KeyValuePair{kvp1Plus, kvp2}, slices.Collect(index.All()))
 
 	for i := 100; i > 2; i-- {
 		index.Upsert(KeyValuePair{
@@ -40,7 +37,61 @@ func TestInMemoryIndex_Upsert(t *testing.T) {
 		})
 	}
 
-	assert.Len(t, index.KeyValues, 100)
+	keyValues := slices.Collect(index.All())
+	assert.Len(t, keyValues, 100)
+	assert.True(t, slices.IsSortedFunc(keyValues, func(a, b keyvaluepair.KeyValuePair) int {
+		return bytes.Compare(a.Key, b.Key)
+	}))
+
+	// each pair takes up its key and value, plus 24 bytes of overhead
+	var expectedSize uint64
+	for _, kvp := range keyValues {
+		expectedSize += uint64(len(kvp.Key)+len(kvp.Value)) + 24
+	}
+	assert.Equal(t, expectedSize, index.SizeOf())
+}
+
+func TestInMemoryIndex_UpsertVersion(t *testing.T) {
+	t.Parallel()
+
+	index := InMemoryIndex{}
+
+	version := func(value string, sequenceNumber uint64) keyvaluepair.KeyValuePair {
+		return keyvaluepair.KeyValuePair{
+			Key:            []byte("key1"),
+			Value:          []byte(value),
+			SequenceNumber: sequenceNumber,
+		}
+	}
+
+	index.UpsertVersion(version("v1", 1), nil)
+	index.UpsertVersion(version("v2", 2), []uint64{1})
+	index.UpsertVersion(version("v3", 3), []uint64{1})
+
+	// v2 is not visible to any snapshot, so it is discarded
+	assert.Equal(t, []keyvaluepair.KeyValuePair{version("v3", 3), version("v1", 1)},
+		slices.Collect(index.All()))
+
+	index.UpsertVersion(version("v4", 4), nil)
+	assert.Equal(t, []keyvaluepair.KeyValuePair{version("v4", 4)}, slices.Collect(index.All()))
+
+	index.UpsertVersion(version("v5", 5), []uint64{4})
+	index.UpsertVersion(version("v5+", 5), []uint64{4})
+	assert.Equal(t, []keyvaluepair.KeyValuePair{version("v5+", 5), version("v4", 4)},
+		slices.Collect(index.All()))
+
+	t.Run("lookup at", func(t *testing.T) {
+		result, exists := index.LookupAt([]byte("key1"), 4)
+		assert.True(t, exists)
+		assert.Equal(t, version("v4", 4), result)
+
+		_, exists = index.LookupAt([]byte("key1"), 3)
+		assert.False(t, exists)
+
+		result, exists = index.Lookup([]byte("key1"))
+		assert.True(t, exists)
+		assert.Equal(t, version("v5+", 5), result)
+	})
 }
 
 func TestInMemoryIndex_Lookup(t *testing.T) {
@@ -63,3 +114,98 @@ func TestInMemoryIndex_Lookup(t *testing.T) {
 	_, exists = index.Lookup([]byte("key3"))
 	assert.False(t, exists)
 }
+
+func TestInMemoryIndex_EntriesFrom(t *testing.T) {
+	t.Parallel()
+
+	index := InMemoryIndex{}
+	assert.Empty(t, slices.Collect(index.All()))
+
+	for _, key := range []string{"key3", "key1", "key4", "key2"} {
+		index.Upsert(keyvaluepair.KeyValuePair{Key: []byte(key), Value: []byte("value")})
+	}
+
+	keys := func(start []byte) (out []string) {
+		for kvp := range index.EntriesFrom(start) {
+			out = append(out, string(kvp.Key))
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"key1", "key2", "key3", "key4"}, keys(nil))
+	assert.Equal(t, []string{"key2", "key3", "key4"}, keys([]byte("key2")))
+	assert.Equal(t, []string{"key3", "key4"}, keys([]byte("key21")))
+	assert.Empty(t, keys([]byte("key5")))
+}
+
+func TestInMemoryIndex_ReverseEntriesFrom(t *testing.T) {
+	t.Parallel()
+
+	index := InMemoryIndex{}
+	assert.Empty(t, slices.Collect(index.ReverseEntriesFrom(nil)))
+
+	for _, key := range []string{"key3", "key1", "key4", "key2"} {
+		index.Upsert(keyvaluepair.KeyValuePair{Key: []byte(key), Value: []byte("value")})
+	}
+	index.UpsertVersion(keyvaluepair.KeyValuePair{
+		Key: []byte("key2"), Value: []byte("operand"), SequenceNumber: 1, IsMergeOperand: true,
+	}, nil)
+
+	keys := func(end []byte) (out []string) {
+		for kvp := range index.ReverseEntriesFrom(end) {
+			out = append(out, fmt.Sprintf("%s@%d", kvp.Key, kvp.SequenceNumber))
+		}
+		return out
+	}
+
+	// versions of a key are still newest first
+	all := []string{"key4@0", "key3@0", "key2@1", "key2@0", "key1@0"}
+	assert.Equal(t, all, keys(nil))
+	assert.Equal(t, all[2:], keys([]byte("key2")))
+	assert.Equal(t, all[2:], keys([]byte("key21")))
+	assert.Equal(t, all, keys([]byte("key5")))
+	assert.Empty(t, keys([]byte("key0")))
+}
+
+func TestInMemoryIndex_ConcurrentReads(t *testing.T) {
+	t.Parallel()
+
+	const numKeys = 1000
+
+	index := InMemoryIndex{}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range numKeys {
+			index.UpsertVersion(keyvaluepair.KeyValuePair{
+				Key:            []byte(fmt.Sprintf("key%04d", (i*7)%numKeys)),
+				Value:          []byte(fmt.Sprintf("value%d", i)),
+				SequenceNumber: uint64(i + 1),
+			}, nil)
+		}
+	}()
+
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				var lastKey []byte
+				for kvp := range index.All() {
+					assert.Less(t, string(lastKey), string(kvp.Key))
+					lastKey = kvp.Key
+
+					result, exists := index.Lookup(kvp.Key)
+					if assert.True(t, exists) {
+						assert.GreaterOrEqual(t, result.SequenceNumber, kvp.SequenceNumber)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, slices.Collect(index.All()), numKeys)
+}
@@ -3,49 +3,156 @@ package lsm
 import (
 	"fmt"
 	"io"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"github.com/navijation/njsimple/storage/journal"
 	"github.com/navijation/njsimple/storage/keyvaluepair"
+	"github.com/navijation/njsimple/storage/sstable"
 	"github.com/navijation/njsimple/util"
 )
 
+// Type of a writeahead log entry, which is its first byte. Entries have had sequence numbers
+// since databases have had a MANIFEST, so logs of entries without them are never read: Open
+// rejects the databases they belong to with ErrUnsupportedFormatVersion.
 type journalEntryType byte
 
 const (
 	journalEntryTypeCUD journalEntryType = iota
 	journalEntryTypeCreateTable
 	journalEntryTypeMergeTables
+	journalEntryTypeWriteBatch
 )
 
 func parseJournalEntry(entry *journal.JournalEntry) (any, error) {
-	if len(entry.Content) == 0 {
-		return nil, fmt.Errorf("journal entry is empty")
+	_, content, err := splitJournalEntryTimestamp(entry.Content)
+	if err != nil {
+		return nil, err
 	}
-	entryTypeByte := journalEntryType(entry.Content[0])
+	var out any
+	entryTypeByte := journalEntryType(content[0])
 	switch entryTypeByte {
 	case journalEntryTypeCUD:
-		return util.ValueFromBytes[CUDKeyValueEntry](entry.Content)
+		out, err = util.ValueFromBytes[CUDKeyValueEntry](content)
 	case journalEntryTypeCreateTable:
-		return util.ValueFromBytes[CreateSSTableEntry](entry.Content)
+		out, err = util.ValueFromBytes[CreateSSTableEntry](content)
+	case journalEntryTypeMergeTables:
+		out, err = util.ValueFromBytes[MergeTablesEntry](content)
+	case journalEntryTypeWriteBatch:
+		out, err = util.ValueFromBytes[WriteBatchEntry](content)
+	default:
+		return nil, fmt.Errorf("unsupported entry type: %d", entryTypeByte)
+	}
+	// entries are logged whole, so one that ends early is corrupt
+	if errors.Is(err, io.EOF) {
+		return nil, errors.Wrapf(io.ErrUnexpectedEOF, "journal entry %d", entry.EntryNumber)
 	}
-	return nil, fmt.Errorf("unsupported entry type: %d", entryTypeByte)
+	return out, err
+}
+
+// timestampJournalEntry serializes an entry preceded by the time it is logged, in nanoseconds
+// since the Unix epoch, which is how every entry is written to a writeahead log.
+// ______________________________
+// | 8 bytes   | (variable)     |
+// |----------------------------|
+// | timestamp | entry          |
+// |----------------------------|
+func timestampJournalEntry(entry io.WriterTo, timestamp time.Time) []byte {
+	content, _ := util.ToBytes(entry)
+	word := util.Uint64ToWord64(uint64(timestamp.UnixNano()))
+	return append(word[:], content...)
 }
 
-// Create, update, or delete a key-value pair
+// splitJournalEntryTimestamp returns the time an entry was logged, and the entry without it.
+func splitJournalEntryTimestamp(content []byte) (timestamp time.Time, rest []byte, _ error) {
+	if len(content) < 8+1 {
+		return timestamp, nil, errors.Wrap(io.ErrUnexpectedEOF, "journal entry is truncated")
+	}
+	nanos := util.Word64(content[:8]).Uint64()
+	return time.Unix(0, int64(nanos)), content[8:], nil
+}
+
+// Create, update, or delete a key-value pair of a column family.
+// ________________________________________________________________
+// | 1 byte | 8 bytes         | (variable)     | 8 bytes          |
+// |--------------------------------------------------------------|
+// | type   | sequence number | key-value pair | column family ID |
+// |--------------------------------------------------------------|
 type CUDKeyValueEntry struct {
+	SequenceNumber     uint64
 	StoredKeyValuePair keyvaluepair.StoredKeyValuePair
+	ColumnFamilyID     uint64
 }
 
+// Create, update, or delete several key-value pairs atomically. The pairs are assigned
+// consecutive sequence numbers, starting with FirstSequenceNumber. The column family ID of each
+// pair is only logged if any pair belongs to a family other than the default one, in which case
+// num column family IDs equals num pairs; otherwise it is 0. The binary representation is as
+// follows.
+// _____________________________________________________________________________
+// | 1 byte | 8 bytes               | 8 bytes   | (variable) ... | (variable)   |
+// |---------------------------------------------------------------------------|
+// | type   | first sequence number | num pairs | key-value pair | ...          |
+// |---------------------------------------------------------------------------|
+// | 8 bytes                  | 8 bytes ...                                    |
+// |---------------------------------------------------------------------------|
+// | num column family IDs    | column family IDs                              |
+// |---------------------------------------------------------------------------|
+type WriteBatchEntry struct {
+	FirstSequenceNumber uint64
+	StoredKeyValuePairs []keyvaluepair.StoredKeyValuePair
+	// one per pair, or nil if every pair belongs to the default column family
+	ColumnFamilyIDs []uint64
+}
+
+// Flush the primary in-memory index of every listed column family, which always includes the
+// default family, and start a new writeahead log. The default family's SSTable is numbered
+// SSTableNumber, and those of the other families follow in order. The binary representation is
+// as follows.
+// _______________________________________________________________________________________
+// | 1 byte | 8 bytes        | 8 bytes           | 8 bytes      | 8 bytes ...            |
+// |-------------------------------------------------------------------------------------|
+// | type   | SSTable number | writeahead log    | num column   | column family IDs      |
+// |        |                | number            | families     |                        |
+// |-------------------------------------------------------------------------------------|
 type CreateSSTableEntry struct {
 	SSTableNumber       uint64
 	WriteAheadLogNumber uint64
+	// families flushed besides the default family
+	ColumnFamilyIDs []uint64
 
 	// in-memory only
-	index *InMemoryIndex
+	flushes []memtableFlush
+	// whether the new SSTables have replaced the flushed in-memory indexes, so that a retry only
+	// removes the obsolete writeahead logs
+	installed bool
+}
+
+// memtableFlush is an in-memory index being flushed to a new SSTable of its column family.
+type memtableFlush struct {
+	family        *ColumnFamily
+	index         *InMemoryIndex
+	sstableNumber uint64
+	// set once the SSTable has been written, so that a retry does not write it again
+	table *sstable.SSTable
+}
+
+// Merge several SSTables into a new SSTable at the given level, then delete them. The binary
+// representation is as follows.
+// ___________________________________________________________________________________
+// | 1 byte | 8 bytes        | 8 bytes | 8 bytes    | 8 bytes ... | 8 bytes          |
+// |---------------------------------------------------------------------------------|
+// | type   | SSTable number | level   | num inputs | input SSTable numbers          |
+// |---------------------------------------------------------------------------------|
+type MergeTablesEntry struct {
+	SSTableNumber       uint64
+	Level               uint64
+	InputSSTableNumbers []uint64
 }
 
 func (me *CUDKeyValueEntry) SizeOf() uint64 {
-	return me.StoredKeyValuePair.SizeOf() + 1
+	return 1 + 8 + me.StoredKeyValuePair.SizeOf() + 8
 }
 
 func (me *CUDKeyValueEntry) WriteTo(writer io.Writer) (n int64, _ error) {
@@ -55,8 +162,20 @@ func (me *CUDKeyValueEntry) WriteTo(writer io.Writer) (n int64, _ error) {
 		return n, err
 	}
 
+	dn, err = util.WriteUint64(writer, me.SequenceNumber)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
 	dn2, err := me.StoredKeyValuePair.WriteTo(writer)
 	n += int64(dn2)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64(writer, me.ColumnFamilyID)
+	n += int64(dn)
 
 	return n, err
 }
@@ -69,14 +188,25 @@ func (me *CUDKeyValueEntry) ReadFrom(reader io.Reader) (n int64, _ error) {
 		return n, err
 	}
 
+	me.SequenceNumber, dn, err = util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
 	dn2, err := me.StoredKeyValuePair.ReadFrom(reader)
 	n += int64(dn2)
+	if err != nil {
+		return n, err
+	}
 
+	me.ColumnFamilyID, dn, err = util.ReadUint64(reader)
+	n += int64(dn)
 	return n, err
 }
 
 func (me *CreateSSTableEntry) SizeOf() uint64 {
-	return 1 + 8
+	return 1 + 8 + 8 + 8 + 8*uint64(len(me.ColumnFamilyIDs))
 }
 
 func (me *CreateSSTableEntry) ReadFrom(reader io.Reader) (n int64, _ error) {
@@ -95,8 +225,28 @@ func (me *CreateSSTableEntry) ReadFrom(reader io.Reader) (n int64, _ error) {
 
 	me.WriteAheadLogNumber, dn, err = util.ReadUint64(reader)
 	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
 
-	return n, err
+	me.ColumnFamilyIDs = nil
+	numFamilies, dn, err := util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for range numFamilies {
+		var id uint64
+		dn, err = util.ReadUint64s(reader, &id)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+		me.ColumnFamilyIDs = append(me.ColumnFamilyIDs, id)
+	}
+
+	return n, nil
 }
 
 func (me *CreateSSTableEntry) WriteTo(writer io.Writer) (n int64, _ error) {
@@ -112,8 +262,182 @@ func (me *CreateSSTableEntry) WriteTo(writer io.Writer) (n int64, _ error) {
 		return n, err
 	}
 
-	dn, err = util.WriteUint64(writer, me.WriteAheadLogNumber)
+	dn, err = util.WriteUint64s(writer, me.WriteAheadLogNumber, uint64(len(me.ColumnFamilyIDs)))
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(writer, me.ColumnFamilyIDs...)
+	n += int64(dn)
+
+	return n, err
+}
+
+// Return the logged key-value pair, versioned with the entry's sequence number.
+func (me *CUDKeyValueEntry) ToKeyValuePair() keyvaluepair.KeyValuePair {
+	kvp := me.StoredKeyValuePair.ToKeyValuePair()
+	kvp.SequenceNumber = me.SequenceNumber
+	return kvp
+}
+
+func (me *WriteBatchEntry) SizeOf() uint64 {
+	size := uint64(1 + 8 + 8)
+	for _, storedKVP := range me.StoredKeyValuePairs {
+		size += storedKVP.SizeOf()
+	}
+	return size + 8 + 8*uint64(len(me.ColumnFamilyIDs))
+}
+
+func (me *WriteBatchEntry) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := writer.Write([]byte{byte(journalEntryTypeWriteBatch)})
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(
+		writer, me.FirstSequenceNumber, uint64(len(me.StoredKeyValuePairs)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, storedKVP := range me.StoredKeyValuePairs {
+		dn2, err := storedKVP.WriteTo(writer)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+	}
+
+	dn, err = util.WriteUint64s(
+		writer, append([]uint64{uint64(len(me.ColumnFamilyIDs))}, me.ColumnFamilyIDs...)...,
+	)
 	n += int64(dn)
 
 	return n, err
 }
+
+func (me *WriteBatchEntry) ReadFrom(reader io.Reader) (n int64, _ error) {
+	var byteBuf [1]byte
+	dn, err := reader.Read(byteBuf[:])
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	var numPairs uint64
+	dn, err = util.ReadUint64s(reader, &me.FirstSequenceNumber, &numPairs)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	me.StoredKeyValuePairs = nil
+	for range numPairs {
+		var storedKVP keyvaluepair.StoredKeyValuePair
+		dn2, err := storedKVP.ReadFrom(reader)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+		me.StoredKeyValuePairs = append(me.StoredKeyValuePairs, storedKVP)
+	}
+
+	me.ColumnFamilyIDs = nil
+	numFamilyIDs, dn, err := util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+	if numFamilyIDs != 0 && numFamilyIDs != numPairs {
+		return n, fmt.Errorf(
+			"write batch of %d pairs has %d column family IDs", numPairs, numFamilyIDs,
+		)
+	}
+	for range numFamilyIDs {
+		id, dn, err := util.ReadUint64(reader)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+		me.ColumnFamilyIDs = append(me.ColumnFamilyIDs, id)
+	}
+
+	return n, nil
+}
+
+// Return the column family ID of the i-th logged key-value pair.
+func (me *WriteBatchEntry) ColumnFamilyID(i int) uint64 {
+	if me.ColumnFamilyIDs == nil {
+		return 0
+	}
+	return me.ColumnFamilyIDs[i]
+}
+
+// Return the logged key-value pairs, versioned with consecutive sequence numbers.
+func (me *WriteBatchEntry) ToKeyValuePairs() []keyvaluepair.KeyValuePair {
+	out := make([]keyvaluepair.KeyValuePair, len(me.StoredKeyValuePairs))
+	for i, storedKVP := range me.StoredKeyValuePairs {
+		out[i] = storedKVP.ToKeyValuePair()
+		out[i].SequenceNumber = me.FirstSequenceNumber + uint64(i)
+	}
+	return out
+}
+
+func (me *MergeTablesEntry) SizeOf() uint64 {
+	return 1 + 8 + 8 + 8 + 8*uint64(len(me.InputSSTableNumbers))
+}
+
+func (me *MergeTablesEntry) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := writer.Write([]byte{byte(journalEntryTypeMergeTables)})
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(
+		writer, me.SSTableNumber, me.Level, uint64(len(me.InputSSTableNumbers)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(writer, me.InputSSTableNumbers...)
+	n += int64(dn)
+
+	return n, err
+}
+
+func (me *MergeTablesEntry) ReadFrom(reader io.Reader) (n int64, _ error) {
+	var byteBuf [1]byte
+	dn, err := reader.Read(byteBuf[:])
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	var numInputs uint64
+	dn, err = util.ReadUint64s(reader, &me.SSTableNumber, &me.Level, &numInputs)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	// the count is not trusted to size an allocation, since a corrupt one would be huge
+	me.InputSSTableNumbers = nil
+	for range numInputs {
+		var number uint64
+		dn, err = util.ReadUint64s(reader, &number)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+		me.InputSSTableNumbers = append(me.InputSSTableNumbers, number)
+	}
+
+	return n, nil
+}
@@ -2,11 +2,15 @@ package lsm
 
 import (
 	"bytes"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/navijation/njsimple/storage/journal"
 	"github.com/navijation/njsimple/storage/keyvaluepair"
+	"github.com/navijation/njsimple/util"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCUDKeyValueEntry_Serialization(t *testing.T) {
@@ -19,12 +23,15 @@ func TestCUDKeyValueEntry_Serialization(t *testing.T) {
 		}).ToStoredKeyValuePair()
 
 		entry := CUDKeyValueEntry{
+			SequenceNumber:     42,
 			StoredKeyValuePair: storedKVP,
+			ColumnFamilyID:     3,
 		}
 
 		var buf bytes.Buffer
-		_, err := entry.WriteTo(&buf)
+		n, err := entry.WriteTo(&buf)
 		assert.NoError(t, err)
+		assert.EqualValues(t, entry.SizeOf(), n)
 
 		var deserializedEntry CUDKeyValueEntry
 		_, err = deserializedEntry.ReadFrom(&buf)
@@ -33,6 +40,28 @@ func TestCUDKeyValueEntry_Serialization(t *testing.T) {
 		assert.Equal(t, entry, deserializedEntry)
 	})
 
+	t.Run("truncated before column family", func(t *testing.T) {
+		storedKVP := (&KeyValuePair{
+			Key:   []byte("key1"),
+			Value: []byte("value1"),
+		}).ToStoredKeyValuePair()
+
+		entry := CUDKeyValueEntry{
+			SequenceNumber:     42,
+			StoredKeyValuePair: storedKVP,
+			ColumnFamilyID:     3,
+		}
+
+		var buf bytes.Buffer
+		_, err := entry.WriteTo(&buf)
+		assert.NoError(t, err)
+		buf.Truncate(buf.Len() - 8)
+
+		content := timestampJournalEntry(&buf, time.Now())
+		_, err = parseJournalEntry(&journal.JournalEntry{Content: content})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
 	t.Run("deleted", func(t *testing.T) {
 		storedKVP := (&KeyValuePair{
 			Key: []byte("key1"),
@@ -61,12 +90,15 @@ func TestCreateSSTableEntry_Serialization(t *testing.T) {
 
 	tableNumber := uint64(12345)
 	entry := CreateSSTableEntry{
-		SSTableNumber: tableNumber,
+		SSTableNumber:       tableNumber,
+		WriteAheadLogNumber: 6,
+		ColumnFamilyIDs:     []uint64{2, 5},
 	}
 
 	var buf bytes.Buffer
-	_, err := entry.WriteTo(&buf)
+	n, err := entry.WriteTo(&buf)
 	assert.NoError(t, err)
+	assert.EqualValues(t, entry.SizeOf(), n)
 
 	var deserializedEntry CreateSSTableEntry
 	_, err = deserializedEntry.ReadFrom(&buf)
@@ -75,6 +107,97 @@ func TestCreateSSTableEntry_Serialization(t *testing.T) {
 	assert.Equal(t, entry, deserializedEntry)
 }
 
+func TestWriteBatchEntry_Serialization(t *testing.T) {
+	t.Parallel()
+
+	deletedKVP := (&KeyValuePair{Key: []byte("key2")}).ToStoredKeyValuePair()
+	deletedKVP.SetIsDeleted(true)
+
+	entry := WriteBatchEntry{
+		FirstSequenceNumber: 7,
+		StoredKeyValuePairs: []keyvaluepair.StoredKeyValuePair{
+			(&KeyValuePair{Key: []byte("key1"), Value: []byte("value1")}).ToStoredKeyValuePair(),
+			deletedKVP,
+		},
+	}
+
+	var buf bytes.Buffer
+	n, err := entry.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, entry.SizeOf(), n)
+
+	var deserializedEntry WriteBatchEntry
+	_, err = deserializedEntry.ReadFrom(&buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, entry, deserializedEntry)
+	assert.Equal(t, []KeyValuePair{
+		{Key: []byte("key1"), Value: []byte("value1"), SequenceNumber: 7},
+		{Key: []byte("key2"), IsDeleted: true, SequenceNumber: 8},
+	}, deserializedEntry.ToKeyValuePairs())
+	assert.Zero(t, deserializedEntry.ColumnFamilyID(1))
+
+	t.Run("column families", func(t *testing.T) {
+		entry.ColumnFamilyIDs = []uint64{0, 4}
+
+		var buf bytes.Buffer
+		n, err := entry.WriteTo(&buf)
+		assert.NoError(t, err)
+		assert.EqualValues(t, entry.SizeOf(), n)
+
+		var deserializedEntry WriteBatchEntry
+		_, err = deserializedEntry.ReadFrom(&buf)
+		assert.NoError(t, err)
+
+		assert.Equal(t, entry, deserializedEntry)
+		assert.EqualValues(t, 4, deserializedEntry.ColumnFamilyID(1))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		entry.ColumnFamilyIDs = nil
+
+		var buf bytes.Buffer
+		_, err := entry.WriteTo(&buf)
+		assert.NoError(t, err)
+		buf.Truncate(buf.Len() - 8)
+
+		content := timestampJournalEntry(&buf, time.Now())
+		_, err = parseJournalEntry(&journal.JournalEntry{Content: content})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestMergeTablesEntry_Serialization(t *testing.T) {
+	t.Parallel()
+
+	entry := MergeTablesEntry{
+		SSTableNumber:       12,
+		Level:               2,
+		InputSSTableNumbers: []uint64{9, 7, 3},
+	}
+
+	var buf bytes.Buffer
+	n, err := entry.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, entry.SizeOf(), n)
+
+	var deserializedEntry MergeTablesEntry
+	_, err = deserializedEntry.ReadFrom(&buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, entry, deserializedEntry)
+
+	t.Run("corrupt number of inputs", func(t *testing.T) {
+		buf := bytes.NewBuffer([]byte{byte(journalEntryTypeMergeTables)})
+		_, err := util.WriteUint64s(buf, 12, 2, 1<<60, 9)
+		require.NoError(t, err)
+
+		content := timestampJournalEntry(buf, time.Now())
+		_, err = parseJournalEntry(&journal.JournalEntry{Content: content})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
 func TestParseJournalEntry(t *testing.T) {
 	t.Parallel()
 
@@ -86,19 +209,47 @@ func TestParseJournalEntry(t *testing.T) {
 
 		cudEntry := CUDKeyValueEntry{StoredKeyValuePair: storedKVP}
 
-		// Serialize CUD entry
-		var cudBuf bytes.Buffer
-		_, err := cudEntry.WriteTo(&cudBuf)
+		journalEntry := &journal.JournalEntry{Content: timestampJournalEntry(&cudEntry, time.Now())}
+		_, err := parseJournalEntry(journalEntry)
 		assert.NoError(t, err)
+	})
 
-		journalEntry := &journal.JournalEntry{Content: cudBuf.Bytes()}
-		_, err = parseJournalEntry(journalEntry)
+	t.Run("write batch entry", func(t *testing.T) {
+		batchEntry := WriteBatchEntry{
+			FirstSequenceNumber: 1,
+			StoredKeyValuePairs: []keyvaluepair.StoredKeyValuePair{
+				(&KeyValuePair{Key: []byte("key1"), Value: []byte("value1")}).ToStoredKeyValuePair(),
+			},
+		}
+
+		journalEntry := &journal.JournalEntry{
+			Content: timestampJournalEntry(&batchEntry, time.Now()),
+		}
+		parsed, err := parseJournalEntry(journalEntry)
 		assert.NoError(t, err)
+		assert.Equal(t, batchEntry, parsed)
+	})
+
+	t.Run("timestamped entry", func(t *testing.T) {
+		entry := MergeTablesEntry{SSTableNumber: 3, InputSSTableNumbers: []uint64{1, 2}}
+		loggedAt := time.Unix(1_700_000_000, 5)
+
+		content := timestampJournalEntry(&entry, loggedAt)
+		parsed, err := parseJournalEntry(&journal.JournalEntry{Content: content})
+		_ = assert.NoError(t, err) && assert.Equal(t, entry, parsed)
+
+		timestamp, _, err := splitJournalEntryTimestamp(content)
+		_ = assert.NoError(t, err) && assert.True(t, loggedAt.Equal(timestamp))
+
+		_, err = parseJournalEntry(&journal.JournalEntry{Content: content[:5]})
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
 	})
 
 	t.Run("Unsupported", func(t *testing.T) {
 		// Test unsupported entry type
-		unsupportedEntry := &journal.JournalEntry{Content: []byte{0xFF}}
+		unsupportedEntry := &journal.JournalEntry{
+			Content: timestampJournalEntry(bytes.NewBuffer([]byte{0xFF}), time.Now()),
+		}
 		_, err := parseJournalEntry(unsupportedEntry)
 		assert.Error(t, err)
 	})
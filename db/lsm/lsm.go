@@ -1,6 +1,8 @@
 package lsm
 
 import (
+	"fmt"
+	"iter"
 	"log"
 	"os"
 	"path/filepath"
@@ -8,52 +10,162 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/navijation/njsimple/storage/journal"
 	"github.com/navijation/njsimple/storage/keyvaluepair"
 	"github.com/navijation/njsimple/storage/sstable"
 	"github.com/navijation/njsimple/util"
+	"github.com/pkg/errors"
 )
 
 type LSMDB struct {
 	// immutable config
-	path           string
-	indexChunkSize util.Optional[uint64]
+	path              string
+	indexChunkSize    util.Optional[uint64]
+	writeAheadLogSync journal.SyncPolicy
+	// where retired writeahead logs are moved, or "" to delete them
+	writeAheadLogArchiveDir string
+	clock                   func() time.Time
+	// shared by all SSTables
+	blockCache          *sstable.BlockCache
+	maxImmutableIndexes int
+	// counters and histograms reported by Stats
+	stats  *dbStats
+	events *eventQueue
 
 	// state tracking
-	writeAheadLogs          []*journal.JournalFile
-	sstables                []*sstable.SSTable
-	inMemoryIndexes         []*InMemoryIndex
+	writeAheadLogs []*journal.JournalFile
+	manifest       manifest
+	// column families by ID, including the default column family with ID 0
+	families                map[uint64]*ColumnFamily
+	defaultFamily           *ColumnFamily
 	nextSSTableNumber       uint64
 	nextWriteAheadLogNumber uint64
-	stateErr                error
-	isRunning               atomic.Bool
+	lastSequenceNumber      uint64
+	snapshots               map[*Snapshot]struct{}
+	// merges waiting for the compactor, and the SSTables they will consume
+	pendingMerges      []MergeTablesEntry
+	compactingSSTables map[uint64]struct{}
+	// guards sstableRefs and readPins while only the read lock is held; the write lock alone is
+	// enough to access them
+	pinLock sync.Mutex
+	// number of readers using each SSTable outside the lock; SSTables replaced by a merge are
+	// only deleted once they are no longer in use
+	sstableRefs map[*sstable.SSTable]int
+	// number of scans and cursors reading the versions visible at each sequence number, which
+	// are preserved like those of a snapshot
+	readPins         map[uint64]int
+	obsoleteSSTables map[*sstable.SSTable]*ColumnFamily
+	stateErr         error
+	isRunning        atomic.Bool
 
 	// concurrency control
 	done           chan struct{}
 	asyncEntryChan chan any
 	wg             sync.WaitGroup
 	lock           sync.RWMutex
+	// signalled whenever an in-memory index has been flushed to an SSTable
+	flushed *sync.Cond
+	// signalled whenever SSTables stop being compacted
+	compacted *sync.Cond
+	// set while a write group leader appends to the writeahead log without holding the lock;
+	// logWritten is signalled once it is done
+	isWritingLog bool
+	logWritten   *sync.Cond
+	// queue of writers waiting to be committed in groups, guarded by writersLock rather than the
+	// lock so that writers can queue up while a group is being written
+	writers       []*pendingWrite
+	writersLock   sync.Mutex
+	writersQueued *sync.Cond
+	// wakes up the compactor
+	compactionSignal chan struct{}
 }
 
 type OpenArgs struct {
 	Path           string
 	Create         bool
 	IndexChunkSize util.Optional[uint64]
+	// Bits per key of the bloom filters of new SSTables; defaults to 10, and 0 omits the filters.
+	BloomFilterBitsPerKey util.Optional[uint64]
+	// When writes are synced to the writeahead log; defaults to syncing every write before it is
+	// acknowledged. Call SyncWAL to sync all earlier writes regardless.
+	WriteAheadLogSync journal.SyncPolicy
+	// Directory that writeahead logs are moved to once their writes are all in SSTables, rather
+	// than being deleted, for RecoverToPointInTime to replay. It is created if it does not exist,
+	// and must be on the same file system as the database.
+	WriteAheadLogArchiveDir util.Optional[string]
+	// Total size in bytes of the SSTable blocks cached in memory; defaults to 8 MiB.
+	BlockCacheSize util.Optional[uint64]
+	// Flush the primary in-memory index to a new SSTable once it or the current writeahead log
+	// reaches this many bytes. If unset, SSTables are only created by calling CreateSSTable.
+	WriteBufferSize util.Optional[uint64]
+	// Maximum number of in-memory indexes waiting to be flushed before writers stall.
+	MaxImmutableIndexes util.Optional[int]
+	// Merge runs of similarly sized SSTables in the background. If unset, SSTables are never
+	// merged.
+	SizeTieredCompaction util.Optional[SizeTieredCompactionArgs]
+	// Merge SSTables into levels of non-overlapping SSTables in the background. At most one
+	// compaction strategy may be set.
+	LeveledCompaction util.Optional[LeveledCompactionArgs]
+	// Source of the current time, against which keys written with a TTL expire; defaults to
+	// time.Now.
+	Clock util.Optional[func() time.Time]
+	// Operator that merges the operands written by Merge. Once a database is opened with a merge
+	// operator, it can only be reopened with an operator of the same name.
+	MergeOperator util.Optional[MergeOperator]
+	// Order of keys; defaults to sstable.BytewiseComparator. Its name is stored in every SSTable,
+	// so a database can only be reopened with a comparator of the same name.
+	Comparator util.Optional[Comparator]
+	// Notified of flushes, merges and other background work.
+	EventListener util.Optional[EventListener]
+	// Options of existing column families by name; column families without options use the
+	// defaults. The options of the default column family are set by the fields above.
+	ColumnFamilies map[string]ColumnFamilyOptions
 }
 
+const (
+	defaultMaxImmutableIndexes = 2
+	defaultBlockCacheSize      = 8 << 20
+	maxAsyncEntries            = 5
+
+	// delays between attempts at creating an SSTable, which double after each failed attempt
+	minFlushRetryDelay = 10 * time.Millisecond
+	maxFlushRetryDelay = 10 * time.Second
+)
+
 func Open(args OpenArgs) (out *LSMDB, err error) {
 	var (
 		writeAheadLogs []*journal.JournalFile
 		sstables       []*sstable.SSTable
-		maxSSTableNum  uint64
-		maxJournalNum  uint64
+		familyTables   = map[uint64][]*sstable.SSTable{}
+		manifestFile   manifest
+		maxSequenceNum uint64
+		blockCache     = sstable.NewBlockCache(args.BlockCacheSize.Or(defaultBlockCacheSize))
+		stats          = newDBStats()
+		defaultOptions = ColumnFamilyOptions{
+			BloomFilterBitsPerKey: args.BloomFilterBitsPerKey,
+			WriteBufferSize:       args.WriteBufferSize,
+			SizeTieredCompaction:  args.SizeTieredCompaction,
+			LeveledCompaction:     args.LeveledCompaction,
+			MergeOperator:         args.MergeOperator,
+			Comparator:            args.Comparator,
+		}
 	)
 
 	out = &LSMDB{
 		path: args.Path,
 	}
 
+	if err := defaultOptions.validate(); err != nil {
+		return out, err
+	}
+	for name, options := range args.ColumnFamilies {
+		if err := options.validate(); err != nil {
+			return out, fmt.Errorf("column family %q: %w", name, err)
+		}
+	}
+
 	defer func() {
 		if err != nil {
 			for _, sstable := range sstables {
@@ -62,6 +174,7 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 			for _, journal := range writeAheadLogs {
 				_ = journal.Close()
 			}
+			_ = manifestFile.Close()
 			if args.Create {
 				_ = os.RemoveAll(args.Path)
 			}
@@ -83,6 +196,9 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 			_ = tmpJournal.Close()
 		}
 	} else {
+		if err := checkFormatVersion(args.Path); err != nil {
+			return out, err
+		}
 		// cleanup existing tmp directory
 		_ = os.RemoveAll(filepath.Join(args.Path, "tmp"))
 
@@ -93,6 +209,81 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 		return out, err
 	}
 
+	archiveDir := args.WriteAheadLogArchiveDir.Or("")
+	if archiveDir != "" {
+		if err := os.MkdirAll(archiveDir, 0o755); err != nil {
+			return out, errors.WithStack(err)
+		}
+	}
+
+	// Rewrite the MANIFEST as a single edit, so that it does not grow forever
+	edit := VersionEdit{
+		WriteAheadLogNumber:     1,
+		NextSSTableNumber:       1,
+		NextWriteAheadLogNumber: 2,
+	}
+	if !args.Create {
+		existingManifest, err := readManifest(args.Path)
+		if err != nil {
+			return out, err
+		}
+		edit = existingManifest.snapshot()
+	}
+	// the default column family always has ID 0
+	edit.NextColumnFamilyID = max(edit.NextColumnFamilyID, 1)
+
+	// operands cannot be read back without the operator they were written for
+	if edit.MergeOperatorName, err = defaultOptions.mergeOperatorName(
+		defaultColumnFamilyName, edit.MergeOperatorName,
+	); err != nil {
+		return out, err
+	}
+	for i, metadata := range edit.AddedColumnFamilies {
+		options := args.ColumnFamilies[metadata.Name]
+		if edit.AddedColumnFamilies[i].MergeOperatorName, err = options.mergeOperatorName(
+			metadata.Name, metadata.MergeOperatorName,
+		); err != nil {
+			return out, err
+		}
+	}
+	if manifestFile, err = createManifest(args.Path, edit); err != nil {
+		return out, err
+	}
+
+	// a column family's directory is missing if the database crashed right after creating it
+	for id := range manifestFile.columnFamilies {
+		if err := os.MkdirAll(columnFamilyDir(args.Path, id), 0o755); err != nil {
+			return out, errors.WithStack(err)
+		}
+	}
+
+	openSSTable := func(familyID uint64, dirName, baseName string) error {
+		filename := filepath.Join(dirName, baseName)
+		if sstableNum, ok := getFileNumber(baseName, "sstable_", ".sst"); !ok {
+			log.Printf("Unexpected SSTable file %q\n", filename)
+			return nil
+		} else if !manifestFile.hasSSTable(sstableNum) {
+			return removeOrphanedFile(filename)
+		}
+		options := defaultOptions
+		if familyID != 0 {
+			options = args.ColumnFamilies[manifestFile.columnFamilies[familyID].Name]
+		}
+		sstableFile, err := sstable.Open(sstable.OpenArgs{
+			Path:           filename,
+			IndexChunkSize: args.IndexChunkSize,
+			BlockCache:     blockCache,
+			Comparator:     options.Comparator,
+		})
+		if err != nil {
+			return err
+		}
+		sstables = append(sstables, &sstableFile)
+		familyTables[familyID] = append(familyTables[familyID], &sstableFile)
+		maxSequenceNum = max(maxSequenceNum, sstableFile.MaxSequenceNumber())
+		return nil
+	}
+
 	directoryEntries, err := os.ReadDir(args.Path)
 	if err != nil {
 		return out, err
@@ -102,37 +293,61 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 		baseName := dirent.Name()
 		filename := filepath.Join(args.Path, baseName)
 		switch {
-		case baseName == "tmp":
+		case baseName == "tmp" || baseName == manifestFileName:
 			continue
 
 		case dirent.IsDir():
-			log.Printf("Unexpected DB directory %q\n", baseName)
-
-		case strings.HasSuffix(baseName, ".sst"):
-			if sstableNum, ok := getFileNumber(baseName, "sstable_", ".sst"); !ok {
-				log.Printf("Unexpected SSTable file %q\n", baseName)
+			familyID, ok := getFileNumber(baseName, "column_family_", "")
+			if !ok {
+				log.Printf("Unexpected DB directory %q\n", baseName)
 				continue
-			} else {
-				maxSSTableNum = max(maxSSTableNum, sstableNum)
 			}
-			sstableFile, err := sstable.Open(sstable.OpenArgs{
-				Path:           filename,
-				IndexChunkSize: args.IndexChunkSize,
-			})
+			if _, ok := manifestFile.columnFamilies[familyID]; !ok {
+				// left behind by a dropped column family
+				if err := os.RemoveAll(filename); err != nil {
+					return out, errors.WithStack(err)
+				}
+				continue
+			}
+			familyEntries, err := os.ReadDir(filename)
 			if err != nil {
+				return out, errors.WithStack(err)
+			}
+			for _, familyDirent := range familyEntries {
+				if !strings.HasSuffix(familyDirent.Name(), ".sst") {
+					log.Printf("Unexpected DB file %q\n", familyDirent.Name())
+					continue
+				}
+				if err := openSSTable(familyID, filename, familyDirent.Name()); err != nil {
+					return out, err
+				}
+			}
+
+		case strings.HasSuffix(baseName, ".sst"):
+			if err := openSSTable(0, args.Path, baseName); err != nil {
 				return out, err
 			}
-			sstables = append(sstables, &sstableFile)
 
 		case strings.HasSuffix(baseName, ".jrn"):
 			if journalNum, ok := getFileNumber(baseName, "writeahead_log_", ".jrn"); !ok {
 				log.Printf("Unexpected journal file %q\n", baseName)
 				continue
-			} else {
-				maxJournalNum = max(maxJournalNum, journalNum)
+			} else if journalNum < manifestFile.writeAheadLogNumber && archiveDir != "" {
+				// the database crashed before archiving the log
+				if err := archiveWriteAheadLog(archiveDir, filename); err != nil {
+					return out, err
+				}
+				continue
+			} else if !manifestFile.isLiveWriteAheadLog(journalNum) {
+				if err := removeOrphanedFile(filename); err != nil {
+					return out, err
+				}
+				continue
 			}
 			journalFile, err := journal.Open(journal.OpenArgs{
-				Path: filename,
+				Path:       filename,
+				SyncPolicy: args.WriteAheadLogSync,
+				OnSync:     util.Some(stats.observeWriteAheadLogSync),
 			})
 			if err != nil {
 				return out, err
@@ -144,12 +359,15 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 		}
 	}
 
-	slices.SortFunc(sstables, func(a, b *sstable.SSTable) int {
-		number1, _ := getFileNumber(a.Path(), "sstable_", ".sst")
-		number2, _ := getFileNumber(b.Path(), "sstable_", ".sst")
-		// sort latest first
-		return -(int(number1) - int(number2))
-	})
+	if len(sstables) != len(manifestFile.sstables) {
+		for number := range manifestFile.sstables {
+			if !slices.ContainsFunc(sstables, func(table *sstable.SSTable) bool {
+				return sstableNumber(table) == number
+			}) {
+				return out, fmt.Errorf("SSTable %d listed in %s does not exist", number, manifestFileName)
+			}
+		}
+	}
 
 	slices.SortFunc(writeAheadLogs, func(a, b *journal.JournalFile) int {
 		number1, _ := getFileNumber(a.Path(), "writeahead_log_", ".jrn")
@@ -159,32 +377,74 @@ func Open(args OpenArgs) (out *LSMDB, err error) {
 	})
 
 	out = &LSMDB{
-		path:           args.Path,
-		indexChunkSize: args.IndexChunkSize,
-
-		writeAheadLogs: writeAheadLogs,
-		sstables:       sstables,
-		// single empty in-memory index
-		inMemoryIndexes:         []*InMemoryIndex{{}},
-		nextSSTableNumber:       maxSSTableNum + 1,
-		nextWriteAheadLogNumber: maxJournalNum + 1,
+		path:                    args.Path,
+		indexChunkSize:          args.IndexChunkSize,
+		writeAheadLogSync:       args.WriteAheadLogSync,
+		writeAheadLogArchiveDir: archiveDir,
+		clock:                   args.Clock.Or(time.Now),
+		blockCache:              blockCache,
+		stats:                   stats,
+		events:                  newEventQueue(args.EventListener.Or(nil)),
+		// every immutable index is queued for the async worker, so there cannot be more of them
+		// than the queue holds without blocking
+		maxImmutableIndexes: min(
+			max(args.MaxImmutableIndexes.Or(defaultMaxImmutableIndexes), 1), maxAsyncEntries,
+		),
+
+		writeAheadLogs:          writeAheadLogs,
+		manifest:                manifestFile,
+		families:                map[uint64]*ColumnFamily{},
+		nextSSTableNumber:       manifestFile.nextSSTableNumber,
+		nextWriteAheadLogNumber: manifestFile.nextWriteAheadLogNumber,
+		// bumped further as writeahead logs are replayed
+		lastSequenceNumber: maxSequenceNum,
+		snapshots:          map[*Snapshot]struct{}{},
+		compactingSSTables: map[uint64]struct{}{},
+		sstableRefs:        map[*sstable.SSTable]int{},
+		readPins:           map[uint64]int{},
+		obsoleteSSTables:   map[*sstable.SSTable]*ColumnFamily{},
 
 		// block if >5 async requests have yet to be satisfied
-		asyncEntryChan: make(chan any, 5),
-		done:           make(chan struct{}),
+		asyncEntryChan:   make(chan any, maxAsyncEntries),
+		done:             make(chan struct{}),
+		compactionSignal: make(chan struct{}, 1),
+	}
+	out.flushed = sync.NewCond(&out.lock)
+	out.compacted = sync.NewCond(&out.lock)
+	out.logWritten = sync.NewCond(&out.lock)
+	out.writersQueued = sync.NewCond(&out.writersLock)
+
+	out.defaultFamily = newColumnFamily(out, 0, defaultColumnFamilyName, defaultOptions)
+	out.families[0] = out.defaultFamily
+	for id, metadata := range manifestFile.columnFamilies {
+		out.families[id] = newColumnFamily(
+			out, id, metadata.Name, args.ColumnFamilies[metadata.Name],
+		)
+	}
+	for id, family := range out.families {
+		family.sstables = familyTables[id]
+		sortSSTables(family.comparator, family.sstables)
 	}
 
 	return out, nil
 }
 
 func (me *LSMDB) Start() error {
+	me.events.start()
 	me.runAsyncWorker()
-	return me.processWriteAheadLogs(&dbCtx{})
+	if err := me.processWriteAheadLogs(&dbCtx{}); err != nil {
+		return err
+	}
+	me.scheduleCompaction()
+	return nil
 }
 
 func (me *LSMDB) Close() error {
 	ctx := &dbCtx{}
 
+	// listeners may be waiting on the lock, so events are only drained once it is released
+	defer me.events.stop()
+
 	if me.isRunning.Load() {
 		close(me.done)
 		me.wg.Wait()
@@ -193,50 +453,191 @@ func (me *LSMDB) Close() error {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
+	// wake up writers stalled on flushes that will never happen, and column families being dropped
+	me.flushed.Broadcast()
+	me.compacted.Broadcast()
+	me.waitForLogWriter(ctx)
+
 	for _, log := range me.writeAheadLogs {
 		_ = log.Close()
 	}
 
-	for _, sstable := range me.sstables {
+	for _, family := range me.families {
+		for _, sstable := range family.sstables {
+			_ = sstable.Close()
+		}
+	}
+	for sstable := range me.obsoleteSSTables {
 		_ = sstable.Close()
 	}
+	_ = me.manifest.Close()
 
 	return nil
 }
 
-func (me *LSMDB) Lookup(key []byte) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
-	me.lock.RLock()
-	defer me.lock.RUnlock()
+// SyncWAL syncs every acknowledged write to disk, whatever the sync policy of the writeahead logs.
+func (me *LSMDB) SyncWAL() error {
+	ctx := &dbCtx{}
+	if err := me.checkStateError(ctx); err != nil {
+		return err
+	}
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
 
-	for _, memoryIndex := range me.inMemoryIndexes {
-		kvp, exists := memoryIndex.Lookup(key)
-		if exists {
-			return kvp, true, nil
+	// the write group being appended has not been acknowledged yet, but may as well be synced too
+	me.waitForLogWriter(ctx)
+
+	for _, writeAheadLog := range me.writeAheadLogs {
+		if err := writeAheadLog.Sync(); err != nil {
+			return errors.WithStack(err)
 		}
 	}
+	return nil
+}
+
+// Return the hit and miss counts of the block cache shared by all SSTables.
+func (me *LSMDB) BlockCacheStats() sstable.BlockCacheStats {
+	return me.blockCache.Stats()
+}
+
+func (me *LSMDB) Lookup(key []byte) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	return me.defaultFamily.LookupAt(key, nil)
+}
+
+// Lookup the version of a key visible to the given snapshot. A nil snapshot reads the latest
+// version.
+func (me *LSMDB) LookupAt(
+	key []byte, snapshot *Snapshot,
+) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	return me.defaultFamily.LookupAt(key, snapshot)
+}
+
+func (me *ColumnFamily) Lookup(key []byte) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	return me.LookupAt(key, nil)
+}
+
+// Lookup the version of a key in the column family visible to the given snapshot. A nil snapshot
+// reads the latest version.
+func (me *ColumnFamily) LookupAt(
+	key []byte, snapshot *Snapshot,
+) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	me.db.lock.RLock()
+	defer me.db.lock.RUnlock()
+
+	if err := me.db.checkColumnFamily(me); err != nil {
+		return out, false, err
+	}
+	sequenceNumber, err := me.db.readSequenceNumber(snapshot)
+	if err != nil {
+		return out, false, err
+	}
+
+	return me.db.lookup(me, key, sequenceNumber)
+}
+
+// lookup returns the newest version of a key in a column family with a sequence number of at most
+// the given sequence number, with any merge operands on top of it merged into it. The caller must
+// hold the lock.
+func (me *LSMDB) lookup(
+	family *ColumnFamily, key []byte, sequenceNumber uint64,
+) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	var (
+		operands       []KeyValuePair
+		sstablesProbed int
+	)
+	defer func() {
+		me.stats.lookupSSTablesProbed.observe(float64(sstablesProbed))
+	}()
 
-	for _, sstable := range me.sstables {
-		entry, exists, err := sstable.LookupEntry(key)
+	for version, err := range me.versionsAt(family, key, sequenceNumber, &sstablesProbed) {
 		if err != nil {
 			return out, false, err
 		}
-		if exists {
-			return keyvaluepair.KeyValuePair{
-				Key:       key,
-				Value:     entry.Value,
-				IsDeleted: entry.IsDeleted,
-			}, true, nil
+		version = me.expire(version)
+
+		if version.IsMergeOperand && family.mergeOperator != nil {
+			operands = append(operands, version)
+			continue
 		}
+		if len(operands) == 0 {
+			return version, true, nil
+		}
+		out, err := sstable.FullMerge(family.mergeOperator, operands, &version)
+		return out, err == nil, err
 	}
 
+	if len(operands) > 0 {
+		out, err := sstable.FullMerge(family.mergeOperator, operands, nil)
+		return out, err == nil, err
+	}
 	return out, false, nil
 }
 
-func (me *LSMDB) processWriteAheadLogs(ctx *dbCtx) error {
-	for i := range me.writeAheadLogs {
-		// process oldest logs first
+// versionsAt returns an iterator over the versions of a key in a column family with a sequence
+// number of at most the given sequence number, newest first, counting the SSTables it probes in
+// sstablesProbed. The caller must hold the lock.
+func (me *LSMDB) versionsAt(
+	family *ColumnFamily, key []byte, sequenceNumber uint64, sstablesProbed *int,
+) iter.Seq2[KeyValuePair, error] {
+	return func(yield func(KeyValuePair, error) bool) {
+		// a version may be in both a memtable and the SSTable it is being flushed to
+		var (
+			lastSequenceNumber    uint64
+			lastSequenceNumberSet bool
+		)
+		yieldVersion := func(version KeyValuePair) bool {
+			if lastSequenceNumberSet && version.SequenceNumber >= lastSequenceNumber {
+				return true
+			}
+			lastSequenceNumber = version.SequenceNumber
+			lastSequenceNumberSet = true
+			return yield(version, nil)
+		}
+
+		for _, memoryIndex := range family.inMemoryIndexes {
+			for version := range memoryIndex.VersionsAt(key, sequenceNumber) {
+				if !yieldVersion(version) {
+					return
+				}
+			}
+		}
+
+		// SSTables beyond level 0 do not overlap, so at most one SSTable per level holds the key;
+		// SSTables whose bloom filter rules the key out are skipped without reading them
+		for _, sstable := range family.sstables {
+			if !sstableContainsKey(family.comparator, sstable, key) {
+				continue
+			}
+			*sstablesProbed++
+			for entry, err := range sstable.VersionsAt(key, sequenceNumber) {
+				if err != nil {
+					yield(KeyValuePair{}, err)
+					return
+				}
+				if !yieldVersion(entry.ToKeyValuePair()) {
+					return
+				}
+			}
+		}
+	}
+}
 
-		log := me.writeAheadLogs[len(me.writeAheadLogs)-i-1]
+// expire returns a version that has expired as a tombstone, which it reads as. It still shadows
+// older versions of its key.
+func (me *LSMDB) expire(kvp KeyValuePair) KeyValuePair {
+	if kvp.IsExpiredAt(me.clock()) {
+		kvp.IsDeleted = true
+		kvp.Value = nil
+		kvp.ExpiresAt = 0
+	}
+	return kvp
+}
+
+func (me *LSMDB) processWriteAheadLogs(ctx *dbCtx) error {
+	// process oldest logs first; logs may be removed from the list as SSTables are recovered, so
+	// iterate over a copy
+	for _, log := range slices.Backward(slices.Clone(me.writeAheadLogs)) {
 		cursor := log.NewCursor(false)
 		for {
 			entry, hasNext, err := cursor.NextEntry()
@@ -253,10 +654,16 @@ func (me *LSMDB) processWriteAheadLogs(ctx *dbCtx) error {
 			switch parsed := parsed.(type) {
 			case CUDKeyValueEntry:
 				me.processCUDKeyValueEntry(ctx, parsed)
+			case WriteBatchEntry:
+				me.processWriteBatchEntry(ctx, parsed)
 			case CreateSSTableEntry:
 				if err := me.processCreateSSTableEntry(ctx, parsed); err != nil {
 					return err
 				}
+			case MergeTablesEntry:
+				if err := me.processMergeTablesEntry(ctx, parsed); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -269,6 +676,9 @@ func (me *LSMDB) runAsyncWorker() {
 		me.wg.Done()
 		return
 	}
+	me.wg.Add(1)
+	go me.runCompactor()
+
 	go func() {
 		defer func() {
 			me.isRunning.Store(false)
@@ -282,12 +692,27 @@ func (me *LSMDB) runAsyncWorker() {
 				case CUDKeyValueEntry:
 					me.processCUDKeyValueEntry(ctx, entry)
 				case CreateSSTableEntry:
+					retryDelay := minFlushRetryDelay
 					for {
-						if err := me.processCreateSSTableEntryAsync(ctx, entry); err != nil {
-							log.Printf("Failed to create SSTable: %s", err.Error())
-						} else {
+						err := me.processCreateSSTableEntryAsync(ctx, &entry)
+						if err == nil {
 							break
 						}
+						log.Printf("Failed to create SSTable: %s", err.Error())
+						me.events.backgroundError(err)
+
+						// failures that leave the database in an unknown state are not retried
+						if err := me.checkStateError(ctx); err != nil {
+							me.abandonCreateSSTableEntry(ctx, &entry)
+							break
+						}
+						select {
+						case <-time.After(retryDelay):
+							retryDelay = min(2*retryDelay, maxFlushRetryDelay)
+						case <-me.done:
+							me.abandonCreateSSTableEntry(ctx, &entry)
+							return
+						}
 					}
 				}
 			case <-me.done:
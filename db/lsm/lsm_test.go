@@ -1,8 +1,12 @@
 package lsm
 
 import (
+	"fmt"
+	"os"
 	"testing"
 
+	"github.com/navijation/njsimple/storage/journal"
+	"github.com/navijation/njsimple/storage/sstable"
 	"github.com/navijation/njsimple/util"
 	testing_util "github.com/navijation/njsimple/util/testing"
 	"github.com/stretchr/testify/assert"
@@ -29,12 +33,12 @@ func TestOpen(t *testing.T) {
 
 		assert.Equal(t, uint64(2), db.nextWriteAheadLogNumber)
 		assert.Equal(t, uint64(1), db.nextSSTableNumber)
-		assert.Equal(t, []*InMemoryIndex{{}}, db.inMemoryIndexes)
+		assert.Equal(t, []*InMemoryIndex{NewInMemoryIndex(sstable.BytewiseComparator)}, db.defaultFamily.inMemoryIndexes)
 		if assert.Len(t, db.writeAheadLogs, 1) {
 			assert.Equal(t, dir+"/writeahead_log_1.jrn", db.writeAheadLogs[0].Path())
 			assert.FileExists(t, db.writeAheadLogs[0].Path())
 		}
-		assert.Len(t, db.sstables, 0)
+		assert.Len(t, db.defaultFamily.sstables, 0)
 		assert.NoError(t, db.stateErr)
 		assert.False(t, db.isRunning.Load())
 		assert.Equal(t, dir, db.path)
@@ -54,18 +58,37 @@ func TestOpen(t *testing.T) {
 
 		assert.Equal(t, uint64(2), sameDB.nextWriteAheadLogNumber)
 		assert.Equal(t, uint64(1), sameDB.nextSSTableNumber)
-		assert.Equal(t, []*InMemoryIndex{{}}, sameDB.inMemoryIndexes)
+		assert.Equal(t, []*InMemoryIndex{NewInMemoryIndex(sstable.BytewiseComparator)}, sameDB.defaultFamily.inMemoryIndexes)
 		if assert.Len(t, db.writeAheadLogs, 1) {
 			assert.Equal(t, dir+"/writeahead_log_1.jrn", db.writeAheadLogs[0].Path())
 			assert.FileExists(t, db.writeAheadLogs[0].Path())
 		}
-		assert.Len(t, sameDB.sstables, 0)
+		assert.Len(t, sameDB.defaultFamily.sstables, 0)
 		assert.NoError(t, sameDB.stateErr)
 		assert.False(t, sameDB.isRunning.Load())
 		assert.Equal(t, dir, sameDB.path)
 	})
 
 	require.NoError(t, sameDB.Close())
+
+	t.Run("open baseline-format DB", func(t *testing.T) {
+		// databases used to be made up of writeahead logs and SSTables alone
+		baselineDir := dir + "_baseline"
+		require.NoError(t, os.Mkdir(baselineDir, 0o755))
+		defer os.RemoveAll(baselineDir)
+
+		writeAheadLog, err := journal.Open(journal.OpenArgs{
+			Path:   baselineDir + "/writeahead_log_1.jrn",
+			Create: true,
+		})
+		require.NoError(t, err)
+		require.NoError(t, writeAheadLog.Close())
+
+		_, err = Open(OpenArgs{Path: baselineDir})
+		assert.ErrorIs(t, err, ErrUnsupportedFormatVersion)
+		assert.FileExists(t, baselineDir+"/writeahead_log_1.jrn")
+		assert.NoFileExists(t, baselineDir+"/"+manifestFileName)
+	})
 }
 
 func TestLSMDB_StartClose(t *testing.T) {
@@ -93,3 +116,112 @@ func TestLSMDB_StartClose(t *testing.T) {
 	assert.Empty(t, db.done)
 	assert.NoError(t, db.stateErr)
 }
+
+func TestLSMDB_BlockCache(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_BlockCache")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(3),
+		}),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	writeSSTable := func(t *testing.T, table int) {
+		for i := range 10 {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d-%d", table, i)),
+			))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+	assertLookups := func(t *testing.T, table int) {
+		for i := range 10 {
+			entry, exists, err := db.Lookup([]byte(fmt.Sprintf("key %03d", i)))
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, fmt.Sprintf("value %d-%d", table, i), string(entry.Value))
+			}
+		}
+	}
+
+	for table := range 2 {
+		writeSSTable(t, table)
+	}
+	waitForCompaction(t, db, 2)
+
+	t.Run("repeated lookups hit the cache", func(t *testing.T) {
+		assertLookups(t, 1)
+		before := db.BlockCacheStats()
+		assert.NotZero(t, before.Misses)
+		assert.NotZero(t, before.Size)
+
+		assertLookups(t, 1)
+		after := db.BlockCacheStats()
+		assert.Equal(t, before.Misses, after.Misses)
+		assert.Equal(t, before.Hits+10, after.Hits)
+	})
+
+	t.Run("merged SSTables are evicted", func(t *testing.T) {
+		writeSSTable(t, 2)
+		waitForCompaction(t, db, 1)
+
+		assert.Zero(t, db.BlockCacheStats().Size)
+		assertLookups(t, 2)
+	})
+}
+
+func TestLSMDB_WriteAheadLogSync(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name   string
+		policy journal.SyncPolicy
+	}{
+		{name: "periodically", policy: journal.SyncPolicy{Mode: journal.SyncPeriodically}},
+		{name: "never", policy: journal.SyncPolicy{Mode: journal.SyncNever}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_WriteAheadLogSync")
+			cleanup()
+			defer cleanup()
+
+			db, err := Open(OpenArgs{
+				Path:              dir,
+				Create:            true,
+				WriteAheadLogSync: tc.policy,
+			})
+			require.NoError(t, err)
+			require.NoError(t, db.Start())
+
+			for i := range 10 {
+				require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key%d", i)), []byte("value")))
+			}
+			require.NoError(t, db.SyncWAL())
+			require.NoError(t, db.Close())
+
+			sameDB, err := Open(OpenArgs{
+				Path:              dir,
+				WriteAheadLogSync: tc.policy,
+			})
+			require.NoError(t, err)
+			require.NoError(t, sameDB.Start())
+			defer sameDB.Close()
+
+			for i := range 10 {
+				_, exists, err := sameDB.Lookup([]byte(fmt.Sprintf("key%d", i)))
+				assert.NoError(t, err)
+				assert.True(t, exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,606 @@
+package lsm
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+
+	"github.com/navijation/njsimple/storage/journal"
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+const manifestFileName = "MANIFEST"
+
+// The MANIFEST is a journal of version edits, which together describe the set of files making up
+// the database. Files in the database directory that the MANIFEST does not list are orphans, left
+// behind by a crash, and are removed when the database is opened.
+type manifest struct {
+	journal  *journal.JournalFile
+	sstables map[uint64]SSTableMetadata
+	// writeahead logs numbered below this have been flushed to SSTables
+	writeAheadLogNumber     uint64
+	nextSSTableNumber       uint64
+	nextWriteAheadLogNumber uint64
+	// name of the merge operator that merge operands of the default column family were written
+	// for, if any
+	mergeOperatorName  string
+	columnFamilies     map[uint64]ColumnFamilyMetadata
+	nextColumnFamilyID uint64
+}
+
+// Describes a live SSTable.
+// _______________________________________________________________________________________
+// | 8 bytes        | 8 bytes | 8 bytes        | (variable) | 8 bytes       | (variable) |
+// |-------------------------------------------------------------------------------------|
+// | SSTable number | level   | first key size | first key  | last key size | last key   |
+// |-------------------------------------------------------------------------------------|
+type SSTableMetadata struct {
+	Number   uint64
+	Level    uint64
+	FirstKey []byte
+	LastKey  []byte
+}
+
+// Describes a live column family other than the default one, whose SSTables are kept in its own
+// subdirectory.
+// ________________________________________________________________________________________
+// | 8 bytes          | 8 bytes   | (variable) | 8 bytes            | (variable)          |
+// |--------------------------------------------------------------------------------------|
+// | column family ID | name size | name       | merge op name size | merge operator name |
+// |--------------------------------------------------------------------------------------|
+type ColumnFamilyMetadata struct {
+	ID                uint64
+	Name              string
+	MergeOperatorName string
+}
+
+// A change to the set of live files and column families. Zero numbers and an empty merge operator
+// name leave the corresponding field unchanged, and adding an existing column family replaces its
+// metadata. The binary representation is as follows.
+// ___________________________________________________________________________________________
+// | 8 bytes       | 8 bytes          | 8 bytes          | 8 bytes   | (variable) ... |        |
+// |-----------------------------------------------------------------------------------------|
+// | writeahead    | next SSTable     | next writeahead  | num added | added SSTable  | ...    |
+// | log number    | number           | log number       |           | metadata       |        |
+// |-----------------------------------------------------------------------------------------|
+// | 8 bytes       | 8 bytes ...      |                                                      |
+// |-----------------------------------------------------------------------------------------|
+// | num removed   | removed SSTable numbers                                                 |
+// |-----------------------------------------------------------------------------------------|
+// | 8 bytes       | (variable)       |                                                      |
+// |-----------------------------------------------------------------------------------------|
+// | merge op name | merge operator   |                                                      |
+// | size          | name             |                                                      |
+// |-----------------------------------------------------------------------------------------|
+// | 8 bytes       | 8 bytes          | (variable) ...   | 8 bytes   | 8 bytes ...             |
+// |-----------------------------------------------------------------------------------------|
+// | next column   | num added column | added column     | num       | dropped column family   |
+// | family ID     | families         | family metadata  | dropped   | IDs                     |
+// |-----------------------------------------------------------------------------------------|
+type VersionEdit struct {
+	// writeahead logs numbered below this have been flushed to SSTables
+	WriteAheadLogNumber     uint64
+	NextSSTableNumber       uint64
+	NextWriteAheadLogNumber uint64
+	AddedSSTables           []SSTableMetadata
+	RemovedSSTables         []uint64
+	// of the default column family
+	MergeOperatorName     string
+	NextColumnFamilyID    uint64
+	AddedColumnFamilies   []ColumnFamilyMetadata
+	DroppedColumnFamilies []uint64
+}
+
+func newSSTableMetadata(table *sstable.SSTable) SSTableMetadata {
+	firstKey, lastKey := table.KeyRange()
+	return SSTableMetadata{
+		Number:   sstableNumber(table),
+		Level:    table.Level(),
+		FirstKey: firstKey,
+		LastKey:  lastKey,
+	}
+}
+
+// createManifest atomically writes a new MANIFEST holding a single version edit, replacing any
+// existing MANIFEST.
+func createManifest(dbPath string, edit VersionEdit) (out manifest, _ error) {
+	file, err := os.CreateTemp(filepath.Join(dbPath, "tmp"), "manifest_")
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+	_ = os.Remove(file.Name())
+	defer os.Remove(file.Name())
+	_ = file.Close()
+
+	journalFile, err := journal.Open(journal.OpenArgs{
+		Path:   file.Name(),
+		Create: true,
+	})
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+
+	out = manifest{
+		journal:        &journalFile,
+		sstables:       map[uint64]SSTableMetadata{},
+		columnFamilies: map[uint64]ColumnFamilyMetadata{},
+	}
+	if err := out.append(edit); err != nil {
+		_ = journalFile.Close()
+		return out, err
+	}
+
+	if err := journalFile.Rename(filepath.Join(dbPath, manifestFileName)); err != nil {
+		_ = journalFile.Close()
+		return out, errors.WithStack(err)
+	}
+
+	return out, nil
+}
+
+// ErrUnsupportedFormatVersion is returned when opening a database written in a format that cannot
+// be read anymore.
+var ErrUnsupportedFormatVersion = errors.New("unsupported format version")
+
+// checkFormatVersion fails if a database directory was written before databases had a MANIFEST.
+// Its SSTables and writeahead log entries have no sequence numbers, so it cannot be upgraded in
+// place.
+func checkFormatVersion(dbPath string) error {
+	if exists, err := util.FileExists(filepath.Join(dbPath, manifestFileName)); err != nil {
+		return errors.WithStack(err)
+	} else if exists {
+		return nil
+	}
+
+	dirents, err := os.ReadDir(dbPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, dirent := range dirents {
+		_, isSSTable := getFileNumber(dirent.Name(), "sstable_", ".sst")
+		_, isWriteAheadLog := getFileNumber(dirent.Name(), "writeahead_log_", ".jrn")
+		if isSSTable || isWriteAheadLog {
+			return fmt.Errorf(
+				"%w: database %q has no %s", ErrUnsupportedFormatVersion, dbPath, manifestFileName,
+			)
+		}
+	}
+	return nil
+}
+
+// readManifest replays every version edit in the MANIFEST.
+func readManifest(dbPath string) (out manifest, _ error) {
+	journalFile, err := journal.Open(journal.OpenArgs{
+		Path: filepath.Join(dbPath, manifestFileName),
+	})
+	if err != nil {
+		return out, errors.WithStack(err)
+	}
+	defer journalFile.Close()
+
+	out = manifest{
+		sstables:       map[uint64]SSTableMetadata{},
+		columnFamilies: map[uint64]ColumnFamilyMetadata{},
+	}
+
+	cursor := journalFile.NewCursor(false)
+	for {
+		entry, hasNext, err := cursor.NextEntry()
+		if err != nil {
+			return out, err
+		}
+		if !hasNext {
+			break
+		}
+		edit, err := util.ValueFromBytes[VersionEdit](entry.Content)
+		// edits are logged whole, so one that ends early is corrupt
+		if errors.Is(err, io.EOF) {
+			return out, errors.Wrapf(io.ErrUnexpectedEOF, "version edit %d", entry.EntryNumber)
+		}
+		if err != nil {
+			return out, err
+		}
+		out.apply(edit)
+	}
+
+	return out, nil
+}
+
+// snapshot returns a single version edit that recreates the current state from scratch.
+func (me *manifest) snapshot() VersionEdit {
+	out := VersionEdit{
+		WriteAheadLogNumber:     me.writeAheadLogNumber,
+		NextSSTableNumber:       me.nextSSTableNumber,
+		NextWriteAheadLogNumber: me.nextWriteAheadLogNumber,
+		MergeOperatorName:       me.mergeOperatorName,
+		NextColumnFamilyID:      me.nextColumnFamilyID,
+	}
+	for _, metadata := range me.sstables {
+		out.AddedSSTables = append(out.AddedSSTables, metadata)
+	}
+	slices.SortFunc(out.AddedSSTables, func(a, b SSTableMetadata) int {
+		return cmp.Compare(a.Number, b.Number)
+	})
+	for _, metadata := range me.columnFamilies {
+		out.AddedColumnFamilies = append(out.AddedColumnFamilies, metadata)
+	}
+	slices.SortFunc(out.AddedColumnFamilies, func(a, b ColumnFamilyMetadata) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return out
+}
+
+// append durably logs a version edit, then applies it.
+func (me *manifest) append(edit VersionEdit) error {
+	bytes, _ := util.ToBytes(&edit)
+	if _, err := me.journal.AppendEntry(bytes); err != nil {
+		return err
+	}
+	me.apply(edit)
+	return nil
+}
+
+func (me *manifest) apply(edit VersionEdit) {
+	me.writeAheadLogNumber = max(me.writeAheadLogNumber, edit.WriteAheadLogNumber)
+	me.nextSSTableNumber = max(me.nextSSTableNumber, edit.NextSSTableNumber)
+	me.nextWriteAheadLogNumber = max(me.nextWriteAheadLogNumber, edit.NextWriteAheadLogNumber)
+	for _, metadata := range edit.AddedSSTables {
+		me.sstables[metadata.Number] = metadata
+	}
+	for _, number := range edit.RemovedSSTables {
+		delete(me.sstables, number)
+	}
+	if edit.MergeOperatorName != "" {
+		me.mergeOperatorName = edit.MergeOperatorName
+	}
+	me.nextColumnFamilyID = max(me.nextColumnFamilyID, edit.NextColumnFamilyID)
+	for _, metadata := range edit.AddedColumnFamilies {
+		me.columnFamilies[metadata.ID] = metadata
+	}
+	for _, id := range edit.DroppedColumnFamilies {
+		delete(me.columnFamilies, id)
+	}
+}
+
+func (me *manifest) hasSSTable(number uint64) bool {
+	_, ok := me.sstables[number]
+	return ok
+}
+
+// isLiveWriteAheadLog reports whether a writeahead log may still hold entries missing from the
+// SSTables.
+func (me *manifest) isLiveWriteAheadLog(number uint64) bool {
+	return number >= me.writeAheadLogNumber && number < me.nextWriteAheadLogNumber
+}
+
+func (me *manifest) Close() error {
+	if me.journal != nil {
+		return me.journal.Close()
+	}
+	return nil
+}
+
+// logVersionEdit appends a version edit to the MANIFEST. Failing to do so leaves the database in
+// an unknown state.
+func (me *LSMDB) logVersionEdit(ctx *dbCtx, edit VersionEdit) error {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	if err := me.manifest.append(edit); err != nil {
+		err = errors.WithStack(err)
+		me.stateErr = err
+		return err
+	}
+	return nil
+}
+
+// removeOrphanedFile removes a file that the MANIFEST does not list.
+func removeOrphanedFile(path string) error {
+	log.Printf("Removing orphaned DB file %q\n", filepath.Base(path))
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (me *SSTableMetadata) SizeOf() uint64 {
+	return 8 + 8 + 8 + uint64(len(me.FirstKey)) + 8 + uint64(len(me.LastKey))
+}
+
+func (me *SSTableMetadata) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := util.WriteUint64s(writer, me.Number, me.Level)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, key := range [][]byte{me.FirstKey, me.LastKey} {
+		dn, err = util.WriteUint64(writer, uint64(len(key)))
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+
+		dn, err = writer.Write(key)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (me *SSTableMetadata) ReadFrom(reader io.Reader) (n int64, _ error) {
+	dn, err := util.ReadUint64s(reader, &me.Number, &me.Level)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, key := range []*[]byte{&me.FirstKey, &me.LastKey} {
+		keySize, dn, err := util.ReadUint64(reader)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+
+		*key = make([]byte, keySize)
+		dn, err = io.ReadFull(reader, *key)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (me *VersionEdit) SizeOf() uint64 {
+	size := uint64(8 + 8 + 8 + 8)
+	for _, metadata := range me.AddedSSTables {
+		size += metadata.SizeOf()
+	}
+	size += 8 + 8*uint64(len(me.RemovedSSTables))
+	size += 8 + uint64(len(me.MergeOperatorName))
+	size += 8 + 8
+	for _, metadata := range me.AddedColumnFamilies {
+		size += metadata.SizeOf()
+	}
+	return size + 8 + 8*uint64(len(me.DroppedColumnFamilies))
+}
+
+func (me *VersionEdit) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := util.WriteUint64s(
+		writer,
+		me.WriteAheadLogNumber,
+		me.NextSSTableNumber,
+		me.NextWriteAheadLogNumber,
+		uint64(len(me.AddedSSTables)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, metadata := range me.AddedSSTables {
+		dn2, err := metadata.WriteTo(writer)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+	}
+
+	dn, err = util.WriteUint64(writer, uint64(len(me.RemovedSSTables)))
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(writer, me.RemovedSSTables...)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = writeString(writer, me.MergeOperatorName)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(
+		writer, me.NextColumnFamilyID, uint64(len(me.AddedColumnFamilies)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, metadata := range me.AddedColumnFamilies {
+		dn2, err := metadata.WriteTo(writer)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+	}
+
+	dn, err = util.WriteUint64(writer, uint64(len(me.DroppedColumnFamilies)))
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = util.WriteUint64s(writer, me.DroppedColumnFamilies...)
+	n += int64(dn)
+
+	return n, err
+}
+
+func (me *VersionEdit) ReadFrom(reader io.Reader) (n int64, _ error) {
+	var numAdded uint64
+	dn, err := util.ReadUint64s(
+		reader,
+		&me.WriteAheadLogNumber,
+		&me.NextSSTableNumber,
+		&me.NextWriteAheadLogNumber,
+		&numAdded,
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	me.AddedSSTables = nil
+	for range numAdded {
+		var metadata SSTableMetadata
+		dn2, err := metadata.ReadFrom(reader)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+		me.AddedSSTables = append(me.AddedSSTables, metadata)
+	}
+
+	numRemoved, dn, err := util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	me.RemovedSSTables = nil
+	for range numRemoved {
+		var number uint64
+		dn, err = util.ReadUint64s(reader, &number)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+		me.RemovedSSTables = append(me.RemovedSSTables, number)
+	}
+
+	me.MergeOperatorName = ""
+	me.NextColumnFamilyID = 0
+	me.AddedColumnFamilies = nil
+	me.DroppedColumnFamilies = nil
+
+	me.MergeOperatorName, dn, err = readString(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	var numAddedFamilies uint64
+	dn, err = util.ReadUint64s(reader, &me.NextColumnFamilyID, &numAddedFamilies)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for range numAddedFamilies {
+		var metadata ColumnFamilyMetadata
+		dn2, err := metadata.ReadFrom(reader)
+		n += dn2
+		if err != nil {
+			return n, err
+		}
+		me.AddedColumnFamilies = append(me.AddedColumnFamilies, metadata)
+	}
+
+	numDroppedFamilies, dn, err := util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for range numDroppedFamilies {
+		var id uint64
+		dn, err = util.ReadUint64s(reader, &id)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+		me.DroppedColumnFamilies = append(me.DroppedColumnFamilies, id)
+	}
+
+	return n, nil
+}
+
+func (me *ColumnFamilyMetadata) SizeOf() uint64 {
+	return 8 + 8 + uint64(len(me.Name)) + 8 + uint64(len(me.MergeOperatorName))
+}
+
+func (me *ColumnFamilyMetadata) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := util.WriteUint64(writer, me.ID)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, str := range []string{me.Name, me.MergeOperatorName} {
+		dn, err = writeString(writer, str)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (me *ColumnFamilyMetadata) ReadFrom(reader io.Reader) (n int64, _ error) {
+	dn, err := util.ReadUint64s(reader, &me.ID)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	for _, str := range []*string{&me.Name, &me.MergeOperatorName} {
+		*str, dn, err = readString(reader)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// writeString writes a string prefixed with its size.
+func writeString(writer io.Writer, str string) (n int, _ error) {
+	dn, err := util.WriteUint64(writer, uint64(len(str)))
+	n += dn
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = io.WriteString(writer, str)
+	n += dn
+
+	return n, err
+}
+
+// readString reads a string written by writeString.
+func readString(reader io.Reader) (_ string, n int, _ error) {
+	size, dn, err := util.ReadUint64(reader)
+	n += dn
+	if err != nil {
+		return "", n, err
+	}
+
+	out := make([]byte, size)
+	dn, err = io.ReadFull(reader, out)
+	n += dn
+	if err != nil {
+		return "", n, err
+	}
+
+	return string(out), n, nil
+}
@@ -0,0 +1,148 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/navijation/njsimple/storage/journal"
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionEdit_Serialization(t *testing.T) {
+	t.Parallel()
+
+	edit := VersionEdit{
+		WriteAheadLogNumber:     3,
+		NextSSTableNumber:       12,
+		NextWriteAheadLogNumber: 4,
+		AddedSSTables: []SSTableMetadata{
+			{Number: 10, Level: 0, FirstKey: []byte("a"), LastKey: []byte("m")},
+			{Number: 11, Level: 2, FirstKey: []byte("n"), LastKey: []byte("zz")},
+		},
+		RemovedSSTables:    []uint64{7, 8},
+		MergeOperatorName:  "counter",
+		NextColumnFamilyID: 3,
+		AddedColumnFamilies: []ColumnFamilyMetadata{
+			{ID: 2, Name: "users", MergeOperatorName: "counter"},
+		},
+		DroppedColumnFamilies: []uint64{1},
+	}
+
+	var buf bytes.Buffer
+	n, err := edit.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, edit.SizeOf(), n)
+
+	var deserializedEdit VersionEdit
+	_, err = deserializedEdit.ReadFrom(&buf)
+	assert.NoError(t, err)
+
+	assert.Equal(t, edit, deserializedEdit)
+
+	t.Run("truncated before column families", func(t *testing.T) {
+		edit := VersionEdit{NextSSTableNumber: 12, MergeOperatorName: "counter"}
+
+		var buf bytes.Buffer
+		_, err := edit.WriteTo(&buf)
+		assert.NoError(t, err)
+		// next column family ID, and numbers of added and dropped column families
+		buf.Truncate(buf.Len() - 3*8)
+
+		var deserializedEdit VersionEdit
+		_, err = deserializedEdit.ReadFrom(&buf)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
+
+func TestLSMDB_Manifest(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Manifest")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	for table := range 3 {
+		for i := range 10 {
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("value %d-%d", table, i)),
+			))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+	waitForCompaction(t, db, 3)
+	require.NoError(t, db.Close())
+
+	openArgs.Create = false
+
+	t.Run("rebuild state from MANIFEST", func(t *testing.T) {
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		defer sameDB.Close()
+
+		assert.Len(t, sameDB.defaultFamily.sstables, 3)
+		assert.Len(t, sameDB.manifest.sstables, 3)
+		assert.Equal(t, uint64(4), sameDB.nextSSTableNumber)
+		assert.Equal(t, uint64(5), sameDB.nextWriteAheadLogNumber)
+		if assert.Len(t, sameDB.writeAheadLogs, 1) {
+			assert.Equal(t, sameDB.writeAheadLogPath(4), sameDB.writeAheadLogs[0].Path())
+		}
+		for _, table := range sameDB.defaultFamily.sstables {
+			metadata := sameDB.manifest.sstables[sstableNumber(table)]
+			assert.Equal(t, []byte("key 000"), metadata.FirstKey)
+			assert.Equal(t, []byte("key 009"), metadata.LastKey)
+		}
+
+		// the MANIFEST is compacted into a single edit on open
+		manifestJournal, err := journal.Open(journal.OpenArgs{
+			Path: filepath.Join(dir, manifestFileName),
+		})
+		require.NoError(t, err)
+		defer manifestJournal.Close()
+		assert.EqualValues(t, 1, manifestJournal.NumEntries())
+	})
+
+	t.Run("orphaned files are removed", func(t *testing.T) {
+		for _, name := range []string{"sstable_10.sst", "writeahead_log_1.jrn", "writeahead_log_9.jrn"} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("garbage"), 0o644))
+		}
+
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assertSSTableFiles(t, sameDB)
+		for _, name := range []string{"sstable_10.sst", "writeahead_log_1.jrn", "writeahead_log_9.jrn"} {
+			assert.NoFileExists(t, filepath.Join(dir, name))
+		}
+
+		entry, exists, err := sameDB.Lookup([]byte("key 005"))
+		if assert.NoError(t, err) && assert.True(t, exists) {
+			assert.Equal(t, "value 2-5", string(entry.Value))
+		}
+	})
+
+	t.Run("missing SSTable", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(dir, "sstable_1.sst")))
+
+		_, err := Open(openArgs)
+		assert.Error(t, err)
+	})
+}
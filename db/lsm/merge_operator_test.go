@@ -0,0 +1,202 @@
+package lsm
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Merge(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Merge")
+	cleanup()
+	defer cleanup()
+
+	openArgs := OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(4),
+		}),
+		MergeOperator: util.Some[MergeOperator](counterOperator{}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	assertCounter := func(t *testing.T, db *LSMDB, key string, expected int) {
+		t.Helper()
+		entry, exists, err := db.Lookup([]byte(key))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.False(t, entry.IsMergeOperand) &&
+			assert.Equal(t, strconv.Itoa(expected), string(entry.Value))
+	}
+
+	t.Run("merge in memory", func(t *testing.T) {
+		require.NoError(t, db.Upsert([]byte("memory"), []byte("10")))
+		for range 3 {
+			require.NoError(t, db.Merge([]byte("memory"), []byte("1")))
+		}
+		assertCounter(t, db, "memory", 13)
+
+		snapshot := db.NewSnapshot()
+		defer snapshot.Release()
+		require.NoError(t, db.Merge([]byte("memory"), []byte("1")))
+
+		entry, _, err := db.LookupAt([]byte("memory"), snapshot)
+		_ = assert.NoError(t, err) && assert.Equal(t, "13", string(entry.Value))
+		assertCounter(t, db, "memory", 14)
+
+		// a deletion resets the counter
+		require.NoError(t, db.Delete([]byte("memory")))
+		require.NoError(t, db.Merge([]byte("memory"), []byte("1")))
+		assertCounter(t, db, "memory", 1)
+	})
+
+	t.Run("failed merge", func(t *testing.T) {
+		require.NoError(t, db.Merge([]byte("failed"), []byte("1")))
+		require.NoError(t, db.Merge([]byte("failed"), []byte("not a number")))
+
+		_, exists, err := db.Lookup([]byte("failed"))
+		assert.ErrorIs(t, err, strconv.ErrSyntax)
+		assert.False(t, exists)
+
+		var scanErr error
+		for _, err := range db.Scan([]byte("failed"), []byte("failee")) {
+			if err != nil {
+				scanErr = err
+				break
+			}
+		}
+		assert.ErrorIs(t, scanErr, strconv.ErrSyntax)
+
+		require.NoError(t, db.Delete([]byte("failed")))
+	})
+
+	// every round adds to the same keys, so operands end up spread over many SSTables
+	const numRounds, numKeys = 12, 20
+	for round := range numRounds {
+		for i := range numKeys {
+			if round == 0 && i%2 == 0 {
+				require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("100")))
+			}
+			require.NoError(t, db.Merge([]byte(fmt.Sprintf("key %03d", i)), []byte("1")))
+		}
+		require.NoError(t, db.CreateSSTable())
+	}
+
+	assertContents := func(t *testing.T, db *LSMDB) {
+		for i := range numKeys {
+			expected := numRounds
+			if i%2 == 0 {
+				expected += 100
+			}
+			assertCounter(t, db, fmt.Sprintf("key %03d", i), expected)
+		}
+
+		var numScanned int
+		for kvp, err := range db.Scan([]byte("key"), []byte("kez")) {
+			require.NoError(t, err)
+			assert.False(t, kvp.IsMergeOperand)
+			counter, err := strconv.Atoi(string(kvp.Value))
+			if assert.NoError(t, err) {
+				assert.Contains(t, []int{numRounds, numRounds + 100}, counter)
+			}
+			numScanned++
+		}
+		assert.Equal(t, numKeys, numScanned)
+	}
+
+	t.Run("contents before compaction", func(t *testing.T) {
+		assertContents(t, db)
+	})
+
+	waitForCompaction(t, db, 4)
+
+	t.Run("contents after compaction", func(t *testing.T) {
+		assertContents(t, db)
+	})
+	require.NoError(t, db.Close())
+
+	t.Run("re-open database", func(t *testing.T) {
+		openArgs.Create = false
+		sameDB, err := Open(openArgs)
+		require.NoError(t, err)
+		require.NoError(t, sameDB.Start())
+		defer sameDB.Close()
+
+		assertContents(t, sameDB)
+	})
+
+	t.Run("re-open with the wrong merge operator", func(t *testing.T) {
+		openArgs.Create = false
+		for _, mergeOperator := range []util.Optional[MergeOperator]{
+			util.Some[MergeOperator](otherCounterOperator{}),
+			{},
+		} {
+			openArgs.MergeOperator = mergeOperator
+			_, err := Open(openArgs)
+			assert.ErrorContains(t, err, `requires merge operator "counter"`)
+		}
+	})
+}
+
+func TestLSMDB_MergeWithoutOperator(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_MergeWithoutOperator")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:   dir,
+		Create: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	assert.Error(t, db.Merge([]byte("key"), []byte("1")))
+}
+
+// counterOperator adds up decimal integers.
+type counterOperator struct{}
+
+func (counterOperator) Name() string {
+	return "counter"
+}
+
+func (me counterOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if existing != nil {
+		operands = append([][]byte{existing}, operands...)
+	}
+	return me.PartialMerge(key, operands)
+}
+
+func (counterOperator) PartialMerge(_ []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	for _, operand := range operands {
+		value, err := strconv.Atoi(string(operand))
+		if err != nil {
+			return nil, err
+		}
+		sum += value
+	}
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+type otherCounterOperator struct {
+	counterOperator
+}
+
+func (otherCounterOperator) Name() string {
+	return "other counter"
+}
@@ -1,6 +1,11 @@
 package lsm
 
-import "github.com/navijation/njsimple/storage/keyvaluepair"
+import (
+	"github.com/navijation/njsimple/storage/keyvaluepair"
+	"github.com/navijation/njsimple/storage/sstable"
+)
 
 type KeyValuePair = keyvaluepair.KeyValuePair
 type StoredKeyValuePair = keyvaluepair.StoredKeyValuePair
+type MergeOperator = sstable.MergeOperator
+type Comparator = sstable.Comparator
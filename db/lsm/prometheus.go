@@ -0,0 +1,148 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Return an HTTP handler that serves the database's Stats in the Prometheus text exposition
+// format, for a Prometheus server to scrape.
+func (me *LSMDB) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := me.Stats()
+		w.Header().Set("Content-Type", prometheusContentType)
+		_ = stats.WritePrometheus(w)
+	})
+}
+
+// Write the stats in the Prometheus text exposition format. Per-column-family gauges are labeled
+// with the name of their column family.
+func (me *Stats) WritePrometheus(w io.Writer) error {
+	out := prometheusWriter{w: w}
+
+	out.metric("njsimple_wal_bytes_written_total", "counter",
+		"Bytes appended to the writeahead logs.")
+	out.sample("njsimple_wal_bytes_written_total", "", float64(me.WriteAheadLogBytesWritten))
+	out.histogram("njsimple_wal_sync_duration_seconds",
+		"Durations of syncing the writeahead logs to disk.", me.WriteAheadLogSyncs)
+
+	for _, gauge := range []struct {
+		name, help string
+		value      func(ColumnFamilyStats) float64
+	}{
+		{
+			name: "njsimple_memtables",
+			help: "Number of in-memory indexes, including those waiting to be flushed.",
+			value: func(family ColumnFamilyStats) float64 {
+				return float64(len(family.InMemoryIndexSizes))
+			},
+		},
+		{
+			name: "njsimple_memtable_bytes",
+			help: "Total size of the in-memory indexes.",
+			value: func(family ColumnFamilyStats) (out float64) {
+				for _, size := range family.InMemoryIndexSizes {
+					out += float64(size)
+				}
+				return out
+			},
+		},
+		{
+			name: "njsimple_sstables",
+			help: "Number of SSTables.",
+			value: func(family ColumnFamilyStats) float64 {
+				return float64(family.SSTables)
+			},
+		},
+		{
+			name: "njsimple_sstable_bytes",
+			help: "Total size of the SSTable files.",
+			value: func(family ColumnFamilyStats) float64 {
+				return float64(family.SSTableBytes)
+			},
+		},
+	} {
+		out.metric(gauge.name, "gauge", gauge.help)
+		for _, family := range me.ColumnFamilies {
+			labels := fmt.Sprintf(`column_family="%s"`, escapeLabelValue(family.Name))
+			out.sample(gauge.name, labels, gauge.value(family))
+		}
+	}
+
+	out.histogram("njsimple_lookup_sstables_probed",
+		"Number of SSTables probed by each lookup.", me.LookupSSTablesProbed)
+	out.histogram("njsimple_flush_duration_seconds",
+		"Durations of writing an in-memory index to a new SSTable.", me.Flushes)
+	out.histogram("njsimple_merge_duration_seconds",
+		"Durations of merging SSTables into a new SSTable.", me.Merges)
+
+	out.metric("njsimple_block_cache_hits_total", "counter", "Block cache hits.")
+	out.sample("njsimple_block_cache_hits_total", "", float64(me.BlockCache.Hits))
+	out.metric("njsimple_block_cache_misses_total", "counter", "Block cache misses.")
+	out.sample("njsimple_block_cache_misses_total", "", float64(me.BlockCache.Misses))
+	out.metric("njsimple_block_cache_bytes", "gauge", "Total size of the cached blocks.")
+	out.sample("njsimple_block_cache_bytes", "", float64(me.BlockCache.Size))
+
+	var failed float64
+	if me.StateErr != nil {
+		failed = 1
+	}
+	out.metric("njsimple_state_error", "gauge",
+		"Whether an error stopped the database from accepting writes.")
+	out.sample("njsimple_state_error", "", failed)
+
+	return out.err
+}
+
+// prometheusWriter writes metrics in the Prometheus text exposition format, keeping the first
+// error so that it only needs to be checked once at the end.
+type prometheusWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (me *prometheusWriter) metric(name, metricType, help string) {
+	me.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (me *prometheusWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	me.printf("%s%s %s\n", name, labels, formatSampleValue(value))
+}
+
+func (me *prometheusWriter) histogram(name, help string, histogram Histogram) {
+	me.metric(name, "histogram", help)
+	for _, bucket := range histogram.Buckets {
+		labels := fmt.Sprintf(`le="%s"`, formatSampleValue(bucket.UpperBound))
+		me.sample(name+"_bucket", labels, float64(bucket.Count))
+	}
+	me.sample(name+"_sum", "", histogram.Sum)
+	me.sample(name+"_count", "", float64(histogram.Count))
+}
+
+func (me *prometheusWriter) printf(format string, args ...any) {
+	if me.err == nil {
+		_, me.err = fmt.Fprintf(me.w, format, args...)
+	}
+}
+
+func formatSampleValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
@@ -0,0 +1,240 @@
+package lsm
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/navijation/njsimple/storage/journal"
+	"github.com/navijation/njsimple/util"
+)
+
+type PointInTimeRecoveryArgs struct {
+	// Database to recover from, such as a checkpoint or a restored backup
+	CheckpointDir string
+	// Directories holding the writeahead logs written since the checkpoint, such as the archive
+	// directory of the database. The database directory itself may be included to also replay
+	// the logs that have not been archived yet. A log in several directories is read from its
+	// largest copy.
+	WriteAheadLogDirs []string
+	// New directory to recover the database to
+	TargetDir string
+	// Replay entries up to and including this journal entry number. Entry numbers carry on from
+	// one writeahead log to the next.
+	EntryNumber util.Optional[uint64]
+	// Replay entries logged at or before this time, by the clock of the database
+	Timestamp util.Optional[time.Time]
+}
+
+// RecoverToPointInTime recovers a database to a new directory as it was at a point in time since
+// a checkpoint of it was taken, by replaying the writeahead logs that follow the checkpoint up to
+// the target entry number or timestamp. Without a target, every available entry is replayed.
+//
+// The logs are copied to the new directory and truncated at the target, so the entries are
+// replayed once Open opens it. The recovered database branches off the history of the original
+// one, so it must not share its writeahead log archive directory.
+func RecoverToPointInTime(args PointInTimeRecoveryArgs) (err error) {
+	checkpointManifest, err := readManifest(args.CheckpointDir)
+	if err != nil {
+		return err
+	}
+
+	logPaths, err := findWriteAheadLogs(
+		append([]string{args.CheckpointDir}, args.WriteAheadLogDirs...),
+		checkpointManifest.writeAheadLogNumber,
+	)
+	if err != nil {
+		return err
+	}
+	logNumbers := slices.Sorted(maps.Keys(logPaths))
+	for i, number := range logNumbers {
+		if expected := checkpointManifest.writeAheadLogNumber + uint64(i); number != expected {
+			return fmt.Errorf("writeahead log %d is missing", expected)
+		}
+	}
+
+	if err := os.Mkdir(args.TargetDir, os.ModeExclusive|0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(args.TargetDir)
+		}
+	}()
+	tmpDir := filepath.Join(args.TargetDir, "tmp")
+	if err := os.Mkdir(tmpDir, 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// SSTables are copied rather than linked, since a restored backup may be on another file
+	// system
+	if err := filepath.WalkDir(args.CheckpointDir, func(
+		path string, dirent fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		relativePath, _ := filepath.Rel(args.CheckpointDir, path)
+		switch {
+		case dirent.IsDir() && relativePath == "tmp":
+			return filepath.SkipDir
+		case dirent.IsDir():
+			destDir := filepath.Join(args.TargetDir, relativePath)
+			return errors.WithStack(os.MkdirAll(destDir, 0o755))
+		case relativePath == manifestFileName || strings.HasSuffix(relativePath, ".jrn"):
+			return nil
+		}
+		fileInfo, err := dirent.Info()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return copyFilePrefix(
+			path, filepath.Join(args.TargetDir, relativePath), uint64(fileInfo.Size()),
+		)
+	}); err != nil {
+		return err
+	}
+
+	isPastTarget := func(entry journal.JournalEntry) (bool, error) {
+		if target, ok := args.EntryNumber.Unpack(); ok && entry.EntryNumber > target {
+			return true, nil
+		}
+		loggedAt, _, err := splitJournalEntryTimestamp(entry.Content)
+		if err != nil {
+			return false, err
+		}
+		target, ok := args.Timestamp.Unpack()
+		return ok && loggedAt.After(target), nil
+	}
+
+	lastLogNumber := checkpointManifest.writeAheadLogNumber
+	for i, number := range logNumbers {
+		numReplayed, reachedTarget, err := copyWriteAheadLogUntil(
+			logPaths[number], filepath.Join(args.TargetDir, filepath.Base(logPaths[number])),
+			tmpDir, isPastTarget,
+		)
+		if err != nil {
+			return err
+		}
+		if i == 0 && reachedTarget && numReplayed == 0 {
+			return fmt.Errorf("recovery target precedes the checkpoint")
+		}
+		lastLogNumber = number
+		if reachedTarget {
+			break
+		}
+	}
+
+	// the MANIFEST must list the replayed writeahead logs, or they would be removed as orphans
+	edit := checkpointManifest.snapshot()
+	edit.NextWriteAheadLogNumber = max(edit.NextWriteAheadLogNumber, lastLogNumber+1)
+	targetManifest, err := createManifest(args.TargetDir, edit)
+	if err != nil {
+		return err
+	}
+	if err := targetManifest.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.Remove(tmpDir); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// findWriteAheadLogs returns the paths of the largest copies of the writeahead logs numbered from
+// minNumber on in the given directories, by number.
+func findWriteAheadLogs(dirs []string, minNumber uint64) (map[uint64]string, error) {
+	out, sizes := map[uint64]string{}, map[uint64]int64{}
+	for _, dir := range dirs {
+		dirents, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, dirent := range dirents {
+			number, ok := getFileNumber(dirent.Name(), "writeahead_log_", ".jrn")
+			if !ok || dirent.IsDir() || number < minNumber {
+				continue
+			}
+			fileInfo, err := dirent.Info()
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if _, exists := out[number]; !exists || fileInfo.Size() > sizes[number] {
+				out[number] = filepath.Join(dir, dirent.Name())
+				sizes[number] = fileInfo.Size()
+			}
+		}
+	}
+	return out, nil
+}
+
+// copyWriteAheadLogUntil copies a writeahead log up to the first entry past the recovery target,
+// returning the number of entries copied and whether any entry was past the target.
+func copyWriteAheadLogUntil(
+	srcPath, destPath, tmpDir string, isPastTarget func(journal.JournalEntry) (bool, error),
+) (numCopied uint64, reachedTarget bool, _ error) {
+	fileInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+
+	// the source may still be appended to, so a torn entry at its end is only truncated from the
+	// copy once it is opened
+	tmpPath := filepath.Join(tmpDir, filepath.Base(destPath))
+	if err := copyFilePrefix(srcPath, tmpPath, uint64(fileInfo.Size())); err != nil {
+		return 0, false, err
+	}
+	defer os.Remove(tmpPath)
+
+	writeAheadLog, err := journal.Open(journal.OpenArgs{Path: tmpPath})
+	if err != nil {
+		return 0, false, errors.WithStack(err)
+	}
+	defer writeAheadLog.Close()
+
+	end := writeAheadLog.Size()
+	cursor := writeAheadLog.NewCursor(false)
+	for {
+		entry, hasNext, err := cursor.NextEntry()
+		if err != nil {
+			return numCopied, false, errors.WithStack(err)
+		}
+		if !hasNext {
+			break
+		}
+		if reachedTarget, err = isPastTarget(entry); err != nil {
+			return numCopied, false, err
+		} else if reachedTarget {
+			end = entry.Offset
+			break
+		}
+		numCopied++
+	}
+
+	// signatures only cover the entries preceding them, so any prefix of entries stays valid
+	if err := os.Truncate(tmpPath, int64(end)); err != nil {
+		return numCopied, false, errors.WithStack(err)
+	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return numCopied, false, errors.WithStack(err)
+	}
+	return numCopied, reachedTarget, nil
+}
+
+// archiveWriteAheadLog moves a retired writeahead log to the archive directory.
+func archiveWriteAheadLog(archiveDir, path string) error {
+	if err := os.Rename(
+		path, filepath.Join(archiveDir, filepath.Base(path)),
+	); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverToPointInTime(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestRecoverToPointInTime")
+	defer cleanup()
+
+	var now atomic.Int64
+	start := time.Unix(1_700_000_000, 0)
+	now.Store(start.UnixNano())
+	archiveDir := filepath.Join(dir, "archive")
+	openArgs := OpenArgs{
+		Path:                    filepath.Join(dir, "db"),
+		Create:                  true,
+		IndexChunkSize:          util.Some(uint64(100)),
+		WriteAheadLogArchiveDir: util.Some(archiveDir),
+		Clock: util.Some(func() time.Time {
+			return time.Unix(0, now.Load())
+		}),
+	}
+
+	db, err := Open(openArgs)
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	const numKeys = 10
+	upsertAll := func(t *testing.T, value string) {
+		for i := range numKeys {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			require.NoError(t, db.Upsert(key, []byte(value)))
+		}
+	}
+	lastEntryNumber := func() uint64 {
+		db.lock.RLock()
+		defer db.lock.RUnlock()
+		return db.writeAheadLogs[0].NextEntryNumber() - 1
+	}
+
+	upsertAll(t, "zero")
+	checkpointDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, db.Checkpoint(checkpointDir))
+
+	// each step is logged a minute after the previous one, and spans a new writeahead log
+	steps := []string{"one", "two", "three"}
+	stepEntryNumbers := []uint64{}
+	for i, value := range steps {
+		now.Store(start.Add(time.Duration(i+1) * time.Minute).UnixNano())
+		upsertAll(t, value)
+		stepEntryNumbers = append(stepEntryNumbers, lastEntryNumber())
+		require.NoError(t, db.CreateSSTable())
+		waitForCompaction(t, db, i+1)
+	}
+	// the last step is still in the live writeahead log
+	now.Store(start.Add(10 * time.Minute).UnixNano())
+	upsertAll(t, "live")
+
+	t.Run("retired writeahead logs are archived", func(t *testing.T) {
+		for number := uint64(1); number <= uint64(len(steps)); number++ {
+			baseName := filepath.Base(db.writeAheadLogPath(number))
+			assert.FileExists(t, filepath.Join(archiveDir, baseName))
+			assert.NoFileExists(t, db.writeAheadLogPath(number))
+		}
+		// entry numbers carry on across writeahead logs, each of which ends with the entry that
+		// creates the next one
+		assert.EqualValues(t, 2*numKeys-1, stepEntryNumbers[0])
+		assert.EqualValues(t, numKeys+1, stepEntryNumbers[1]-stepEntryNumbers[0])
+	})
+
+	assertRecovered := func(t *testing.T, args PointInTimeRecoveryArgs, expected string) {
+		t.Helper()
+
+		args.CheckpointDir = checkpointDir
+		args.TargetDir = filepath.Join(dir, "recovered")
+		defer os.RemoveAll(args.TargetDir)
+		require.NoError(t, RecoverToPointInTime(args))
+
+		recovered, err := Open(OpenArgs{
+			Path:           args.TargetDir,
+			IndexChunkSize: util.Some(uint64(100)),
+		})
+		require.NoError(t, err)
+		require.NoError(t, recovered.Start())
+		defer recovered.Close()
+
+		for i := range numKeys {
+			entry, exists, err := recovered.Lookup([]byte(fmt.Sprintf("key %03d", i)))
+			_ = assert.NoError(t, err) && assert.True(t, exists) &&
+				assert.Equal(t, expected, string(entry.Value))
+		}
+
+		// the recovered database takes writes of its own
+		require.NoError(t, recovered.Upsert([]byte("key"), []byte("value")))
+		require.NoError(t, recovered.CreateSSTable())
+		waitForCompaction(t, recovered, 10)
+	}
+
+	t.Run("to a timestamp", func(t *testing.T) {
+		for i, value := range steps {
+			loggedAt := start.Add(time.Duration(i+1) * time.Minute)
+			assertRecovered(t, PointInTimeRecoveryArgs{
+				WriteAheadLogDirs: []string{archiveDir},
+				Timestamp:         util.Some(loggedAt.Add(time.Second)),
+			}, value)
+		}
+		assertRecovered(t, PointInTimeRecoveryArgs{
+			WriteAheadLogDirs: []string{archiveDir},
+			Timestamp:         util.Some(start.Add(30 * time.Second)),
+		}, "zero")
+	})
+
+	t.Run("to an entry number", func(t *testing.T) {
+		for i, value := range steps {
+			assertRecovered(t, PointInTimeRecoveryArgs{
+				WriteAheadLogDirs: []string{archiveDir},
+				EntryNumber:       util.Some(stepEntryNumbers[i]),
+			}, value)
+		}
+		// the last key of the step has not been written yet
+		args := PointInTimeRecoveryArgs{
+			CheckpointDir:     checkpointDir,
+			WriteAheadLogDirs: []string{archiveDir},
+			TargetDir:         filepath.Join(dir, "partial"),
+			EntryNumber:       util.Some(stepEntryNumbers[1] - 1),
+		}
+		require.NoError(t, RecoverToPointInTime(args))
+		recovered, err := Open(OpenArgs{Path: args.TargetDir})
+		require.NoError(t, err)
+		require.NoError(t, recovered.Start())
+		defer recovered.Close()
+		entry, _, err := recovered.Lookup([]byte(fmt.Sprintf("key %03d", numKeys-1)))
+		_ = assert.NoError(t, err) && assert.Equal(t, "one", string(entry.Value))
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		assertRecovered(t, PointInTimeRecoveryArgs{
+			WriteAheadLogDirs: []string{archiveDir},
+		}, "three")
+		// the live writeahead log is only replayed if the database directory is included
+		assertRecovered(t, PointInTimeRecoveryArgs{
+			WriteAheadLogDirs: []string{archiveDir, openArgs.Path},
+		}, "live")
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		targetDir := filepath.Join(dir, "failed")
+
+		assert.Error(t, RecoverToPointInTime(PointInTimeRecoveryArgs{
+			CheckpointDir:     checkpointDir,
+			WriteAheadLogDirs: []string{archiveDir},
+			TargetDir:         targetDir,
+			Timestamp:         util.Some(start.Add(-time.Minute)),
+		}), "the target precedes the checkpoint")
+		assert.NoDirExists(t, targetDir)
+
+		assert.Error(t, RecoverToPointInTime(PointInTimeRecoveryArgs{
+			CheckpointDir:     checkpointDir,
+			WriteAheadLogDirs: []string{archiveDir},
+			TargetDir:         checkpointDir,
+		}), "the target directory exists")
+
+		require.NoError(t, os.Remove(filepath.Join(archiveDir, "writeahead_log_2.jrn")))
+		assert.Error(t, RecoverToPointInTime(PointInTimeRecoveryArgs{
+			CheckpointDir:     checkpointDir,
+			WriteAheadLogDirs: []string{archiveDir},
+			TargetDir:         targetDir,
+		}), "a writeahead log is missing")
+		assert.NoDirExists(t, targetDir)
+	})
+}
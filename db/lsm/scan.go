@@ -0,0 +1,236 @@
+package lsm
+
+import (
+	"iter"
+	"slices"
+	"time"
+
+	"github.com/navijation/njsimple/storage/sstable"
+	"github.com/navijation/njsimple/util"
+)
+
+// Scan returns an iterator over all live key-value pairs with keys in [start, end), in key order.
+// A nil start or end leaves that side of the range unbounded. Deleted keys are skipped.
+//
+// The in-memory indexes and SSTables are captured when iteration begins, so an SSTable being
+// created in the background does not cause keys to be skipped or repeated.
+func (me *LSMDB) Scan(start, end []byte) iter.Seq2[KeyValuePair, error] {
+	return me.defaultFamily.ScanAt(start, end, nil)
+}
+
+// ScanAt is like Scan, but reads the versions visible to the given snapshot. A nil snapshot reads
+// the latest versions as of when iteration begins.
+func (me *LSMDB) ScanAt(start, end []byte, snapshot *Snapshot) iter.Seq2[KeyValuePair, error] {
+	return me.defaultFamily.ScanAt(start, end, snapshot)
+}
+
+// Scan returns an iterator over the live key-value pairs of the column family with keys in
+// [start, end), like LSMDB.Scan.
+func (me *ColumnFamily) Scan(start, end []byte) iter.Seq2[KeyValuePair, error] {
+	return me.ScanAt(start, end, nil)
+}
+
+// ScanAt is like Scan, but reads the versions visible to the given snapshot.
+func (me *ColumnFamily) ScanAt(
+	start, end []byte, snapshot *Snapshot,
+) iter.Seq2[KeyValuePair, error] {
+	return func(yield func(KeyValuePair, error) bool) {
+		sources, err := me.db.captureReadSources(me, start, snapshot)
+		if err != nil {
+			yield(KeyValuePair{}, err)
+			return
+		}
+		defer sources.release()
+
+		mux, stop, err := sources.forwardMux(start)
+		defer stop()
+		if err != nil {
+			yield(KeyValuePair{}, err)
+			return
+		}
+
+		for {
+			entry, hasNext, err := mux.NextEntry()
+			if err != nil {
+				yield(KeyValuePair{}, err)
+				return
+			}
+			if !hasNext {
+				return
+			}
+			if end != nil && me.comparator.Compare(entry.Key, end) >= 0 {
+				return
+			}
+			if entry.IsDeleted {
+				continue
+			}
+			if !yield(entry.ToKeyValuePair(), nil) {
+				return
+			}
+		}
+	}
+}
+
+// readSources is a point-in-time capture of every in-memory index and SSTable, newest first.
+// In-memory indexes are read as writers go on updating them, but the versions visible at
+// sequenceNumber are pinned, and newer ones are skipped.
+type readSources struct {
+	memtables []*InMemoryIndex
+	sstables  []*sstable.SSTable
+	// no key less than start is read
+	start []byte
+	// versions with higher sequence numbers are not visible to the reader
+	sequenceNumber uint64
+	// versions that expire by this time read as deleted
+	now           time.Time
+	mergeOperator MergeOperator
+	comparator    Comparator
+	// allows the captured SSTables to be deleted once they have been merged, and the pinned
+	// versions to be discarded; must be called exactly once
+	release func()
+}
+
+// captureReadSources captures the in-memory indexes of a column family along with its current
+// list of SSTables, for reading keys from start on. A nil start reads from the first key. A nil
+// snapshot captures the latest versions.
+func (me *LSMDB) captureReadSources(
+	family *ColumnFamily, start []byte, snapshot *Snapshot,
+) (out readSources, _ error) {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	if err := me.checkColumnFamily(family); err != nil {
+		return out, err
+	}
+
+	out.start = start
+	out.sequenceNumber = me.lastSequenceNumber
+	out.now = me.clock()
+	out.mergeOperator = family.mergeOperator
+	out.comparator = family.comparator
+	if snapshot != nil {
+		sequenceNumber, err := me.readSequenceNumber(snapshot)
+		if err != nil {
+			return out, err
+		}
+		out.sequenceNumber = sequenceNumber
+	}
+
+	out.memtables = slices.Clone(family.inMemoryIndexes)
+	out.sstables = slices.Clone(family.sstables)
+
+	me.acquireSSTables(out.sstables)
+	// writers would otherwise discard versions that are still visible to the reader
+	me.pinLock.Lock()
+	me.readPins[out.sequenceNumber]++
+	me.pinLock.Unlock()
+
+	out.release = func() {
+		ctx := &dbCtx{}
+		ctx.Lock(&me.lock)
+		defer ctx.Unlock(&me.lock)
+
+		if me.readPins[out.sequenceNumber]--; me.readPins[out.sequenceNumber] == 0 {
+			delete(me.readPins, out.sequenceNumber)
+		}
+		me.releaseSSTables(ctx, out.sstables)
+	}
+
+	return out, nil
+}
+
+// forwardMux merges all sources, starting at the first key greater than or equal to start, into
+// a single newest-wins stream in ascending key order. The returned stop function must always be
+// called.
+func (me *readSources) forwardMux(start []byte) (_ sstable.IteratorMux, stop func(), _ error) {
+	tableEntries := func(table *sstable.SSTable) iter.Seq2[sstable.SSTableEntry, error] {
+		return table.EntriesFrom(start)
+	}
+	memtableEntries := func(index *InMemoryIndex) iter.Seq[KeyValuePair] {
+		return index.EntriesFrom(start)
+	}
+
+	return me.mux(false, tableEntries, memtableEntries)
+}
+
+// reverseMux merges all sources, starting at the last key less than or equal to end, into a
+// single newest-wins stream in descending key order. A nil end starts from the last key. The
+// returned stop function must always be called.
+func (me *readSources) reverseMux(end []byte) (_ sstable.IteratorMux, stop func(), _ error) {
+	tableEntries := func(table *sstable.SSTable) iter.Seq2[sstable.SSTableEntry, error] {
+		return table.ReverseEntriesFrom(end)
+	}
+	memtableEntries := func(index *InMemoryIndex) iter.Seq[KeyValuePair] {
+		return func(yield func(KeyValuePair) bool) {
+			for kvp := range index.ReverseEntriesFrom(end) {
+				if me.start != nil && me.comparator.Compare(kvp.Key, me.start) < 0 {
+					return
+				}
+				if !yield(kvp) {
+					return
+				}
+			}
+		}
+	}
+
+	return me.mux(true, tableEntries, memtableEntries)
+}
+
+func (me *readSources) mux(
+	reverse bool,
+	tableEntries func(*sstable.SSTable) iter.Seq2[sstable.SSTableEntry, error],
+	memtableEntries func(*InMemoryIndex) iter.Seq[KeyValuePair],
+) (_ sstable.IteratorMux, stop func(), _ error) {
+	var stops []func()
+	stop = func() {
+		for _, stopSource := range stops {
+			stopSource()
+		}
+	}
+
+	mux := sstable.NewIteratorMux(sstable.IteratorMuxArgs{
+		Comparator:        me.comparator,
+		Reverse:           reverse,
+		MaxSequenceNumber: util.Some(me.sequenceNumber),
+		Now:               util.Some(me.now),
+		// every version of every key in range is captured
+		MergeOperator:        me.mergeOperator,
+		FullMergeWithoutBase: true,
+	})
+
+	// add the oldest sources first, so that newer sources win ties
+	for _, table := range slices.Backward(me.sstables) {
+		next, stopTable := iter.Pull2(tableEntries(table))
+		stops = append(stops, stopTable)
+
+		if err := mux.AddIterator(next); err != nil {
+			return mux, stop, err
+		}
+	}
+
+	for _, memtable := range slices.Backward(me.memtables) {
+		next, stopMemtable := iter.Pull(memtableEntries(memtable))
+		stops = append(stops, stopMemtable)
+
+		if err := mux.AddIterator(func() (out sstable.SSTableEntry, _ error, _ bool) {
+			kvp, ok := next()
+			if !ok {
+				return out, nil, false
+			}
+			return sstable.SSTableEntry{
+				KeySize:        uint64(len(kvp.Key)),
+				ValueSize:      uint64(len(kvp.Value)),
+				Key:            kvp.Key,
+				Value:          kvp.Value,
+				IsDeleted:      kvp.IsDeleted,
+				SequenceNumber: kvp.SequenceNumber,
+				ExpiresAt:      kvp.ExpiresAt,
+				IsMergeOperand: kvp.IsMergeOperand,
+			}, nil, true
+		}); err != nil {
+			return mux, stop, err
+		}
+	}
+
+	return mux, stop, nil
+}
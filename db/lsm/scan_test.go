@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"fmt"
+	"iter"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Scan(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Scan")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	for i := range 50 {
+		require.NoError(t, db.Upsert(
+			[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("old %d", i))),
+		)
+	}
+	require.NoError(t, db.CreateSSTable())
+
+	// overwrite and delete some keys while the first SSTable may still be in flight
+	for i := range 50 {
+		switch {
+		case i%5 == 0:
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key %03d", i))))
+		case i%2 == 0:
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("new %d", i))),
+			)
+		}
+	}
+
+	collect := func(start, end []byte) (keys, values []string) {
+		for kvp, err := range db.Scan(start, end) {
+			require.NoError(t, err)
+			keys = append(keys, string(kvp.Key))
+			values = append(values, string(kvp.Value))
+		}
+		return keys, values
+	}
+
+	expected := func(lo, hi int) (keys, values []string) {
+		for i := lo; i < hi; i++ {
+			switch {
+			case i%5 == 0:
+				continue
+			case i%2 == 0:
+				values = append(values, fmt.Sprintf("new %d", i))
+			default:
+				values = append(values, fmt.Sprintf("old %d", i))
+			}
+			keys = append(keys, fmt.Sprintf("key %03d", i))
+		}
+		return keys, values
+	}
+
+	t.Run("full range", func(t *testing.T) {
+		keys, values := collect(nil, nil)
+		expectedKeys, expectedValues := expected(0, 50)
+		assert.Equal(t, expectedKeys, keys)
+		assert.Equal(t, expectedValues, values)
+	})
+
+	t.Run("bounded range", func(t *testing.T) {
+		keys, values := collect([]byte("key 012"), []byte("key 031"))
+		expectedKeys, expectedValues := expected(12, 31)
+		assert.Equal(t, expectedKeys, keys)
+		assert.Equal(t, expectedValues, values)
+	})
+
+	require.NoError(t, db.CreateSSTable())
+
+	t.Run("range after second SSTable", func(t *testing.T) {
+		keys, values := collect([]byte("key 040"), nil)
+		expectedKeys, expectedValues := expected(40, 50)
+		assert.Equal(t, expectedKeys, keys)
+		assert.Equal(t, expectedValues, values)
+	})
+
+	t.Run("empty range", func(t *testing.T) {
+		keys, _ := collect([]byte("key 031"), []byte("key 012"))
+		assert.Empty(t, keys)
+	})
+
+	t.Run("early break", func(t *testing.T) {
+		var count int
+		for _, err := range db.Scan(nil, nil) {
+			require.NoError(t, err)
+			count++
+			if count == 3 {
+				break
+			}
+		}
+		assert.Equal(t, 3, count)
+	})
+	t.Run("writes during scan", func(t *testing.T) {
+		for i := range 10 {
+			require.NoError(t, db.Upsert([]byte(fmt.Sprintf("live %03d", i)), []byte("before")))
+		}
+
+		next, stop := iter.Pull2(db.Scan([]byte("live"), []byte("livf")))
+		defer stop()
+		kvp, err, ok := next()
+		require.True(t, ok)
+		require.NoError(t, err)
+		assert.Equal(t, "live 000", string(kvp.Key))
+
+		// the in-memory index is read as the scan goes, but only the versions that existed when
+		// it began are visible
+		for i := range 10 {
+			key := []byte(fmt.Sprintf("live %03d", i))
+			require.NoError(t, db.Upsert(key, []byte("after")))
+			require.NoError(t, db.Upsert([]byte(fmt.Sprintf("live %03d new", i)), []byte("after")))
+		}
+		for i := 1; i < 10; i++ {
+			kvp, err, ok := next()
+			require.True(t, ok)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("live %03d", i), string(kvp.Key))
+			assert.Equal(t, "before", string(kvp.Value))
+		}
+		_, _, ok = next()
+		assert.False(t, ok)
+
+		db.lock.RLock()
+		assert.Empty(t, db.readPins, "the scan releases its pin once done")
+		db.lock.RUnlock()
+	})
+}
@@ -0,0 +1,80 @@
+package lsm
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Snapshot is a consistent, read-only view of an LSMDB as of the moment it was created. Versions
+// of keys visible to a snapshot are preserved until the snapshot is released.
+type Snapshot struct {
+	db             *LSMDB
+	sequenceNumber uint64
+}
+
+func (me *LSMDB) NewSnapshot() *Snapshot {
+	ctx := &dbCtx{}
+
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	snapshot := &Snapshot{
+		db:             me,
+		sequenceNumber: me.lastSequenceNumber,
+	}
+	me.snapshots[snapshot] = struct{}{}
+
+	return snapshot
+}
+
+// Return the sequence number of the latest write visible to the snapshot.
+func (me *Snapshot) SequenceNumber() uint64 {
+	return me.sequenceNumber
+}
+
+// Release the snapshot, allowing versions only it can see to be discarded. The snapshot must not
+// be used afterwards.
+func (me *Snapshot) Release() {
+	ctx := &dbCtx{}
+
+	ctx.Lock(&me.db.lock)
+	defer ctx.Unlock(&me.db.lock)
+
+	delete(me.db.snapshots, me)
+}
+
+// liveSnapshots returns the sorted sequence numbers of all unreleased snapshots, including those
+// pinned by scans and cursors.
+func (me *LSMDB) liveSnapshots(ctx *dbCtx) []uint64 {
+	ctx.RLock(&me.lock)
+	defer ctx.RUnlock(&me.lock)
+	me.pinLock.Lock()
+	defer me.pinLock.Unlock()
+
+	out := make([]uint64, 0, len(me.snapshots)+len(me.readPins))
+	for snapshot := range me.snapshots {
+		out = append(out, snapshot.sequenceNumber)
+	}
+	for sequenceNumber := range me.readPins {
+		out = append(out, sequenceNumber)
+	}
+	slices.Sort(out)
+
+	return slices.Compact(out)
+}
+
+// readSequenceNumber returns the highest sequence number a read through the given snapshot may
+// observe. The caller must hold the lock.
+func (me *LSMDB) readSequenceNumber(snapshot *Snapshot) (uint64, error) {
+	if snapshot == nil {
+		return math.MaxUint64, nil
+	}
+	if snapshot.db != me {
+		return 0, fmt.Errorf("snapshot belongs to a different database")
+	}
+	if _, ok := me.snapshots[snapshot]; !ok {
+		return 0, fmt.Errorf("snapshot was released")
+	}
+	return snapshot.sequenceNumber, nil
+}
@@ -0,0 +1,131 @@
+package lsm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Snapshot")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	for i := range 20 {
+		require.NoError(t, db.Upsert(
+			[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("old %d", i))),
+		)
+	}
+
+	snapshot := db.NewSnapshot()
+	assert.EqualValues(t, 20, snapshot.SequenceNumber())
+
+	// overwrite even keys, delete multiples of 3, and add new keys after the snapshot
+	for i := range 25 {
+		switch {
+		case i%3 == 0:
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key %03d", i))))
+		case i%2 == 0:
+			require.NoError(t, db.Upsert(
+				[]byte(fmt.Sprintf("key %03d", i)), []byte(fmt.Sprintf("new %d", i))),
+			)
+		}
+	}
+
+	assertSnapshotReads := func(t *testing.T) {
+		t.Run("lookup", func(t *testing.T) {
+			for i := range 25 {
+				key := []byte(fmt.Sprintf("key %03d", i))
+				entry, exists, err := db.LookupAt(key, snapshot)
+				require.NoError(t, err)
+				if i >= 20 {
+					assert.False(t, exists, string(key))
+					continue
+				}
+				if assert.True(t, exists, string(key)) {
+					assert.Equal(t, fmt.Sprintf("old %d", i), string(entry.Value))
+					assert.False(t, entry.IsDeleted)
+				}
+			}
+		})
+
+		t.Run("scan", func(t *testing.T) {
+			var values []string
+			for kvp, err := range db.ScanAt(nil, nil, snapshot) {
+				require.NoError(t, err)
+				values = append(values, string(kvp.Value))
+			}
+			var expected []string
+			for i := range 20 {
+				expected = append(expected, fmt.Sprintf("old %d", i))
+			}
+			assert.Equal(t, expected, values)
+		})
+
+		t.Run("cursor", func(t *testing.T) {
+			cursor := db.NewCursor(CursorArgs{Snapshot: snapshot})
+			defer cursor.Close()
+
+			var values []string
+			for ok := cursor.Last(); ok; ok = cursor.Prev() {
+				values = append(values, string(cursor.Entry().Value))
+			}
+			require.NoError(t, cursor.Err())
+			if assert.Len(t, values, 20) {
+				assert.Equal(t, "old 19", values[0])
+				assert.Equal(t, "old 0", values[19])
+			}
+		})
+
+		t.Run("latest", func(t *testing.T) {
+			entry, exists, err := db.Lookup([]byte("key 004"))
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, "new 4", string(entry.Value))
+			}
+			entry, exists, err = db.Lookup([]byte("key 003"))
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.True(t, entry.IsDeleted)
+			}
+		})
+	}
+
+	t.Run("before flush", assertSnapshotReads)
+
+	require.NoError(t, db.CreateSSTable())
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("after flush", assertSnapshotReads)
+
+	snapshot.Release()
+
+	t.Run("released", func(t *testing.T) {
+		_, _, err := db.LookupAt([]byte("key 001"), snapshot)
+		assert.Error(t, err)
+
+		for _, err := range db.ScanAt(nil, nil, snapshot) {
+			assert.Error(t, err)
+		}
+
+		cursor := db.NewCursor(CursorArgs{Snapshot: snapshot})
+		defer cursor.Close()
+		assert.False(t, cursor.First())
+		assert.Error(t, cursor.Err())
+	})
+}
@@ -0,0 +1,158 @@
+package lsm
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navijation/njsimple/storage/sstable"
+)
+
+// Stats is a point-in-time view of the counters and gauges of an LSMDB. Counters and histograms
+// cover the time since the database was opened.
+type Stats struct {
+	// Bytes appended to the writeahead logs, including the framing of each entry
+	WriteAheadLogBytesWritten uint64
+	// Durations in seconds of syncing the writeahead logs to disk
+	WriteAheadLogSyncs Histogram
+	// Live column families, sorted by ID so that the default column family comes first
+	ColumnFamilies []ColumnFamilyStats
+	// Number of SSTables probed by each lookup, including those whose bloom filter then rules the
+	// key out; SSTables whose key range rules the key out are not counted
+	LookupSSTablesProbed Histogram
+	// Durations in seconds of writing an in-memory index to a new SSTable
+	Flushes Histogram
+	// Durations in seconds of merging SSTables into a new SSTable
+	Merges     Histogram
+	BlockCache sstable.BlockCacheStats
+	// Error that stopped the database from accepting writes, if any
+	StateErr error
+}
+
+type ColumnFamilyStats struct {
+	Name string
+	// Sizes in bytes of the in-memory indexes, starting with the one being written to and followed
+	// by those waiting to be flushed
+	InMemoryIndexSizes []uint64
+	SSTables           int
+	// Total size of the SSTable files, including their bloom filters
+	SSTableBytes uint64
+}
+
+// Histogram is a distribution of observed values, like a Prometheus histogram.
+type Histogram struct {
+	Count uint64
+	Sum   float64
+	// Cumulative counts by ascending upper bound; the last bucket has an infinite upper bound
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket counts the observed values less than or equal to its upper bound.
+type HistogramBucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+var (
+	durationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+	probeBuckets    = []float64{0, 1, 2, 4, 8, 16, 32}
+)
+
+// dbStats collects the counters and histograms reported by Stats. It is safe for concurrent use,
+// so that it can be updated without holding the DB lock.
+type dbStats struct {
+	writeAheadLogBytesWritten atomic.Uint64
+	writeAheadLogSyncs        *histogram
+	lookupSSTablesProbed      *histogram
+	flushes                   *histogram
+	merges                    *histogram
+}
+
+func newDBStats() *dbStats {
+	return &dbStats{
+		writeAheadLogSyncs:   newHistogram(durationBuckets),
+		lookupSSTablesProbed: newHistogram(probeBuckets),
+		flushes:              newHistogram(durationBuckets),
+		merges:               newHistogram(durationBuckets),
+	}
+}
+
+func (me *dbStats) observeWriteAheadLogSync(duration time.Duration) {
+	me.writeAheadLogSyncs.observe(duration.Seconds())
+}
+
+type histogram struct {
+	lock        sync.Mutex
+	upperBounds []float64
+	// counts of the values in each bucket, not including the lower buckets; the last count is of
+	// the values above every upper bound
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func (me *histogram) observe(value float64) {
+	bucket, _ := slices.BinarySearch(me.upperBounds, value)
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	me.counts[bucket]++
+	me.sum += value
+}
+
+func (me *histogram) snapshot() (out Histogram) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	out.Sum = me.sum
+	out.Buckets = make([]HistogramBucket, len(me.counts))
+	for i, count := range me.counts {
+		out.Count += count
+		out.Buckets[i] = HistogramBucket{UpperBound: math.Inf(1), Count: out.Count}
+		if i < len(me.upperBounds) {
+			out.Buckets[i].UpperBound = me.upperBounds[i]
+		}
+	}
+	return out
+}
+
+// Return the current counters and gauges of the database.
+func (me *LSMDB) Stats() Stats {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+
+	out := Stats{
+		WriteAheadLogBytesWritten: me.stats.writeAheadLogBytesWritten.Load(),
+		WriteAheadLogSyncs:        me.stats.writeAheadLogSyncs.snapshot(),
+		LookupSSTablesProbed:      me.stats.lookupSSTablesProbed.snapshot(),
+		Flushes:                   me.stats.flushes.snapshot(),
+		Merges:                    me.stats.merges.snapshot(),
+		BlockCache:                me.blockCache.Stats(),
+		StateErr:                  me.stateErr,
+	}
+
+	for _, family := range me.liveColumnFamilies() {
+		familyStats := ColumnFamilyStats{
+			Name:     family.name,
+			SSTables: len(family.sstables),
+		}
+		for _, index := range family.inMemoryIndexes {
+			familyStats.InMemoryIndexSizes = append(familyStats.InMemoryIndexSizes, index.SizeOf())
+		}
+		for _, table := range family.sstables {
+			familyStats.SSTableBytes += sstableSize(table)
+		}
+		out.ColumnFamilies = append(out.ColumnFamilies, familyStats)
+	}
+
+	return out
+}
@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Stats(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Stats")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		SizeTieredCompaction: util.Some(SizeTieredCompactionArgs{
+			MinMergeWidth: util.Some(2),
+		}),
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	_, err = db.CreateColumnFamily("users", ColumnFamilyOptions{})
+	require.NoError(t, err)
+
+	const numKeys = 20
+	for i := range numKeys {
+		require.NoError(t, db.Upsert([]byte(fmt.Sprintf("key %03d", i)), []byte("value")))
+		if i%10 == 9 {
+			require.NoError(t, db.CreateSSTable())
+		}
+	}
+	waitForCompaction(t, db, 1)
+	require.NoError(t, db.Upsert([]byte("key"), []byte("value")))
+
+	_, exists, err := db.Lookup([]byte("key 000"))
+	_ = assert.NoError(t, err) && assert.True(t, exists)
+	_, exists, err = db.Lookup([]byte("key"))
+	_ = assert.NoError(t, err) && assert.True(t, exists)
+
+	t.Run("stats", func(t *testing.T) {
+		stats := db.Stats()
+
+		assert.NotZero(t, stats.WriteAheadLogBytesWritten)
+		assert.GreaterOrEqual(t, stats.WriteAheadLogSyncs.Count, uint64(numKeys))
+		assert.EqualValues(t, 2, stats.Flushes.Count)
+		assert.EqualValues(t, 1, stats.Merges.Count)
+		assert.NoError(t, stats.StateErr)
+
+		// the first lookup read the merged SSTable, and the second was served from memory
+		assert.EqualValues(t, 2, stats.LookupSSTablesProbed.Count)
+		assert.EqualValues(t, 1, stats.LookupSSTablesProbed.Sum)
+		if assert.NotEmpty(t, stats.LookupSSTablesProbed.Buckets) {
+			assert.Equal(t, HistogramBucket{UpperBound: 0, Count: 1},
+				stats.LookupSSTablesProbed.Buckets[0])
+			lastBucket := stats.LookupSSTablesProbed.Buckets[len(stats.LookupSSTablesProbed.Buckets)-1]
+			assert.EqualValues(t, 2, lastBucket.Count)
+		}
+
+		if assert.Len(t, stats.ColumnFamilies, 2) {
+			defaultStats := stats.ColumnFamilies[0]
+			assert.Equal(t, defaultColumnFamilyName, defaultStats.Name)
+			assert.Equal(t, 1, defaultStats.SSTables)
+			assert.NotZero(t, defaultStats.SSTableBytes)
+			if assert.Len(t, defaultStats.InMemoryIndexSizes, 1) {
+				assert.NotZero(t, defaultStats.InMemoryIndexSizes[0])
+			}
+
+			assert.Equal(t, ColumnFamilyStats{
+				Name:               "users",
+				InMemoryIndexSizes: []uint64{0},
+			}, stats.ColumnFamilies[1])
+		}
+	})
+
+	t.Run("prometheus handler", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		db.StatsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+		response := recorder.Result()
+		assert.Equal(t, prometheusContentType, response.Header.Get("Content-Type"))
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+
+		for _, line := range []string{
+			"# TYPE njsimple_wal_bytes_written_total counter\n",
+			"# TYPE njsimple_wal_sync_duration_seconds histogram\n",
+			`njsimple_sstables{column_family="default"} 1` + "\n",
+			`njsimple_sstables{column_family="users"} 0` + "\n",
+			`njsimple_lookup_sstables_probed_bucket{le="0"} 1` + "\n",
+			`njsimple_lookup_sstables_probed_bucket{le="+Inf"} 2` + "\n",
+			"njsimple_lookup_sstables_probed_sum 1\n",
+			"njsimple_lookup_sstables_probed_count 2\n",
+			"njsimple_flush_duration_seconds_count 2\n",
+			"njsimple_merge_duration_seconds_count 1\n",
+			"njsimple_state_error 0\n",
+		} {
+			assert.Contains(t, string(body), line)
+		}
+	})
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, `a\\b\"c\nd`, escapeLabelValue("a\\b\"c\nd"))
+}
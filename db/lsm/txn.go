@@ -0,0 +1,118 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/navijation/njsimple/storage/keyvaluepair"
+)
+
+// Txn is an optimistic read-write transaction. Reads are served from a snapshot taken when the
+// transaction begins, and writes are buffered until Commit. Commit fails with a
+// *TxnConflictError if any key read by the transaction was written by someone else in the
+// meantime.
+//
+// A transaction is not safe for concurrent use, and must be committed or rolled back once it is
+// no longer needed.
+type Txn struct {
+	db       *LSMDB
+	snapshot *Snapshot
+	// sequence number of the version of each key observed by the transaction, or 0 if the key
+	// did not exist
+	reads    map[string]uint64
+	writes   WriteBatch
+	finished bool
+}
+
+// TxnConflictError is returned by Txn.Commit when a key read by the transaction was modified by
+// another writer after the transaction began.
+type TxnConflictError struct {
+	Key []byte
+}
+
+func (me *TxnConflictError) Error() string {
+	return fmt.Sprintf("transaction conflict on key %q", me.Key)
+}
+
+func (me *LSMDB) Begin() *Txn {
+	return &Txn{
+		db:       me,
+		snapshot: me.NewSnapshot(),
+		reads:    map[string]uint64{},
+	}
+}
+
+// Lookup a key as of the start of the transaction, including the transaction's own writes. Keys
+// read from the database are checked for conflicts on commit.
+func (me *Txn) Get(key []byte) (out keyvaluepair.KeyValuePair, exists bool, _ error) {
+	if me.finished {
+		return out, false, fmt.Errorf("transaction is already finished")
+	}
+
+	// the latest buffered write to a key wins
+	for _, kvp := range slices.Backward(me.writes.keyValues) {
+		if bytes.Equal(kvp.Key, key) {
+			return kvp, true, nil
+		}
+	}
+
+	out, exists, err := me.db.LookupAt(key, me.snapshot)
+	if err != nil {
+		return out, false, err
+	}
+
+	if _, alreadyRead := me.reads[string(key)]; !alreadyRead {
+		me.reads[string(key)] = out.SequenceNumber
+	}
+
+	return out, exists, nil
+}
+
+// Buffer an upsert of a key-value pair until commit.
+func (me *Txn) Put(key, value []byte) {
+	me.writes.Put(key, value)
+}
+
+// Buffer a deletion of a key until commit.
+func (me *Txn) Delete(key []byte) {
+	me.writes.Delete(key)
+}
+
+// Commit atomically applies all buffered writes as part of a single writeahead log entry, unless a
+// key read by the transaction has since been modified, in which case nothing is written and a
+// *TxnConflictError is returned. The transaction is finished either way.
+func (me *Txn) Commit() error {
+	if me.finished {
+		return fmt.Errorf("transaction is already finished")
+	}
+	defer me.Rollback()
+
+	return me.db.write(&pendingWrite{
+		keyValues: me.writes.keyValues,
+		// checked after any stall for flushes, which releases the lock
+		precondition: func(ctx *dbCtx) error {
+			for key, sequenceNumber := range me.reads {
+				latest, _, err := me.db.lookup(me.db.defaultFamily, []byte(key), math.MaxUint64)
+				if err != nil {
+					return err
+				}
+				if latest.SequenceNumber != sequenceNumber {
+					return &TxnConflictError{Key: []byte(key)}
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// Discard all buffered writes and release the transaction's snapshot. Rolling back a finished
+// transaction does nothing.
+func (me *Txn) Rollback() {
+	if me.finished {
+		return
+	}
+	me.finished = true
+	me.snapshot.Release()
+}
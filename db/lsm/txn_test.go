@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Txn(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Txn")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+	defer db.Close()
+
+	require.NoError(t, db.Upsert([]byte("key1"), []byte("value1")))
+	require.NoError(t, db.Upsert([]byte("key2"), []byte("value2")))
+
+	t.Run("commit", func(t *testing.T) {
+		txn := db.Begin()
+
+		entry, exists, err := txn.Get([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value1", string(entry.Value))
+
+		txn.Put([]byte("key1"), []byte("value1+"))
+		txn.Delete([]byte("key2"))
+
+		// reads observe the transaction's own writes, but nobody else does until commit
+		entry, exists, err = txn.Get([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value1+", string(entry.Value))
+		entry, exists, err = db.Lookup([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value1", string(entry.Value))
+
+		require.NoError(t, txn.Commit())
+
+		entry, exists, err = db.Lookup([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "value1+", string(entry.Value))
+		entry, exists, err = db.Lookup([]byte("key2"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.True(t, entry.IsDeleted)
+
+		_, _, err = txn.Get([]byte("key1"))
+		assert.Error(t, err)
+		assert.Error(t, txn.Commit())
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		txn := db.Begin()
+
+		_, _, err := txn.Get([]byte("key1"))
+		require.NoError(t, err)
+		txn.Put([]byte("key1"), []byte("from txn"))
+
+		require.NoError(t, db.Upsert([]byte("key1"), []byte("from writer")))
+
+		err = txn.Commit()
+		var conflictErr *TxnConflictError
+		if assert.True(t, errors.As(err, &conflictErr)) {
+			assert.Equal(t, []byte("key1"), conflictErr.Key)
+		}
+
+		entry, exists, err := db.Lookup([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "from writer", string(entry.Value))
+	})
+
+	t.Run("conflict on created key", func(t *testing.T) {
+		txn := db.Begin()
+
+		_, exists, err := txn.Get([]byte("key3"))
+		require.NoError(t, err)
+		assert.False(t, exists)
+		txn.Put([]byte("key3"), []byte("from txn"))
+
+		require.NoError(t, db.Upsert([]byte("key3"), []byte("from writer")))
+
+		var conflictErr *TxnConflictError
+		assert.ErrorAs(t, txn.Commit(), &conflictErr)
+	})
+
+	t.Run("no conflict on unread key", func(t *testing.T) {
+		txn := db.Begin()
+
+		_, _, err := txn.Get([]byte("key1"))
+		require.NoError(t, err)
+		txn.Put([]byte("key4"), []byte("from txn"))
+
+		require.NoError(t, db.Upsert([]byte("key2"), []byte("from writer")))
+
+		require.NoError(t, txn.Commit())
+
+		entry, exists, err := db.Lookup([]byte("key4"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, "from txn", string(entry.Value))
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		txn := db.Begin()
+		txn.Put([]byte("key5"), []byte("from txn"))
+		txn.Rollback()
+		txn.Rollback()
+
+		_, exists, err := db.Lookup([]byte("key5"))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+		assert.Error(t, txn.Commit())
+	})
+
+	t.Run("concurrent increments", func(t *testing.T) {
+		require.NoError(t, db.Upsert([]byte("counter"), []byte("0")))
+
+		const numWorkers, numIncrements = 4, 25
+
+		var wg sync.WaitGroup
+		for range numWorkers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range numIncrements {
+					for {
+						txn := db.Begin()
+						entry, _, err := txn.Get([]byte("counter"))
+						if !assert.NoError(t, err) {
+							txn.Rollback()
+							return
+						}
+						count, _ := strconv.Atoi(string(entry.Value))
+						txn.Put([]byte("counter"), []byte(strconv.Itoa(count+1)))
+
+						err = txn.Commit()
+						var conflictErr *TxnConflictError
+						if errors.As(err, &conflictErr) {
+							continue
+						}
+						if !assert.NoError(t, err) {
+							return
+						}
+						break
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		entry, exists, err := db.Lookup([]byte("counter"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) &&
+			assert.Equal(t, strconv.Itoa(numWorkers*numIncrements), string(entry.Value))
+	})
+}
@@ -6,18 +6,20 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/navijation/njsimple/util"
 )
 
+// appendEntry appends an entry to the current writeahead log. Unless called by a write group
+// leader, the caller must have called waitForLogWriter since acquiring the lock.
 func (me *LSMDB) appendEntry(ctx *dbCtx, entry io.WriterTo) error {
 	ctx.Lock(&me.lock)
 	defer ctx.Unlock(&me.lock)
 
-	bytes, _ := util.ToBytes(entry)
-	if _, err := me.writeAheadLogs[0].AppendEntry(bytes); err != nil {
+	bytes := timestampJournalEntry(entry, me.clock())
+	journalEntry, err := me.writeAheadLogs[0].AppendEntry(bytes)
+	if err != nil {
 		return err
 	}
+	me.stats.writeAheadLogBytesWritten.Add(journalEntry.SizeOf())
 	return nil
 }
 
@@ -38,10 +40,6 @@ func (me *LSMDB) checkStateError(ctx *dbCtx) error {
 	return me.stateErr
 }
 
-func (me *LSMDB) sstablePath(tableNumber uint64) string {
-	return filepath.Join(me.path, fmt.Sprintf("sstable_%d.sst", tableNumber))
-}
-
 func (me *LSMDB) writeAheadLogPath(writeAheadLogNumber uint64) string {
 	return filepath.Join(me.path, fmt.Sprintf("writeahead_log_%d.jrn", writeAheadLogNumber))
 }
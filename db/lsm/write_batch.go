@@ -0,0 +1,81 @@
+package lsm
+
+import (
+	"github.com/navijation/njsimple/storage/keyvaluepair"
+)
+
+// WriteBatch collects writes to be applied atomically by LSMDB.Write. Writes to the same key
+// within a batch are applied in order, so the last one wins.
+type WriteBatch struct {
+	keyValues []keyvaluepair.KeyValuePair
+	// see pendingWrite
+	families []*ColumnFamily
+}
+
+// Queue an upsert of a key-value pair.
+func (me *WriteBatch) Put(key, value []byte) {
+	me.keyValues = append(me.keyValues, keyvaluepair.KeyValuePair{
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Queue a deletion of a key.
+func (me *WriteBatch) Delete(key []byte) {
+	me.keyValues = append(me.keyValues, keyvaluepair.KeyValuePair{
+		Key:       key,
+		IsDeleted: true,
+	})
+}
+
+// Queue an upsert of a key-value pair in the given column family.
+func (me *WriteBatch) PutCF(family *ColumnFamily, key, value []byte) {
+	me.Put(key, value)
+	me.setFamily(family)
+}
+
+// Queue a deletion of a key in the given column family.
+func (me *WriteBatch) DeleteCF(family *ColumnFamily, key []byte) {
+	me.Delete(key)
+	me.setFamily(family)
+}
+
+// setFamily sets the column family of the last queued write.
+func (me *WriteBatch) setFamily(family *ColumnFamily) {
+	me.families = append(me.families, make([]*ColumnFamily, len(me.keyValues)-len(me.families))...)
+	me.families[len(me.keyValues)-1] = family
+}
+
+// Return the number of queued writes.
+func (me *WriteBatch) Len() int {
+	return len(me.keyValues)
+}
+
+// Discard all queued writes so that the batch can be reused.
+func (me *WriteBatch) Reset() {
+	me.keyValues = me.keyValues[:0]
+	me.families = me.families[:0]
+}
+
+// Write applies all writes in the batch as part of a single writeahead log entry, which may be
+// shared with concurrent writers. After a crash, either all of the writes are recovered or none of
+// them are, and readers never observe a partially applied batch, even across column families.
+func (me *LSMDB) Write(batch *WriteBatch) error {
+	return me.write(&pendingWrite{keyValues: batch.keyValues, families: batch.families})
+}
+
+// processWriteBatchEntry applies every write in the batch while holding the lock, so that readers
+// see either none or all of them.
+func (me *LSMDB) processWriteBatchEntry(ctx *dbCtx, entry WriteBatchEntry) {
+	ctx.Lock(&me.lock)
+	defer ctx.Unlock(&me.lock)
+
+	snapshots := me.liveSnapshots(ctx)
+	for i, kvp := range entry.ToKeyValuePairs() {
+		// writes to dropped column families are discarded
+		if family, ok := me.families[entry.ColumnFamilyID(i)]; ok {
+			family.inMemoryIndexes[0].UpsertVersion(kvp, snapshots)
+		}
+		me.lastSequenceNumber = max(me.lastSequenceNumber, kvp.SequenceNumber)
+	}
+}
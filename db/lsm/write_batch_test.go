@@ -0,0 +1,103 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLSMDB_Write(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestLSMDB_Write")
+	cleanup()
+	defer cleanup()
+
+	db, err := Open(OpenArgs{
+		Path:           dir,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Start())
+
+	require.NoError(t, db.Upsert([]byte("key0"), []byte("value0")))
+
+	var batch WriteBatch
+	batch.Put([]byte("key1"), []byte("value1"))
+	batch.Put([]byte("key2"), []byte("value2"))
+	batch.Delete([]byte("key0"))
+	batch.Put([]byte("key1"), []byte("value1+"))
+	require.NoError(t, db.Write(&batch))
+
+	assertFirstBatch := func(t *testing.T, db *LSMDB) {
+		entry0, exists, err := db.Lookup([]byte("key0"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
+			Key:            []byte("key0"),
+			IsDeleted:      true,
+			SequenceNumber: 4,
+		}, entry0)
+
+		entry1, exists, err := db.Lookup([]byte("key1"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
+			Key:            []byte("key1"),
+			Value:          []byte("value1+"),
+			SequenceNumber: 5,
+		}, entry1)
+
+		entry2, exists, err := db.Lookup([]byte("key2"))
+		_ = assert.NoError(t, err) && assert.True(t, exists) && assert.Equal(t, KeyValuePair{
+			Key:            []byte("key2"),
+			Value:          []byte("value2"),
+			SequenceNumber: 3,
+		}, entry2)
+	}
+
+	t.Run("lookup after write", func(t *testing.T) {
+		assertFirstBatch(t, db)
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		numEntries := db.writeAheadLogs[0].NumEntries()
+		require.NoError(t, db.Write(&WriteBatch{}))
+		assert.Equal(t, numEntries, db.writeAheadLogs[0].NumEntries())
+	})
+
+	batch.Reset()
+	for i := range 10 {
+		batch.Put([]byte(fmt.Sprintf("key%d", i)), []byte("overwritten"))
+	}
+	require.NoError(t, db.Write(&batch))
+
+	writeAheadLogPath := db.writeAheadLogs[0].Path()
+	writeAheadLogSize := db.writeAheadLogs[0].Size()
+	require.NoError(t, db.Close())
+
+	// simulate a crash in the middle of appending the second batch
+	require.NoError(t, os.Truncate(writeAheadLogPath, int64(writeAheadLogSize)-10))
+
+	sameDB, err := Open(OpenArgs{
+		Path:           dir,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, sameDB.Start())
+	defer sameDB.Close()
+
+	t.Run("torn batch is not replayed", func(t *testing.T) {
+		assertFirstBatch(t, sameDB)
+
+		for i := 3; i < 10; i++ {
+			_, exists, err := sameDB.Lookup([]byte(fmt.Sprintf("key%d", i)))
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		}
+	})
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/navijation/njsimple/util"
 )
@@ -48,12 +49,22 @@ type JournalFile struct {
 
 	// indicates that there was a failed append that wasn't fully rolled back
 	isBad bool
+
+	syncPolicy SyncPolicy
+	// set with SyncPeriodically
+	syncer *backgroundSyncer
+	onSync func(time.Duration)
 }
 
 type OpenArgs struct {
 	Path    string
 	Create  bool
 	StartAt uint64
+	// When appended entries are synced to disk; defaults to syncing after every append.
+	SyncPolicy SyncPolicy
+	// Called with the duration of every sync of the file to disk, such as to collect metrics.
+	// It may be called from a background goroutine.
+	OnSync util.Optional[func(time.Duration)]
 }
 
 func Open(args OpenArgs) (out JournalFile, err error) {
@@ -79,11 +90,13 @@ func Open(args OpenArgs) (out JournalFile, err error) {
 	}
 
 	out = JournalFile{
-		header: journalFileHeader{},
-		path:   args.Path,
-		file:   file,
-		size:   uint64(fileInfo.Size()),
-		hash:   sha256.New(),
+		header:     journalFileHeader{},
+		path:       args.Path,
+		file:       file,
+		size:       uint64(fileInfo.Size()),
+		hash:       sha256.New(),
+		syncPolicy: args.SyncPolicy,
+		onSync:     args.OnSync.Or(nil),
 	}
 
 	fileW := out.fileWrapperAt(0)
@@ -100,14 +113,31 @@ func Open(args OpenArgs) (out JournalFile, err error) {
 		return out, err
 	}
 
+	if args.SyncPolicy.Mode == SyncPeriodically {
+		out.syncer = startBackgroundSyncer(file, args.SyncPolicy, out.onSync)
+	}
+
 	return out, err
 }
 
 func (me *JournalFile) Close() error {
+	var syncErr error
+	if me.syncer != nil {
+		syncErr = me.syncer.stop()
+		me.syncer = nil
+	}
 	if me.file != nil {
-		return me.file.Close()
+		return errors.Join(syncErr, me.file.Close())
 	}
-	return nil
+	return syncErr
+}
+
+// Sync all appended entries to disk, whatever the sync policy.
+func (me *JournalFile) Sync() error {
+	if me.syncer != nil {
+		return me.syncer.sync()
+	}
+	return syncFile(me.file, me.onSync)
 }
 
 func (me *JournalFile) AppendEntry(content []byte) (out JournalEntry, err error) {
@@ -140,8 +170,15 @@ func (me *JournalFile) AppendEntry(content []byte) (out JournalEntry, err error)
 		return out, err
 	}
 
-	if err := me.file.Sync(); err != nil {
-		return out, err
+	switch me.syncPolicy.Mode {
+	case SyncEveryAppend:
+		if err := syncFile(me.file, me.onSync); err != nil {
+			return out, err
+		}
+	case SyncPeriodically:
+		if err := me.syncer.appended(internalEntry.SizeOf()); err != nil {
+			return out, err
+		}
 	}
 
 	out = JournalEntry{
@@ -178,6 +215,11 @@ func (me *JournalFile) NumEntries() uint64 {
 	return me.numberOfEntries
 }
 
+// Return the entry number of the next appended entry.
+func (me *JournalFile) NextEntryNumber() uint64 {
+	return me.header.start + me.numberOfEntries
+}
+
 func (me *JournalFile) fileWrapperAt(offset uint64) util.FileWrapper {
 	return util.NewFileWrapperAt(me.file, offset)
 }
@@ -247,7 +289,7 @@ func (me *JournalFile) checkSumOnce() (sumMatches bool, _ error) {
 	}
 	me.size = offset
 
-	if err := me.file.Sync(); err != nil {
+	if err := syncFile(me.file, me.onSync); err != nil {
 		return sumMatches, err
 	}
 
@@ -3,8 +3,13 @@ package journal
 import (
 	"crypto/sha256"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/navijation/njsimple/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -100,6 +105,7 @@ func TestJournal_AppendAndIterate(t *testing.T) {
 		assert.Equal(t, uint64(5), file.header.start)
 		assert.NotZero(t, file.header.id)
 		assert.Equal(t, uint64(2), file.numberOfEntries)
+		assert.Equal(t, uint64(7), file.NextEntryNumber())
 		assert.Equal(t, uint64(130), file.Size())
 		assert.False(t, file.isBad)
 		assert.NotNil(t, file.hash)
@@ -211,6 +217,78 @@ func TestJournal_CorruptionHandling(t *testing.T) {
 	})
 }
 
+func TestJournal_SyncPolicy(t *testing.T) {
+	t.Parallel()
+
+	dir := getTemporaryDir(t, "TestJournal_SyncPolicy")
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name   string
+		policy SyncPolicy
+		// including the syncs when the file is opened and when Sync is called
+		minSyncs uint64
+	}{
+		{name: "every append", policy: SyncPolicy{Mode: SyncEveryAppend}, minSyncs: 12},
+		{name: "periodically", policy: SyncPolicy{
+			Mode:     SyncPeriodically,
+			Interval: util.Some(time.Hour),
+			Bytes:    util.Some(uint64(100)),
+		}, minSyncs: 3},
+		{name: "never", policy: SyncPolicy{Mode: SyncNever}, minSyncs: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "_")+".jrn")
+
+			var syncs atomic.Uint64
+			file, err := Open(OpenArgs{
+				Path:       path,
+				Create:     true,
+				SyncPolicy: tc.policy,
+				OnSync: util.Some(func(time.Duration) {
+					syncs.Add(1)
+				}),
+			})
+			require.NoError(t, err)
+
+			for range 10 {
+				_, err := file.AppendEntry([]byte("Hello world\n"))
+				require.NoError(t, err)
+			}
+
+			if tc.policy.Mode == SyncPeriodically {
+				// the byte threshold wakes up the background syncer well before the interval
+				assert.Eventually(t, func() bool {
+					return file.syncer.unsyncedBytes.Load() < 100
+				}, 5*time.Second, time.Millisecond)
+			}
+
+			require.NoError(t, file.Sync())
+			assert.GreaterOrEqual(t, syncs.Load(), tc.minSyncs)
+			require.NoError(t, file.Close())
+
+			t.Run("torn tail is truncated", func(t *testing.T) {
+				rawFile, err := os.OpenFile(path, os.O_RDWR, 0)
+				require.NoError(t, err)
+				_, err = rawFile.WriteAt([]byte("deadbeef"), int64(file.Size()))
+				require.NoError(t, err)
+				assert.NoError(t, rawFile.Close())
+
+				sameFile, err := Open(OpenArgs{
+					Path:       path,
+					SyncPolicy: tc.policy,
+				})
+				require.NoError(t, err)
+				defer sameFile.Close()
+
+				assert.Equal(t, file.NumEntries(), sameFile.NumEntries())
+				assert.Equal(t, file.Size(), sameFile.Size())
+				assert.Equal(t, file.hash.Sum(nil), sameFile.hash.Sum(nil))
+			})
+		})
+	}
+}
+
 func getTemporaryDir(t *testing.T, prefix string) (path string) {
 	out, err := os.MkdirTemp(os.TempDir(), prefix)
 	if err != nil {
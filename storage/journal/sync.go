@@ -0,0 +1,151 @@
+package journal
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/navijation/njsimple/util"
+)
+
+type SyncMode int
+
+const (
+	// Sync after every append, so that an entry is durable once AppendEntry returns.
+	SyncEveryAppend SyncMode = iota
+	// Sync from a background goroutine once an interval has passed or enough bytes have been
+	// appended since the last sync. Entries appended since the last sync may be lost on a crash.
+	SyncPeriodically
+	// Never sync, leaving it up to the operating system to write entries back. Entries that have
+	// not been written back may be lost on a crash.
+	SyncNever
+)
+
+const (
+	defaultSyncInterval = time.Second
+	defaultSyncBytes    = 1 << 20
+)
+
+// SyncPolicy determines when appended entries are synced to disk. Whatever the policy, a crash can
+// only lose a suffix of the journal: a torn entry fails its signature check and is truncated, along
+// with everything after it, when the journal is next opened.
+type SyncPolicy struct {
+	Mode SyncMode
+	// With SyncPeriodically, sync at least this often; defaults to 1 second.
+	Interval util.Optional[time.Duration]
+	// With SyncPeriodically, also sync once this many bytes have been appended since the last
+	// sync; defaults to 1 MiB.
+	Bytes util.Optional[uint64]
+}
+
+// backgroundSyncer periodically syncs a journal file from its own goroutine. It is shared by
+// every copy of the JournalFile that started it.
+type backgroundSyncer struct {
+	file     *os.File
+	maxBytes uint64
+	onSync   func(time.Duration)
+
+	unsyncedBytes atomic.Uint64
+	// buffered wake-up for the goroutine, once enough bytes have been appended
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	// the first failed sync, reported by every subsequent append or sync
+	lock sync.Mutex
+	err  error
+}
+
+func startBackgroundSyncer(
+	file *os.File, policy SyncPolicy, onSync func(time.Duration),
+) *backgroundSyncer {
+	out := &backgroundSyncer{
+		file:     file,
+		maxBytes: policy.Bytes.Or(defaultSyncBytes),
+		onSync:   onSync,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	out.wg.Add(1)
+	go func() {
+		defer out.wg.Done()
+
+		ticker := time.NewTicker(policy.Interval.Or(defaultSyncInterval))
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-out.wake:
+			case <-out.done:
+				return
+			}
+			if out.unsyncedBytes.Load() == 0 {
+				continue
+			}
+			if err := out.sync(); err != nil {
+				log.Printf("Failed to sync journal: %s\n", err.Error())
+			}
+		}
+	}()
+
+	return out
+}
+
+// appended records that the given number of bytes were appended, waking up the goroutine if
+// enough bytes are waiting to be synced. It returns the error of any earlier failed sync.
+func (me *backgroundSyncer) appended(numBytes uint64) error {
+	if me.unsyncedBytes.Add(numBytes) >= me.maxBytes {
+		select {
+		case me.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return me.err
+}
+
+func (me *backgroundSyncer) sync() error {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if me.err != nil {
+		return me.err
+	}
+
+	// bytes appended during the sync may or may not be covered by it, so they stay counted
+	unsyncedBytes := me.unsyncedBytes.Load()
+	if err := syncFile(me.file, me.onSync); err != nil {
+		// after a failed sync, the kernel may have dropped the dirty pages, so a later sync
+		// succeeding would not mean anything
+		me.err = err
+		return err
+	}
+	me.unsyncedBytes.Add(-unsyncedBytes)
+
+	return nil
+}
+
+// stop stops the goroutine, then syncs anything it had yet to sync.
+func (me *backgroundSyncer) stop() error {
+	close(me.done)
+	me.wg.Wait()
+
+	return me.sync()
+}
+
+// syncFile syncs a file to disk, reporting how long it took to onSync, if set.
+func syncFile(file *os.File, onSync func(time.Duration)) error {
+	start := time.Now()
+	err := file.Sync()
+	if onSync != nil {
+		onSync(time.Since(start))
+	}
+	return err
+}
@@ -2,20 +2,26 @@ package keyvaluepair
 
 const (
 	tombstoneMask = (uint64)(1) << 63
-	keySizeMask   = ^tombstoneMask
+	expiryMask    = (uint64)(1) << 62
+	operandMask   = (uint64)(1) << 61
+	keySizeMask   = ^(tombstoneMask | expiryMask | operandMask)
 )
 
-// Directly serde-able key-value pair. The binary representation is as follows.
-// ______________________________________________________________________________
-// | 1 bit     |   63 bits  | (key size) bytes | 8 bytes    | (value size) bytes |
-// |-----------------------------------------------------------------------------|
-// | tombstone |   key size |     key          | value size |      value         |
-// |-----------------------------------------------------------------------------|
+// Directly serde-able key-value pair. The binary representation is as follows. The expiry is only
+// present if the expiry flag is set, and the operand flag marks the value as a merge operand.
+// ______________________________________________________________________________________________
+// | 1 bit     | 1 bit  | 1 bit   | 61 bits  | (key size) | 8 bytes    | (value size) | 8 bytes |
+// |           |        |         |          | bytes      |            | bytes        |         |
+// |--------------------------------------------------------------------------------------------|
+// | tombstone | expiry | operand | key size | key        | value size | value        | expiry  |
+// |--------------------------------------------------------------------------------------------|
 type StoredKeyValuePair struct {
 	keySizeAndTombstone uint64
 	ValueSize           uint64
 	Key                 []byte
 	Value               []byte
+	// Unix time in nanoseconds at which the pair expires, or 0 if it never does
+	ExpiresAt uint64
 }
 
 // Higher-level DTO for passing around key-value pairs conveniently
@@ -23,4 +29,10 @@ type KeyValuePair struct {
 	Key       []byte
 	Value     []byte
 	IsDeleted bool
+	// Version of the key; later writes to a key have higher sequence numbers
+	SequenceNumber uint64
+	// Unix time in nanoseconds from which the key reads as deleted, or 0 if it never expires
+	ExpiresAt uint64
+	// The value is an operand to be merged into the previous version by a merge operator
+	IsMergeOperand bool
 }
@@ -2,6 +2,7 @@ package keyvaluepair
 
 import (
 	"io"
+	"time"
 
 	"github.com/navijation/njsimple/util"
 )
@@ -12,8 +13,10 @@ func (me *KeyValuePair) ToStoredKeyValuePair() StoredKeyValuePair {
 		ValueSize:           uint64(len(me.Value)),
 		Key:                 me.Key,
 		Value:               me.Value,
+		ExpiresAt:           me.ExpiresAt,
 	}
 	out.SetIsDeleted(me.IsDeleted)
+	out.SetIsMergeOperand(me.IsMergeOperand)
 
 	return out
 }
@@ -34,8 +37,24 @@ func (me *StoredKeyValuePair) SetIsDeleted(isDeleted bool) {
 	}
 }
 
+func (me *StoredKeyValuePair) IsMergeOperand() bool {
+	return operandMask&me.keySizeAndTombstone != 0
+}
+
+func (me *StoredKeyValuePair) SetIsMergeOperand(isMergeOperand bool) {
+	if isMergeOperand {
+		me.keySizeAndTombstone |= operandMask
+	} else {
+		me.keySizeAndTombstone &= ^operandMask
+	}
+}
+
 func (me *StoredKeyValuePair) WriteTo(writer io.Writer) (n int64, _ error) {
-	if dn, err := util.WriteUint64(writer, me.keySizeAndTombstone); err != nil {
+	header := me.keySizeAndTombstone
+	if me.ExpiresAt != 0 {
+		header |= expiryMask
+	}
+	if dn, err := util.WriteUint64(writer, header); err != nil {
 		return n + int64(dn), err
 	} else {
 		n += int64(dn)
@@ -71,6 +90,14 @@ func (me *StoredKeyValuePair) WriteTo(writer io.Writer) (n int64, _ error) {
 		n += int64(dn)
 	}
 
+	if me.ExpiresAt != 0 {
+		if dn, err := util.WriteUint64(writer, me.ExpiresAt); err != nil {
+			return n + int64(dn), err
+		} else {
+			n += int64(dn)
+		}
+	}
+
 	return n, nil
 }
 
@@ -81,7 +108,7 @@ func (me *StoredKeyValuePair) ReadFrom(reader io.Reader) (n int64, err error) {
 		return n, err
 	}
 
-	me.keySizeAndTombstone = keySizeAndTombstone
+	me.keySizeAndTombstone = keySizeAndTombstone &^ expiryMask
 
 	me.Key = make([]byte, me.KeySize())
 	dn, err = io.ReadAtLeast(reader, me.Key, int(me.KeySize()))
@@ -108,14 +135,25 @@ func (me *StoredKeyValuePair) ReadFrom(reader io.Reader) (n int64, err error) {
 		me.Value = nil
 	}
 
+	me.ExpiresAt = 0
+	if keySizeAndTombstone&expiryMask != 0 {
+		me.ExpiresAt, dn, err = util.ReadUint64(reader)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
 	return n, nil
 }
 
 func (me *StoredKeyValuePair) ToKeyValuePair() KeyValuePair {
 	return KeyValuePair{
-		Key:       me.Key,
-		Value:     me.Value,
-		IsDeleted: me.IsDeleted(),
+		Key:            me.Key,
+		Value:          me.Value,
+		IsDeleted:      me.IsDeleted(),
+		ExpiresAt:      me.ExpiresAt,
+		IsMergeOperand: me.IsMergeOperand(),
 	}
 }
 
@@ -124,5 +162,13 @@ func (me *StoredKeyValuePair) SizeOf() uint64 {
 	if !me.IsDeleted() {
 		out += me.ValueSize
 	}
+	if me.ExpiresAt != 0 {
+		out += 8
+	}
 	return out
 }
+
+// Return whether the pair has expired as of the given time.
+func (me *KeyValuePair) IsExpiredAt(now time.Time) bool {
+	return me.ExpiresAt != 0 && me.ExpiresAt <= uint64(now.UnixNano())
+}
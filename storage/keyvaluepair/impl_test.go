@@ -89,6 +89,38 @@ func Test_StoredKeyValuePair_serde(t *testing.T) {
 				Key:                 []byte("123456789101112"),
 			},
 		},
+		{
+			name: "expires",
+			stored: StoredKeyValuePair{
+				keySizeAndTombstone: 15,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+				ExpiresAt:           1234,
+			},
+			expectedDeser: StoredKeyValuePair{
+				keySizeAndTombstone: 15,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+				ExpiresAt:           1234,
+			},
+		},
+		{
+			name: "merge operand",
+			stored: StoredKeyValuePair{
+				keySizeAndTombstone: 15 | operandMask,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+			},
+			expectedDeser: StoredKeyValuePair{
+				keySizeAndTombstone: 15 | operandMask,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			var buf bytes.Buffer
@@ -0,0 +1,180 @@
+package sstable
+
+import (
+	"container/list"
+	"io"
+	"slices"
+	"sync"
+)
+
+// BlockCache is a least-recently-used cache of SSTable blocks, bounded by the total size of the
+// cached blocks. A block is a chunk of the sparse index, so a lookup reads at most one block. A
+// single cache may be shared by any number of SSTables, and is safe for concurrent use.
+type BlockCache struct {
+	lock     sync.Mutex
+	capacity uint64
+	size     uint64
+	// most recently used blocks first
+	lru    *list.List
+	blocks map[blockCacheKey]*list.Element
+	hits   uint64
+	misses uint64
+}
+
+type BlockCacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Total size of the cached blocks
+	Size uint64
+}
+
+type blockCacheKey struct {
+	tableID [16]byte
+	offset  uint64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	block []byte
+}
+
+// Create a cache holding at most the given number of bytes of blocks.
+func NewBlockCache(capacity uint64) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   map[blockCacheKey]*list.Element{},
+	}
+}
+
+// get returns a cached block, if its size matches. The last block of a table grows as entries are
+// appended, so a cached block of the wrong size is stale.
+func (me *BlockCache) get(key blockCacheKey, size uint64) (block []byte, ok bool) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	element, ok := me.blocks[key]
+	if !ok || uint64(len(element.Value.(*blockCacheEntry).block)) != size {
+		me.misses++
+		return nil, false
+	}
+
+	me.hits++
+	me.lru.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).block, true
+}
+
+func (me *BlockCache) put(key blockCacheKey, block []byte) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	if element, ok := me.blocks[key]; ok {
+		me.remove(element)
+	}
+	if uint64(len(block)) > me.capacity {
+		return
+	}
+
+	for me.size+uint64(len(block)) > me.capacity {
+		me.remove(me.lru.Back())
+	}
+
+	me.blocks[key] = me.lru.PushFront(&blockCacheEntry{key: key, block: block})
+	me.size += uint64(len(block))
+}
+
+func (me *BlockCache) remove(element *list.Element) {
+	entry := me.lru.Remove(element).(*blockCacheEntry)
+	delete(me.blocks, entry.key)
+	me.size -= uint64(len(entry.block))
+}
+
+// Evict every cached block of a table, such as when the table is deleted.
+func (me *BlockCache) EvictTable(tableID [16]byte) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	for key, element := range me.blocks {
+		if key.tableID == tableID {
+			me.remove(element)
+		}
+	}
+}
+
+func (me *BlockCache) Stats() BlockCacheStats {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+
+	return BlockCacheStats{
+		Hits:   me.hits,
+		Misses: me.misses,
+		Size:   me.size,
+	}
+}
+
+// blockReader reads the entries of an SSTable one block at a time, through the table's block
+// cache.
+type blockReader struct {
+	table  *SSTable
+	offset uint64
+	// unread remainder of the current block
+	block []byte
+}
+
+func (me *blockReader) Read(b []byte) (n int, _ error) {
+	if len(me.block) == 0 {
+		if me.offset >= me.table.header.FileSize {
+			return 0, io.EOF
+		}
+		block, blockStart, err := me.table.readBlock(me.offset)
+		if err != nil {
+			return 0, err
+		}
+		me.block = block[me.offset-blockStart:]
+	}
+
+	n = copy(b, me.block)
+	me.block = me.block[n:]
+	me.offset += uint64(n)
+	return n, nil
+}
+
+// readBlock returns the block containing the given offset, and the offset at which it starts.
+func (me *SSTable) readBlock(offset uint64) (block []byte, blockStart uint64, _ error) {
+	// blocks start at the first entry, then at every indexed entry
+	idx, found := slices.BinarySearchFunc(
+		me.index.IndexedEntries, offset, func(entry SparseMemIndexEntry, offset uint64) int {
+			switch {
+			case entry.Location.Offset < offset:
+				return -1
+			case entry.Location.Offset > offset:
+				return 1
+			}
+			return 0
+		},
+	)
+	if found {
+		idx++
+	}
+
+	blockStart, blockEnd := me.header.SizeOf(), me.header.FileSize
+	if idx > 0 {
+		blockStart = me.index.IndexedEntries[idx-1].Location.Offset
+	}
+	if idx < len(me.index.IndexedEntries) {
+		blockEnd = me.index.IndexedEntries[idx].Location.Offset
+	}
+
+	key := blockCacheKey{tableID: me.header.ID, offset: blockStart}
+	if block, ok := me.blockCache.get(key, blockEnd-blockStart); ok {
+		return block, blockStart, nil
+	}
+
+	block = make([]byte, blockEnd-blockStart)
+	if _, err := me.file.ReadAt(block, int64(blockStart)); err != nil {
+		return nil, 0, err
+	}
+	me.blockCache.put(key, block)
+
+	return block, blockStart, nil
+}
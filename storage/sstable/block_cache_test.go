@@ -0,0 +1,147 @@
+package sstable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache(t *testing.T) {
+	t.Parallel()
+
+	table1, table2 := [16]byte{1}, [16]byte{2}
+	cache := NewBlockCache(10)
+
+	cache.put(blockCacheKey{tableID: table1, offset: 0}, []byte("abcd"))
+	cache.put(blockCacheKey{tableID: table1, offset: 4}, []byte("efgh"))
+
+	t.Run("hit", func(t *testing.T) {
+		block, ok := cache.get(blockCacheKey{tableID: table1, offset: 0}, 4)
+		assert.True(t, ok)
+		assert.Equal(t, []byte("abcd"), block)
+	})
+
+	t.Run("stale size", func(t *testing.T) {
+		_, ok := cache.get(blockCacheKey{tableID: table1, offset: 4}, 6)
+		assert.False(t, ok)
+	})
+
+	t.Run("evict least recently used", func(t *testing.T) {
+		cache.put(blockCacheKey{tableID: table2, offset: 0}, []byte("ijkl"))
+
+		_, ok := cache.get(blockCacheKey{tableID: table1, offset: 4}, 4)
+		assert.False(t, ok)
+		_, ok = cache.get(blockCacheKey{tableID: table1, offset: 0}, 4)
+		assert.True(t, ok)
+		_, ok = cache.get(blockCacheKey{tableID: table2, offset: 0}, 4)
+		assert.True(t, ok)
+	})
+
+	t.Run("block larger than capacity", func(t *testing.T) {
+		cache.put(blockCacheKey{tableID: table2, offset: 4}, []byte("0123456789a"))
+		_, ok := cache.get(blockCacheKey{tableID: table2, offset: 4}, 11)
+		assert.False(t, ok)
+	})
+
+	t.Run("evict table", func(t *testing.T) {
+		cache.EvictTable(table1)
+		_, ok := cache.get(blockCacheKey{tableID: table1, offset: 0}, 4)
+		assert.False(t, ok)
+		_, ok = cache.get(blockCacheKey{tableID: table2, offset: 0}, 4)
+		assert.True(t, ok)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		assert.Equal(t, BlockCacheStats{Hits: 4, Misses: 4, Size: 4}, cache.Stats())
+	})
+}
+
+func TestSSTable_BlockCache(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestSSTable_BlockCache")
+	defer cleanup()
+
+	cache := NewBlockCache(1 << 20)
+
+	file, err := Open(OpenArgs{
+		Path:           dir + "/sstable.sst",
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(200)),
+		BlockCache:     cache,
+	})
+	require.NoError(t, err)
+	defer file.Close()
+
+	const numKeys = 100
+	var kvps []KeyValuePair
+	for i := range numKeys {
+		kvps = append(kvps, KeyValuePair{
+			Key:   []byte(fmt.Sprintf("key %03d", i)),
+			Value: []byte(fmt.Sprintf("value %d", i)),
+		})
+	}
+	require.NoError(t, file.AppendEntries(util.SeqOf(kvps...)))
+
+	assertLookups := func(t *testing.T) {
+		for i := range numKeys {
+			entry, exists, err := file.LookupEntry([]byte(fmt.Sprintf("key %03d", i)))
+			if assert.NoError(t, err) && assert.True(t, exists) {
+				assert.Equal(t, fmt.Sprintf("value %d", i), string(entry.Value))
+			}
+		}
+	}
+
+	t.Run("first lookups miss", func(t *testing.T) {
+		assertLookups(t)
+		stats := cache.Stats()
+		assert.EqualValues(t, len(file.index.IndexedEntries)+1, stats.Misses)
+		assert.EqualValues(t, numKeys-stats.Misses, stats.Hits)
+	})
+
+	t.Run("repeated lookups hit", func(t *testing.T) {
+		before := cache.Stats()
+		assertLookups(t)
+		after := cache.Stats()
+		assert.Equal(t, before.Misses, after.Misses)
+		assert.EqualValues(t, before.Hits+numKeys, after.Hits)
+	})
+
+	t.Run("iterate through cache", func(t *testing.T) {
+		var i int
+		for entry, err := range file.Entries() {
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("key %03d", i), string(entry.Key))
+			i++
+		}
+		assert.Equal(t, numKeys, i)
+	})
+
+	t.Run("appending invalidates the last block", func(t *testing.T) {
+		require.NoError(t, file.AppendEntries(util.SeqOf(KeyValuePair{
+			Key:   []byte("key 999"),
+			Value: []byte("value 999"),
+		})))
+		entry, exists, err := file.LookupEntry([]byte("key 999"))
+		if assert.NoError(t, err) && assert.True(t, exists) {
+			assert.Equal(t, "value 999", string(entry.Value))
+		}
+	})
+
+	t.Run("concurrent readers", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assertLookups(t)
+			}()
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,121 @@
+package sstable
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+
+	"github.com/navijation/njsimple/util"
+)
+
+const (
+	defaultBloomFilterBitsPerKey uint64 = 10
+	maxBloomFilterHashes         uint64 = 30
+)
+
+// Bloom filter over the keys of an SSTable, used to skip tables that cannot contain a key. Bit
+// positions are derived from a single 64-bit hash of the key by double hashing.
+// ______________________________________
+// | 8 bytes        | (variable)        |
+// |------------------------------------|
+// | num hashes     | bits              |
+// |------------------------------------|
+type BloomFilter struct {
+	numHashes uint64
+	bits      []byte
+}
+
+// newBloomFilter builds a filter over the given key hashes, as returned by bloomHash.
+func newBloomFilter(keyHashes []uint64, bitsPerKey uint64) BloomFilter {
+	// the false positive rate is lowest with bitsPerKey * ln(2) hash functions
+	numHashes := uint64(float64(bitsPerKey) * math.Ln2)
+	numHashes = min(max(numHashes, 1), maxBloomFilterHashes)
+
+	// very small filters have a high false positive rate, so enforce a minimum size
+	numBits := max(uint64(len(keyHashes))*bitsPerKey, 64)
+
+	out := BloomFilter{
+		numHashes: numHashes,
+		bits:      make([]byte, (numBits+7)/8),
+	}
+	for _, hash := range keyHashes {
+		out.add(hash)
+	}
+	return out
+}
+
+func bloomHash(key []byte) uint64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write(key)
+	return hash.Sum64()
+}
+
+func (me *BloomFilter) add(hash uint64) {
+	numBits := uint64(len(me.bits)) * 8
+	delta := hash>>33 | hash<<31
+	for range me.numHashes {
+		bit := hash % numBits
+		me.bits[bit/8] |= 1 << (bit % 8)
+		hash += delta
+	}
+}
+
+// Report whether the key may have been added to the filter. False positives are possible, but
+// false negatives are not.
+func (me *BloomFilter) MayContain(key []byte) bool {
+	if len(me.bits) == 0 {
+		return true
+	}
+
+	hash := bloomHash(key)
+	numBits := uint64(len(me.bits)) * 8
+	delta := hash>>33 | hash<<31
+	for range me.numHashes {
+		bit := hash % numBits
+		if me.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		hash += delta
+	}
+	return true
+}
+
+func (me *BloomFilter) SizeOf() uint64 {
+	return 8 + uint64(len(me.bits))
+}
+
+func (me *BloomFilter) WriteTo(writer io.Writer) (n int64, _ error) {
+	dn, err := util.WriteUint64(writer, me.numHashes)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = writer.Write(me.bits)
+	return n + int64(dn), err
+}
+
+// readFrom reads a filter of the given total size, as recorded in the SSTable header.
+func (me *BloomFilter) readFrom(reader io.Reader, size uint64) (n int64, _ error) {
+	if size < 8 {
+		return n, fmt.Errorf("invalid bloom filter size %d", size)
+	}
+
+	numHashes, dn, err := util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	bits := make([]byte, size-8)
+	dn, err = io.ReadFull(reader, bits)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	me.numHashes = numHashes
+	me.bits = bits
+	return n, nil
+}
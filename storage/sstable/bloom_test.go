@@ -0,0 +1,134 @@
+package sstable
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	t.Parallel()
+
+	const numKeys = 1000
+
+	var keyHashes []uint64
+	for i := range numKeys {
+		keyHashes = append(keyHashes, bloomHash([]byte(fmt.Sprintf("key %d", i))))
+	}
+	filter := newBloomFilter(keyHashes, 10)
+
+	t.Run("no false negatives", func(t *testing.T) {
+		for i := range numKeys {
+			assert.True(t, filter.MayContain([]byte(fmt.Sprintf("key %d", i))))
+		}
+	})
+
+	t.Run("few false positives", func(t *testing.T) {
+		var falsePositives int
+		for i := range numKeys {
+			if filter.MayContain([]byte(fmt.Sprintf("missing %d", i))) {
+				falsePositives++
+			}
+		}
+		// about 1% with 10 bits per key
+		assert.Less(t, falsePositives, numKeys/20)
+	})
+
+	t.Run("empty filter", func(t *testing.T) {
+		var filter BloomFilter
+		assert.True(t, filter.MayContain([]byte("key")))
+	})
+}
+
+func TestSSTable_BloomFilter(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestSSTable_BloomFilter")
+	defer cleanup()
+
+	file, err := Open(OpenArgs{
+		Path:   dir + "/sstable.sst",
+		Create: true,
+	})
+	require.NoError(t, err)
+	defer file.Close()
+
+	appendKeys := func(t *testing.T, start, end int) {
+		var kvps []KeyValuePair
+		for i := start; i < end; i++ {
+			kvps = append(kvps, KeyValuePair{
+				Key:   []byte(fmt.Sprintf("key %03d", i)),
+				Value: []byte("value"),
+			})
+		}
+		require.NoError(t, file.AppendEntries(util.SeqOf(kvps...)))
+	}
+
+	assertKeys := func(t *testing.T, table *SSTable, numKeys int) {
+		assert.NotZero(t, table.header.FilterSize)
+		for i := range numKeys {
+			key := []byte(fmt.Sprintf("key %03d", i))
+			assert.True(t, table.filter.MayContain(key))
+			_, exists, err := table.LookupEntry(key)
+			assert.NoError(t, err)
+			assert.True(t, exists)
+		}
+		_, exists, err := table.LookupEntry([]byte("missing"))
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	}
+
+	t.Run("first append", func(t *testing.T) {
+		appendKeys(t, 0, 50)
+		assertKeys(t, &file, 50)
+	})
+
+	t.Run("second append rebuilds the filter", func(t *testing.T) {
+		appendKeys(t, 50, 100)
+		assertKeys(t, &file, 100)
+	})
+
+	t.Run("re-open file", func(t *testing.T) {
+		sameFile, err := Open(OpenArgs{Path: dir + "/sstable.sst"})
+		require.NoError(t, err)
+		defer sameFile.Close()
+
+		assert.Equal(t, file.header, sameFile.header)
+		assert.Equal(t, file.filter, sameFile.filter)
+		assertKeys(t, &sameFile, 100)
+	})
+
+	t.Run("truncated filter", func(t *testing.T) {
+		bytes, err := os.ReadFile(dir + "/sstable.sst")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/truncated.sst", bytes[:len(bytes)-1], 0o644))
+
+		_, err = Open(OpenArgs{Path: dir + "/truncated.sst"})
+		assert.Error(t, err)
+	})
+
+	t.Run("no filter", func(t *testing.T) {
+		noFilterFile, err := Open(OpenArgs{
+			Path:                  dir + "/no_filter.sst",
+			Create:                true,
+			BloomFilterBitsPerKey: util.Some(uint64(0)),
+		})
+		require.NoError(t, err)
+		defer noFilterFile.Close()
+
+		require.NoError(t, noFilterFile.AppendEntries(util.SeqOf(KeyValuePair{
+			Key:   []byte("key"),
+			Value: []byte("value"),
+		})))
+		assert.Zero(t, noFilterFile.header.FilterSize)
+
+		_, exists, err := noFilterFile.LookupEntry([]byte("key"))
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+}
@@ -0,0 +1,96 @@
+package sstable
+
+import (
+	"bytes"
+	"cmp"
+)
+
+// Comparator defines the order of keys in an SSTable. Its name is stored in the SSTable header,
+// so that an SSTable can only be reopened with a comparator of the same name.
+//
+// Keys must only compare equal if they are byte for byte equal, since versions of a key are
+// grouped and bloom filters are built by their bytes.
+type Comparator interface {
+	// Name of the comparator; a comparator whose order changes must also change its name
+	Name() string
+	// Return a negative number if a sorts before b, a positive number if a sorts after b, and 0
+	// if they are equal.
+	Compare(a, b []byte) int
+}
+
+var (
+	// Orders keys lexicographically by their bytes; the default.
+	BytewiseComparator Comparator = bytewiseComparator{}
+	// Orders keys in the reverse of BytewiseComparator, e.g. so that big-endian timestamps sort
+	// newest first.
+	ReverseBytewiseComparator Comparator = reverseBytewiseComparator{}
+	// Orders keys as strings regardless of ASCII letter case; keys that only differ in case are
+	// ordered bytewise.
+	CaseInsensitiveComparator Comparator = caseInsensitiveComparator{}
+	// Orders keys as unsigned big-endian integers of any width, ignoring leading zero bytes; keys
+	// with the same value are ordered bytewise.
+	BigEndianIntegerComparator Comparator = bigEndianIntegerComparator{}
+)
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "bytewise"
+}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+type reverseBytewiseComparator struct{}
+
+func (reverseBytewiseComparator) Name() string {
+	return "reverse bytewise"
+}
+
+func (reverseBytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+type caseInsensitiveComparator struct{}
+
+func (caseInsensitiveComparator) Name() string {
+	return "case insensitive"
+}
+
+func (caseInsensitiveComparator) Compare(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if comp := cmp.Compare(toLower(a[i]), toLower(b[i])); comp != 0 {
+			return comp
+		}
+	}
+	if comp := cmp.Compare(len(a), len(b)); comp != 0 {
+		return comp
+	}
+	return bytes.Compare(a, b)
+}
+
+func toLower(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+type bigEndianIntegerComparator struct{}
+
+func (bigEndianIntegerComparator) Name() string {
+	return "big-endian integer"
+}
+
+func (bigEndianIntegerComparator) Compare(a, b []byte) int {
+	trimmedA, trimmedB := bytes.TrimLeft(a, "\x00"), bytes.TrimLeft(b, "\x00")
+	// of two integers without leading zeros, the longer one is greater
+	if comp := cmp.Compare(len(trimmedA), len(trimmedB)); comp != 0 {
+		return comp
+	}
+	if comp := bytes.Compare(trimmedA, trimmedB); comp != 0 {
+		return comp
+	}
+	return bytes.Compare(a, b)
+}
@@ -0,0 +1,154 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"iter"
+	"slices"
+	"testing"
+
+	"github.com/navijation/njsimple/util"
+	testing_util "github.com/navijation/njsimple/util/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComparators(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		comparator Comparator
+		sorted     []string
+	}{
+		{comparator: BytewiseComparator, sorted: []string{"", "A", "B", "a", "ab", "b"}},
+		{comparator: ReverseBytewiseComparator, sorted: []string{"b", "ab", "a", "B", "A", ""}},
+		{comparator: CaseInsensitiveComparator, sorted: []string{"", "A", "a", "ab", "B", "b"}},
+		{
+			comparator: BigEndianIntegerComparator,
+			sorted:     []string{"", "\x00", "\x00\x02", "\x02", "\xff", "\x00\x01\x00", "\x01\x01"},
+		},
+	} {
+		t.Run(tc.comparator.Name(), func(t *testing.T) {
+			shuffled := slices.Clone(tc.sorted)
+			slices.Reverse(shuffled)
+			shuffled[0], shuffled[len(shuffled)/2] = shuffled[len(shuffled)/2], shuffled[0]
+
+			slices.SortFunc(shuffled, func(a, b string) int {
+				return tc.comparator.Compare([]byte(a), []byte(b))
+			})
+			assert.Equal(t, tc.sorted, shuffled)
+		})
+	}
+}
+
+func TestSSTable_Comparator(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestSSTable_Comparator")
+	defer cleanup()
+
+	// big-endian timestamps, newest first
+	timestampKey := func(timestamp uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, timestamp)
+	}
+	const numKeys = 100
+	keyValuePairs := func(yield func(KeyValuePair) bool) {
+		for i := range numKeys {
+			timestamp := uint64(numKeys - i)
+			if !yield(KeyValuePair{
+				Key:   timestampKey(timestamp),
+				Value: []byte(fmt.Sprint(timestamp)),
+			}) {
+				return
+			}
+		}
+	}
+
+	path := dir + "/sstable.sst"
+	file, err := Open(OpenArgs{
+		Path:           path,
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+		Comparator:     util.Some(ReverseBytewiseComparator),
+	})
+	require.NoError(t, err)
+	require.NoError(t, file.AppendEntries(keyValuePairs))
+	require.NoError(t, file.Close())
+
+	t.Run("out of order append", func(t *testing.T) {
+		file, err := Open(OpenArgs{Path: dir + "/bytewise.sst", Create: true})
+		require.NoError(t, err)
+		defer file.Close()
+
+		assert.Error(t, file.AppendEntries(keyValuePairs))
+	})
+
+	t.Run("re-open with the same comparator", func(t *testing.T) {
+		file, err := Open(OpenArgs{
+			Path:           path,
+			IndexChunkSize: util.Some(uint64(100)),
+			Comparator:     util.Some(ReverseBytewiseComparator),
+		})
+		require.NoError(t, err)
+		defer file.Close()
+
+		for timestamp := uint64(1); timestamp <= numKeys; timestamp++ {
+			entry, exists, err := file.LookupEntry(timestampKey(timestamp))
+			_ = assert.NoError(t, err) && assert.True(t, exists) &&
+				assert.Equal(t, fmt.Sprint(timestamp), string(entry.Value))
+		}
+
+		var timestamps []uint64
+		for entry, err := range file.EntriesFrom(timestampKey(50)) {
+			require.NoError(t, err)
+			timestamps = append(timestamps, binary.BigEndian.Uint64(entry.Key))
+		}
+		if assert.Len(t, timestamps, 50) {
+			assert.EqualValues(t, 50, timestamps[0])
+			assert.EqualValues(t, 1, timestamps[49])
+		}
+
+		timestamps = nil
+		for entry, err := range file.ReverseEntriesFrom(timestampKey(50)) {
+			require.NoError(t, err)
+			timestamps = append(timestamps, binary.BigEndian.Uint64(entry.Key))
+		}
+		if assert.Len(t, timestamps, 51) {
+			assert.EqualValues(t, 50, timestamps[0])
+			assert.EqualValues(t, numKeys, timestamps[50])
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		dest, err := Open(OpenArgs{
+			Path:       dir + "/merged.sst",
+			Create:     true,
+			Comparator: util.Some(ReverseBytewiseComparator),
+		})
+		require.NoError(t, err)
+		defer dest.Close()
+
+		src, err := Open(OpenArgs{
+			Path:       path,
+			Comparator: util.Some(ReverseBytewiseComparator),
+		})
+		require.NoError(t, err)
+		defer src.Close()
+
+		require.NoError(t, dest.MergeTables(MergeTablesArgs{Srcs: []*SSTable{&src}}))
+		next, stop := iter.Pull2(dest.Entries())
+		defer stop()
+		first, err, _ := next()
+		_ = assert.NoError(t, err) && assert.Equal(t, timestampKey(numKeys), first.Key)
+	})
+
+	t.Run("re-open with another comparator", func(t *testing.T) {
+		for _, comparator := range []util.Optional[Comparator]{
+			{},
+			util.Some(CaseInsensitiveComparator),
+		} {
+			_, err := Open(OpenArgs{Path: path, Comparator: comparator})
+			assert.ErrorContains(t, err, `was created with comparator "reverse bytewise"`)
+		}
+	})
+}
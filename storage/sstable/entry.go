@@ -8,16 +8,21 @@ import (
 
 const (
 	tombstoneMask = (uint64)(1) << 63
-	keySizeMask   = ^tombstoneMask
+	expiryMask    = (uint64)(1) << 62
+	operandMask   = (uint64)(1) << 61
+	keySizeMask   = ^(tombstoneMask | expiryMask | operandMask)
 )
 
 type SSTableEntry struct {
-	Location  EntryLocation
-	KeySize   uint64
-	ValueSize uint64
-	Key       []byte
-	Value     []byte
-	IsDeleted bool
+	Location       EntryLocation
+	KeySize        uint64
+	ValueSize      uint64
+	Key            []byte
+	Value          []byte
+	IsDeleted      bool
+	SequenceNumber uint64
+	ExpiresAt      uint64
+	IsMergeOperand bool
 }
 
 type EntryLocation struct {
@@ -25,16 +30,23 @@ type EntryLocation struct {
 	Offset      uint64
 }
 
-// ______________________________________________________________________________
-// | 1 bit     |   63 bits  | (key size) bytes | 8 bytes    | (value size) bytes |
-// |-----------------------------------------------------------------------------|
-// | tombstone |   key size |     key          | value size |      value         |
-// |-----------------------------------------------------------------------------|
+// Entries for the same key are stored newest first, i.e. in descending sequence number order. The
+// expiry, a Unix time in nanoseconds, is only present if the expiry flag is set, and the operand
+// flag marks the value as a merge operand.
+// ________________________________________________________________________________________________
+// | 1 bit | 1 bit  | 1 bit | 61 bits  | (key size) | 8 bytes | 8 bytes  | (value size) | 8 bytes |
+// |       |        |       |          | bytes      |         |          | bytes        |         |
+// |----------------------------------------------------------------------------------------------|
+// | tomb- | expiry | oper- | key size | key        | seq #   | val size | value        | expiry  |
+// | stone |        | and   |          |            |         |          |              |         |
+// |----------------------------------------------------------------------------------------------|
 type internalSSTableEntry struct {
 	keySizeAndTombstone uint64
 	ValueSize           uint64
 	Key                 []byte
 	Value               []byte
+	SequenceNumber      uint64
+	ExpiresAt           uint64
 }
 
 func (me internalSSTableEntry) FromKeyValuePair(kvp KeyValuePair) internalSSTableEntry {
@@ -43,20 +55,26 @@ func (me internalSSTableEntry) FromKeyValuePair(kvp KeyValuePair) internalSSTabl
 		ValueSize:           uint64(len(kvp.Value)),
 		Key:                 kvp.Key,
 		Value:               kvp.Value,
+		SequenceNumber:      kvp.SequenceNumber,
+		ExpiresAt:           kvp.ExpiresAt,
 	}
 	out.SetIsDeleted(kvp.IsDeleted)
+	out.SetIsMergeOperand(kvp.IsMergeOperand)
 
 	return out
 }
 
 func (me *internalSSTableEntry) ToSSTableEntry(location EntryLocation) SSTableEntry {
 	return SSTableEntry{
-		Location:  location,
-		KeySize:   me.KeySize(),
-		ValueSize: me.ValueSize,
-		Key:       me.Key,
-		Value:     me.Value,
-		IsDeleted: me.IsDeleted(),
+		Location:       location,
+		KeySize:        me.KeySize(),
+		ValueSize:      me.ValueSize,
+		Key:            me.Key,
+		Value:          me.Value,
+		IsDeleted:      me.IsDeleted(),
+		SequenceNumber: me.SequenceNumber,
+		ExpiresAt:      me.ExpiresAt,
+		IsMergeOperand: me.IsMergeOperand(),
 	}
 }
 
@@ -76,8 +94,24 @@ func (me *internalSSTableEntry) SetIsDeleted(isDeleted bool) {
 	}
 }
 
+func (me *internalSSTableEntry) IsMergeOperand() bool {
+	return operandMask&me.keySizeAndTombstone != 0
+}
+
+func (me *internalSSTableEntry) SetIsMergeOperand(isMergeOperand bool) {
+	if isMergeOperand {
+		me.keySizeAndTombstone |= operandMask
+	} else {
+		me.keySizeAndTombstone &= ^operandMask
+	}
+}
+
 func (me *internalSSTableEntry) WriteTo(writer io.Writer) (n int64, _ error) {
-	if dn, err := util.WriteUint64(writer, me.keySizeAndTombstone); err != nil {
+	header := me.keySizeAndTombstone
+	if me.ExpiresAt != 0 {
+		header |= expiryMask
+	}
+	if dn, err := util.WriteUint64(writer, header); err != nil {
 		return n + int64(dn), err
 	} else {
 		n += int64(dn)
@@ -89,6 +123,12 @@ func (me *internalSSTableEntry) WriteTo(writer io.Writer) (n int64, _ error) {
 		n += int64(dn)
 	}
 
+	if dn, err := util.WriteUint64(writer, me.SequenceNumber); err != nil {
+		return n + int64(dn), err
+	} else {
+		n += int64(dn)
+	}
+
 	if dn, err := util.WriteUint64(writer, me.ValueSize); err != nil {
 		return n + int64(dn), err
 	} else {
@@ -101,6 +141,14 @@ func (me *internalSSTableEntry) WriteTo(writer io.Writer) (n int64, _ error) {
 		n += int64(dn)
 	}
 
+	if me.ExpiresAt != 0 {
+		if dn, err := util.WriteUint64(writer, me.ExpiresAt); err != nil {
+			return n + int64(dn), err
+		} else {
+			n += int64(dn)
+		}
+	}
+
 	return n, nil
 }
 
@@ -111,7 +159,7 @@ func (me *internalSSTableEntry) ReadFrom(reader io.Reader) (n int64, err error)
 		return n, err
 	}
 
-	me.keySizeAndTombstone = keySizeAndTombstone
+	me.keySizeAndTombstone = keySizeAndTombstone &^ expiryMask
 
 	me.Key = make([]byte, me.KeySize())
 	dn, err = io.ReadAtLeast(reader, me.Key, int(me.KeySize()))
@@ -120,6 +168,12 @@ func (me *internalSSTableEntry) ReadFrom(reader io.Reader) (n int64, err error)
 		return n, err
 	}
 
+	me.SequenceNumber, dn, err = util.ReadUint64(reader)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
 	valueSize, dn, err := util.ReadUint64(reader)
 	n += int64(dn)
 	if err != nil {
@@ -136,17 +190,33 @@ func (me *internalSSTableEntry) ReadFrom(reader io.Reader) (n int64, err error)
 		}
 	}
 
+	me.ExpiresAt = 0
+	if keySizeAndTombstone&expiryMask != 0 {
+		me.ExpiresAt, dn, err = util.ReadUint64(reader)
+		n += int64(dn)
+		if err != nil {
+			return n, err
+		}
+	}
+
 	return n, nil
 }
 
 func (me *internalSSTableEntry) SizeOf() uint64 {
-	return 8 + me.KeySize() + 8 + me.ValueSize
+	out := 8 + me.KeySize() + 8 + 8 + me.ValueSize
+	if me.ExpiresAt != 0 {
+		out += 8
+	}
+	return out
 }
 
 func (me *SSTableEntry) ToKeyValuePair() KeyValuePair {
 	return KeyValuePair{
-		Key:       me.Key,
-		Value:     me.Value,
-		IsDeleted: me.IsDeleted,
+		Key:            me.Key,
+		Value:          me.Value,
+		IsDeleted:      me.IsDeleted,
+		SequenceNumber: me.SequenceNumber,
+		ExpiresAt:      me.ExpiresAt,
+		IsMergeOperand: me.IsMergeOperand,
 	}
 }
@@ -140,6 +140,27 @@ func Test_internalSSTableEntry_serde(t *testing.T) {
 				Value:               []byte("abc"),
 			},
 		},
+		{
+			name: "expires",
+			internal: internalSSTableEntry{
+				keySizeAndTombstone: 15,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+				SequenceNumber:      7,
+				ExpiresAt:           1234,
+			},
+		},
+		{
+			name: "merge operand",
+			internal: internalSSTableEntry{
+				keySizeAndTombstone: 15 | operandMask,
+				ValueSize:           3,
+				Key:                 []byte("123456789101112"),
+				Value:               []byte("abc"),
+				SequenceNumber:      7,
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			var buf bytes.Buffer
@@ -1,26 +1,47 @@
 package sstable
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/navijation/njsimple/util"
 )
 
-// ______________________________________________________
-// | 16 bytes  |   8 bytes  |    8 bytes   | 8 bytes    |
-// |----------------------------------------------------|
-// | ID        |  file size |  num entries | version    |
-// |----------------------------------------------------|
+// ____________________________________________________________________________________________________
+// | 16 bytes | 8 bytes | 8 bytes   | 8 bytes     | 8 bytes | 8 bytes     | 8 bytes | N bytes         |
+// |--------------------------------------------------------------------------------------------------|
+// | ID       | version | file size | num entries | level   | filter size | N       | comparator name |
+// |--------------------------------------------------------------------------------------------------|
+//
+// The version comes right after the ID in every version of the layout, so that tables written in
+// an older layout can be told apart.
 type Header struct {
-	ID         [16]byte
+	ID [16]byte
+	// Size of the header and entries; the bloom filter, if any, follows the entries
 	FileSize   uint64
 	NumEntries uint64
-	Version    uint64
+	// Layout of the header and entries; always FormatVersion for tables that can be read
+	Version uint64
+	// Level of the table within an LSM tree
+	Level uint64
+	// Size of the bloom filter, or 0 if the table has none
+	FilterSize uint64
+	// Name of the comparator the keys are sorted by
+	ComparatorName string
 }
 
-func (me Header) WithNewSize(fileSize, numEntries uint64) Header {
+// Version of the layout of tables written by this package. Version 1 added sequence numbers,
+// expiration times and merge operands to entries, and the level, bloom filter and comparator to
+// the header.
+const FormatVersion uint64 = 1
+
+var ErrUnsupportedVersion = errors.New("unsupported SSTable version")
+
+func (me Header) WithNewSize(fileSize, numEntries, filterSize uint64) Header {
 	me.FileSize = fileSize
 	me.NumEntries = numEntries
+	me.FilterSize = filterSize
 	return me
 }
 
@@ -31,7 +52,16 @@ func (me *Header) WriteTo(writer io.Writer) (n int64, _ error) {
 		return n, err
 	}
 
-	dn, err = util.WriteUint64s(writer, me.Version, me.FileSize, me.NumEntries)
+	dn, err = util.WriteUint64s(
+		writer, me.Version, me.FileSize, me.NumEntries, me.Level, me.FilterSize,
+		uint64(len(me.ComparatorName)),
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	dn, err = writer.Write([]byte(me.ComparatorName))
 	return n + int64(dn), err
 }
 
@@ -42,10 +72,34 @@ func (me *Header) ReadFrom(reader io.Reader) (n int64, _ error) {
 		return n, err
 	}
 
-	dn, err = util.ReadUint64s(reader, &me.Version, &me.FileSize, &me.NumEntries)
-	return n + int64(dn), err
+	dn, err = util.ReadUint64s(reader, &me.Version)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+	// the rest of an older header has another layout
+	if me.Version != FormatVersion {
+		return n, fmt.Errorf(
+			"%w %d; only version %d is supported", ErrUnsupportedVersion, me.Version, FormatVersion,
+		)
+	}
+
+	var nameSize uint64
+	dn, err = util.ReadUint64s(
+		reader, &me.FileSize, &me.NumEntries, &me.Level, &me.FilterSize, &nameSize,
+	)
+	n += int64(dn)
+	if err != nil {
+		return n, err
+	}
+
+	name := make([]byte, nameSize)
+	dn, err = io.ReadFull(reader, name)
+	n += int64(dn)
+	me.ComparatorName = string(name)
+	return n, err
 }
 
 func (me *Header) SizeOf() uint64 {
-	return 16 + 3*8
+	return 16 + 6*8 + uint64(len(me.ComparatorName))
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/navijation/njsimple/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -18,7 +19,18 @@ func Test_ssTableHeader_serde(t *testing.T) {
 			header: Header{
 				FileSize:   50,
 				NumEntries: 3,
-				Version:    1,
+				Version:    FormatVersion,
+				Level:      2,
+				FilterSize: 20,
+			},
+		},
+		{
+			name: "comparator",
+			header: Header{
+				FileSize:       50,
+				NumEntries:     3,
+				Version:        FormatVersion,
+				ComparatorName: "reverse bytewise",
 			},
 		},
 	} {
@@ -38,4 +50,17 @@ func Test_ssTableHeader_serde(t *testing.T) {
 			assert.Equal(t, tc.header, deser)
 		})
 	}
+
+	t.Run("older version", func(t *testing.T) {
+		// tables used to be written with the version their creator passed in, usually 0, and
+		// their header ended with the number of entries
+		var buf bytes.Buffer
+		buf.Write(make([]byte, 16))
+		_, err := util.WriteUint64s(&buf, 0, 40, 0)
+		require.NoError(t, err)
+
+		var deser Header
+		_, err = deser.ReadFrom(&buf)
+		assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	})
 }
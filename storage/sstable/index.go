@@ -8,6 +8,8 @@ import (
 type SparseMemIndex struct {
 	ChunkSize      uint64
 	IndexedEntries []SparseMemIndexEntry
+	// Order of the indexed keys; defaults to BytewiseComparator
+	Comparator Comparator
 }
 
 type SparseMemIndexEntry struct {
@@ -19,7 +21,7 @@ type SparseMemIndexEntry struct {
 func (me *SparseMemIndex) LookupSearchLocation(key []byte) EntryLocation {
 	index, exists := slices.BinarySearchFunc(
 		me.IndexedEntries, key, func(entry SparseMemIndexEntry, key []byte) int {
-			return bytes.Compare(entry.Key, key)
+			return me.compare(entry.Key, key)
 		},
 	)
 	if exists {
@@ -30,3 +32,10 @@ func (me *SparseMemIndex) LookupSearchLocation(key []byte) EntryLocation {
 	}
 	return me.IndexedEntries[index-1].Location
 }
+
+func (me *SparseMemIndex) compare(a, b []byte) int {
+	if me.Comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return me.Comparator.Compare(a, b)
+}
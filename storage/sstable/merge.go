@@ -2,19 +2,50 @@ package sstable
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
 	"iter"
+	"slices"
+	"time"
 
+	"github.com/navijation/njsimple/util"
 	"github.com/navijation/njsimple/util/heap"
 )
 
 type MergeTablesArgs struct {
 	Srcs []*SSTable
+	// Sequence numbers of live snapshots. Besides the newest version of each key, the newest
+	// version visible to each snapshot is preserved.
+	Snapshots []uint64
+	// Drop tombstones instead of writing them out. Only safe when the destination holds the oldest
+	// data for its key range, so that no older versions remain elsewhere for them to shadow.
+	DropTombstones bool
+	// Write out versions that have expired by this time as tombstones; see IteratorMuxArgs.
+	Now util.Optional[time.Time]
+	// Collapse merge operands; see IteratorMuxArgs. Operands with no base version left are only
+	// merged into a value when DropTombstones is set, as older versions may remain elsewhere.
+	MergeOperator MergeOperator
 }
 
-// Merge all entries from source tables into dest table
+// Merge all entries from source tables into dest table. The source tables must be sorted by the
+// same comparator as the dest table.
 func (me *SSTable) MergeTables(args MergeTablesArgs) error {
-	tableMux := newIteratorMux()
+	for _, src := range args.Srcs {
+		if name := src.comparator.Name(); name != me.comparator.Name() {
+			return fmt.Errorf(
+				"cannot merge SSTable sorted by comparator %q into one sorted by %q",
+				name, me.comparator.Name(),
+			)
+		}
+	}
+
+	tableMux := NewIteratorMux(IteratorMuxArgs{
+		Comparator:           me.comparator,
+		Snapshots:            args.Snapshots,
+		Now:                  args.Now,
+		MergeOperator:        args.MergeOperator,
+		FullMergeWithoutBase: args.DropTombstones,
+	})
 
 	for _, src := range args.Srcs {
 		next, stop := iter.Pull2(src.Entries())
@@ -28,20 +59,26 @@ func (me *SSTable) MergeTables(args MergeTablesArgs) error {
 	var nextEntryErr error
 	appendErr := me.AppendEntries(func(yield func(KeyValuePair) bool) {
 		for {
+			// a failed read also reports no next entry, so the error must be checked first, or the
+			// merged table would silently end early
 			nextEntry, hasNext, err := tableMux.NextEntry()
-			if !hasNext {
-				return
-			}
 			if err != nil {
 				nextEntryErr = err
 				return
 			}
+			if !hasNext {
+				return
+			}
+
+			// a tombstone visible to every snapshot shadows all older versions, so it is the
+			// last version of its key to be returned, and every snapshot reads the key as missing
+			// without it; tombstones newer than a snapshot must hide that snapshot's version
+			if args.DropTombstones && nextEntry.IsDeleted &&
+				tableMux.snapshotStripe(nextEntry.SequenceNumber) == 0 {
+				continue
+			}
 
-			if !yield(KeyValuePair{
-				Key:       nextEntry.Key,
-				Value:     nextEntry.Value,
-				IsDeleted: nextEntry.IsDeleted,
-			}) {
+			if !yield(nextEntry.ToKeyValuePair()) {
 				nextEntryErr = fmt.Errorf("append aborted early")
 				return
 			}
@@ -60,30 +97,85 @@ type tableMuxEntry struct {
 	nextEntry   func() (SSTableEntry, error, bool)
 }
 
-type tableMux struct {
-	heap         heap.Heap[tableMuxEntry]
-	tableCount   int
+type IteratorMuxArgs struct {
+	// Order of the keys of every iterator; defaults to BytewiseComparator
+	Comparator Comparator
+	// Merge iterators sorted in descending key order, such as those returned by
+	// SSTable.ReverseEntriesFrom. Versions of a key must still be sorted newest first.
+	Reverse bool
+	// Ignore all versions with a higher sequence number, as if they were never written.
+	MaxSequenceNumber util.Optional[uint64]
+	// Sequence numbers of live snapshots; see MergeTablesArgs.
+	Snapshots []uint64
+	// Return versions that have expired by this time as tombstones. An expired version still
+	// shadows older versions of its key, so that they do not reappear once it expires.
+	Now util.Optional[time.Time]
+	// Merge operands with the versions of their key below them, up to the first version that is
+	// not an operand, and return the result in their place. Operands are never merged across
+	// snapshots, so that each snapshot still reads the same value.
+	MergeOperator MergeOperator
+	// Merge operands into a value even if no versions remain below them, i.e. if the iterators
+	// hold every version of their key. Otherwise, such operands are combined into one operand.
+	FullMergeWithoutBase bool
+}
+
+// IteratorMux merges several sorted entry iterators into a single sorted stream. By default,
+// only the newest version of each key is returned. When the same version of a key is produced by
+// more than one iterator, only the entry from the most recently added iterator is returned, so
+// iterators should be added from oldest to newest.
+type IteratorMux struct {
+	heap              heap.Heap[tableMuxEntry]
+	tableCount        int
+	maxSequenceNumber util.Optional[uint64]
+	snapshots         []uint64
+	now               util.Optional[time.Time]
+	mergeOperator     MergeOperator
+	fullMerge         bool
+
 	lastKey      []byte
 	lastKeyIsSet bool
+	lastStripe   int
 }
 
-func newIteratorMux() tableMux {
-	return tableMux{
+func NewIteratorMux(args IteratorMuxArgs) IteratorMux {
+	direction := 1
+	if args.Reverse {
+		direction = -1
+	}
+
+	snapshots := slices.Clone(args.Snapshots)
+	slices.Sort(snapshots)
+
+	comparator := args.Comparator
+	if comparator == nil {
+		comparator = BytewiseComparator
+	}
+
+	return IteratorMux{
 		heap: heap.NewHeap(func(a, b tableMuxEntry) int {
-			// pick lower keys first, and upon ties pick the later tables first; this ensures
-			// later writes win
+			// pick lower keys first (or higher keys when reversed), then newer versions, and upon
+			// ties pick the later tables first; this ensures later writes win
+
+			if keyComp := comparator.Compare(a.current.Key, b.current.Key); keyComp != 0 {
+				return direction * keyComp
+			}
 
-			bytesComp := bytes.Compare(a.current.Key, b.current.Key)
-			if bytesComp != 0 {
-				return bytesComp
+			if seqComp := cmp.Compare(b.current.SequenceNumber, a.current.SequenceNumber); seqComp != 0 {
+				return seqComp
 			}
 
 			return b.tableNumber - a.tableNumber
 		}),
+		maxSequenceNumber: args.MaxSequenceNumber,
+		snapshots:         snapshots,
+		now:               args.Now,
+		mergeOperator:     args.MergeOperator,
+		fullMerge:         args.FullMergeWithoutBase,
 	}
 }
 
-func (me *tableMux) AddIterator(next func() (SSTableEntry, error, bool)) error {
+// Add a pull-style iterator, such as one returned by iter.Pull2, to the mux.
+func (me *IteratorMux) AddIterator(next func() (SSTableEntry, error, bool)) error {
 	sstableEntry, err, exists := next()
 	if err != nil {
 		return err
@@ -104,31 +196,128 @@ func (me *tableMux) AddIterator(next func() (SSTableEntry, error, bool)) error {
 	return nil
 }
 
-func (me *tableMux) NextEntry() (out SSTableEntry, hasNext bool, _ error) {
-	for me.heap.Size() > 0 {
-		entry := me.heap.Pop()
+// Return the next entry in key order, skipping versions that are shadowed by newer versions. A
+// failed read, or a failed merge of operands, reports no next entry along with the error, so the
+// error must be checked before hasNext.
+func (me *IteratorMux) NextEntry() (out SSTableEntry, hasNext bool, _ error) {
+	maxSequenceNumber, hasMaxSequenceNumber := me.maxSequenceNumber.Unpack()
 
-		sstableEntry, err, hasNext := entry.nextEntry()
+	for me.heap.Size() > 0 {
+		current, err := me.popEntry()
 		if err != nil {
-			return entry.current, false, err
+			return out, false, err
 		}
-		if hasNext {
-			me.heap.Push(tableMuxEntry{
-				current:     sstableEntry,
-				tableNumber: entry.tableNumber,
-				nextEntry:   entry.nextEntry,
-			})
+
+		if hasMaxSequenceNumber && current.SequenceNumber > maxSequenceNumber {
+			continue
 		}
 
-		// don't rewrite keys that were already written
-		if bytes.Equal(entry.current.Key, me.lastKey) && me.lastKeyIsSet {
+		// a version is shadowed by a newer version of the same key, unless a snapshot was
+		// taken in between them
+		stripe := me.snapshotStripe(current.SequenceNumber)
+		if bytes.Equal(current.Key, me.lastKey) && me.lastKeyIsSet && stripe == me.lastStripe {
 			continue
 		}
 
-		me.lastKey = entry.current.Key
+		me.lastKey = current.Key
 		me.lastKeyIsSet = true
-		return entry.current, true, nil
+		me.lastStripe = stripe
+
+		me.expire(&current)
+		if current.IsMergeOperand && me.mergeOperator != nil {
+			return me.mergeOperands(current, stripe)
+		}
+		return current, true, nil
 	}
 
 	return out, false, nil
 }
+
+// popEntry pops the next entry off the heap, replacing it with the following entry of its
+// iterator.
+func (me *IteratorMux) popEntry() (SSTableEntry, error) {
+	entry := me.heap.Pop()
+
+	sstableEntry, err, hasNext := entry.nextEntry()
+	if err != nil {
+		return entry.current, err
+	}
+	if hasNext {
+		me.heap.Push(tableMuxEntry{
+			current:     sstableEntry,
+			tableNumber: entry.tableNumber,
+			nextEntry:   entry.nextEntry,
+		})
+	}
+
+	return entry.current, nil
+}
+
+func (me *IteratorMux) expire(entry *SSTableEntry) {
+	kvp := entry.ToKeyValuePair()
+	if now, ok := me.now.Unpack(); ok && kvp.IsExpiredAt(now) {
+		entry.IsDeleted = true
+		entry.IsMergeOperand = false
+		entry.Value = nil
+		entry.ValueSize = 0
+		entry.ExpiresAt = 0
+	}
+}
+
+// mergeOperands pops the versions of the newest operand's key below it, in the same snapshot
+// stripe, until it reaches a version that is not an operand, and merges them all. Like NextEntry,
+// it reports no entry along with any error, which callers must check first.
+func (me *IteratorMux) mergeOperands(
+	newest SSTableEntry, stripe int,
+) (out SSTableEntry, hasNext bool, _ error) {
+	operands := []KeyValuePair{newest.ToKeyValuePair()}
+	lastSequenceNumber := newest.SequenceNumber
+
+	toEntry := func(kvp KeyValuePair, err error) (SSTableEntry, bool, error) {
+		if err != nil {
+			return out, false, err
+		}
+		entry := internalSSTableEntry{}.FromKeyValuePair(kvp)
+		return entry.ToSSTableEntry(newest.Location), true, nil
+	}
+
+	for me.heap.Size() > 0 {
+		next := me.heap.Peek()
+		if !bytes.Equal(next.current.Key, newest.Key) {
+			break
+		}
+		// older versions are visible to a snapshot, which must not see them merged
+		if me.snapshotStripe(next.current.SequenceNumber) != stripe {
+			return toEntry(PartialMerge(me.mergeOperator, operands))
+		}
+
+		current, err := me.popEntry()
+		if err != nil {
+			return out, false, err
+		}
+		// the same version, produced by an older iterator
+		if current.SequenceNumber == lastSequenceNumber {
+			continue
+		}
+		lastSequenceNumber = current.SequenceNumber
+
+		me.expire(&current)
+		kvp := current.ToKeyValuePair()
+		if !kvp.IsMergeOperand {
+			return toEntry(FullMerge(me.mergeOperator, operands, &kvp))
+		}
+		operands = append(operands, kvp)
+	}
+
+	if me.fullMerge {
+		return toEntry(FullMerge(me.mergeOperator, operands, nil))
+	}
+	return toEntry(PartialMerge(me.mergeOperator, operands))
+}
+
+// snapshotStripe returns the index of the oldest snapshot that can see the given sequence number.
+// Versions of a key in the same stripe are indistinguishable to every snapshot.
+func (me *IteratorMux) snapshotStripe(sequenceNumber uint64) int {
+	stripe, _ := slices.BinarySearch(me.snapshots, sequenceNumber)
+	return stripe
+}
@@ -0,0 +1,75 @@
+package sstable
+
+import (
+	"fmt"
+	"slices"
+)
+
+// MergeOperator combines merge operands, which are written in place of whole values, with the
+// value of their key. Operands are always passed oldest first.
+type MergeOperator interface {
+	// Name identifies the operator, so that operands are never merged by an operator other than
+	// the one they were written for.
+	Name() string
+	// FullMerge applies operands to the existing value of a key, which is nil if the key does not
+	// exist, and returns the new value. An error fails the read or merge that needed the value.
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combines consecutive operands into a single operand, such that applying it has
+	// the same effect as applying each of them in turn.
+	PartialMerge(key []byte, operands [][]byte) ([]byte, error)
+}
+
+// FullMerge merges operands of a key, sorted newest first, into the version preceding them. The
+// base version is nil if the key did not exist before the operands, and must not itself be an
+// operand. The result is a value, versioned like the newest operand.
+func FullMerge(
+	operator MergeOperator, operands []KeyValuePair, base *KeyValuePair,
+) (KeyValuePair, error) {
+	out := KeyValuePair{
+		Key:            operands[0].Key,
+		SequenceNumber: operands[0].SequenceNumber,
+	}
+
+	var existing []byte
+	if base != nil && !base.IsDeleted {
+		existing = base.Value
+		// the merged value expires along with the value it was merged into
+		out.ExpiresAt = base.ExpiresAt
+	}
+	value, err := operator.FullMerge(out.Key, existing, operandValues(operands))
+	if err != nil {
+		return out, fmt.Errorf("merge operator %q failed on full merge: %w", operator.Name(), err)
+	}
+	out.Value = value
+
+	return out, nil
+}
+
+// PartialMerge combines operands of a key, sorted newest first, into a single operand, versioned
+// like the newest operand.
+func PartialMerge(operator MergeOperator, operands []KeyValuePair) (KeyValuePair, error) {
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	value, err := operator.PartialMerge(operands[0].Key, operandValues(operands))
+	if err != nil {
+		return KeyValuePair{}, fmt.Errorf(
+			"merge operator %q failed on partial merge: %w", operator.Name(), err,
+		)
+	}
+	return KeyValuePair{
+		Key:            operands[0].Key,
+		Value:          value,
+		SequenceNumber: operands[0].SequenceNumber,
+		IsMergeOperand: true,
+	}, nil
+}
+
+// operandValues returns the values of operands sorted newest first, oldest first.
+func operandValues(operands []KeyValuePair) [][]byte {
+	out := make([][]byte, 0, len(operands))
+	for _, operand := range slices.Backward(operands) {
+		out = append(out, operand.Value)
+	}
+	return out
+}
@@ -1,8 +1,12 @@
 package sstable
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/navijation/njsimple/util"
 	testing_util "github.com/navijation/njsimple/util/testing"
@@ -16,9 +20,8 @@ func TestSSTable_Merge(t *testing.T) {
 
 	t.Run("no tables", func(t *testing.T) {
 		dst, err := Open(OpenArgs{
-			Path:    dir + "/no_tables.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/no_tables.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer dst.Close()
@@ -30,9 +33,8 @@ func TestSSTable_Merge(t *testing.T) {
 
 	t.Run("one table", func(t *testing.T) {
 		dst, err := Open(OpenArgs{
-			Path:    dir + "/one_table.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/one_table.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer dst.Close()
@@ -40,7 +42,6 @@ func TestSSTable_Merge(t *testing.T) {
 		src, err := Open(OpenArgs{
 			Path:           dir + "/one_table_1.sst",
 			Create:         true,
-			Version:        5,
 			IndexChunkSize: util.Some(uint64(25)),
 		})
 		require.NoError(t, err)
@@ -68,31 +69,28 @@ func TestSSTable_Merge(t *testing.T) {
 			assert.False(t, middleEntry.IsDeleted)
 		}
 
-		assert.Equal(t, uint64(5), dst.header.Version)
+		assert.Equal(t, FormatVersion, dst.header.Version)
 		assert.Equal(t, defaultChunkSize, dst.index.ChunkSize)
 	})
 
 	t.Run("two tables large", func(t *testing.T) {
 		dst, err := Open(OpenArgs{
-			Path:    dir + "/two_tables.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/two_tables.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer dst.Close()
 
 		src1, err := Open(OpenArgs{
-			Path:    dir + "/two_tables_1.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/two_tables_1.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer src1.Close()
 
 		src2, err := Open(OpenArgs{
-			Path:    dir + "/two_tables_2.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/two_tables_2.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer src2.Close()
@@ -163,25 +161,22 @@ func TestSSTable_Merge(t *testing.T) {
 
 	t.Run("two tables small", func(t *testing.T) {
 		dst, err := Open(OpenArgs{
-			Path:    dir + "/two_tables_small.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/two_tables_small.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer dst.Close()
 
 		src1, err := Open(OpenArgs{
-			Path:    dir + "/two_tables_small_1.sst",
-			Create:  true,
-			Version: 5,
+			Path:   dir + "/two_tables_small_1.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer src1.Close()
 
 		src2, err := Open(OpenArgs{
-			Path:    dir + "/two_tables_small_2.sst",
-			Create:  true,
-			Version: 3,
+			Path:   dir + "/two_tables_small_2.sst",
+			Create: true,
 		})
 		require.NoError(t, err)
 		defer src2.Close()
@@ -220,4 +215,424 @@ func TestSSTable_Merge(t *testing.T) {
 		assert.Equal(t, "looking for someone", string(allEntries[4].Value))
 		assert.Equal(t, "i know", string(allEntries[5].Key))
 	})
+
+	t.Run("snapshots", func(t *testing.T) {
+		dst, err := Open(OpenArgs{
+			Path:   dir + "/snapshots.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer dst.Close()
+
+		src1, err := Open(OpenArgs{
+			Path:   dir + "/snapshots_1.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src1.Close()
+
+		src2, err := Open(OpenArgs{
+			Path:   dir + "/snapshots_2.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src2.Close()
+
+		require.NoError(t, src1.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a3"), SequenceNumber: 3},
+			KeyValuePair{Key: []byte("a"), Value: []byte("a1"), SequenceNumber: 1},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b2"), SequenceNumber: 2},
+		)))
+
+		require.NoError(t, src2.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a5"), SequenceNumber: 5},
+			KeyValuePair{Key: []byte("b"), IsDeleted: true, SequenceNumber: 6},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b4"), SequenceNumber: 4},
+		)))
+
+		// the snapshot at 2 sees a1 and b2, and the snapshot at 4 sees a3 and b4
+		err = dst.MergeTables(MergeTablesArgs{
+			Srcs:      []*SSTable{&src1, &src2},
+			Snapshots: []uint64{4, 2},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(6), dst.header.NumEntries)
+		assert.Equal(t, uint64(6), dst.MaxSequenceNumber())
+
+		var (
+			keys            []string
+			sequenceNumbers []uint64
+		)
+		for entry, err := range dst.Entries() {
+			require.NoError(t, err)
+			keys = append(keys, string(entry.Key))
+			sequenceNumbers = append(sequenceNumbers, entry.SequenceNumber)
+		}
+		assert.Equal(t, []string{"a", "a", "a", "b", "b", "b"}, keys)
+		assert.Equal(t, []uint64{5, 3, 1, 6, 4, 2}, sequenceNumbers)
+
+		entry, exists, err := dst.LookupEntryAt([]byte("a"), 4)
+		if assert.NoError(t, err) && assert.True(t, exists) {
+			assert.Equal(t, "a3", string(entry.Value))
+		}
+		entry, exists, err = dst.LookupEntryAt([]byte("b"), 5)
+		if assert.NoError(t, err) && assert.True(t, exists) {
+			assert.Equal(t, "b4", string(entry.Value))
+		}
+		_, exists, err = dst.LookupEntryAt([]byte("b"), 1)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+	})
+	t.Run("drop tombstones", func(t *testing.T) {
+		src1, err := Open(OpenArgs{
+			Path:   dir + "/drop_tombstones_1.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src1.Close()
+
+		src2, err := Open(OpenArgs{
+			Path:   dir + "/drop_tombstones_2.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src2.Close()
+
+		require.NoError(t, src1.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a1"), SequenceNumber: 1},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b2"), SequenceNumber: 2},
+			KeyValuePair{Key: []byte("c"), Value: []byte("c3"), SequenceNumber: 3},
+		)))
+
+		require.NoError(t, src2.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), IsDeleted: true, SequenceNumber: 4},
+			KeyValuePair{Key: []byte("c"), IsDeleted: true, SequenceNumber: 6},
+			KeyValuePair{Key: []byte("d"), IsDeleted: true, SequenceNumber: 5},
+		)))
+
+		for i, tc := range []struct {
+			name            string
+			snapshots       []uint64
+			keys            []string
+			sequenceNumbers []uint64
+		}{
+			{
+				name:            "no snapshots",
+				keys:            []string{"b"},
+				sequenceNumbers: []uint64{2},
+			},
+			{
+				// the tombstone of c hides c3 from the snapshot, so both are kept
+				name:            "snapshot",
+				snapshots:       []uint64{5},
+				keys:            []string{"b", "c", "c"},
+				sequenceNumbers: []uint64{2, 6, 3},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dst, err := Open(OpenArgs{
+					Path:   fmt.Sprintf("%s/drop_tombstones_dst_%d.sst", dir, i),
+					Create: true,
+				})
+				require.NoError(t, err)
+				defer dst.Close()
+
+				require.NoError(t, dst.MergeTables(MergeTablesArgs{
+					Srcs:           []*SSTable{&src1, &src2},
+					Snapshots:      tc.snapshots,
+					DropTombstones: true,
+				}))
+
+				var (
+					keys            []string
+					sequenceNumbers []uint64
+				)
+				for entry, err := range dst.Entries() {
+					require.NoError(t, err)
+					keys = append(keys, string(entry.Key))
+					sequenceNumbers = append(sequenceNumbers, entry.SequenceNumber)
+				}
+				assert.Equal(t, tc.keys, keys)
+				assert.Equal(t, tc.sequenceNumbers, sequenceNumbers)
+			})
+		}
+	})
+
+	t.Run("expired entries", func(t *testing.T) {
+		src1, err := Open(OpenArgs{
+			Path:   dir + "/expired_1.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src1.Close()
+
+		src2, err := Open(OpenArgs{
+			Path:   dir + "/expired_2.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src2.Close()
+
+		now := time.Unix(1000, 0)
+
+		require.NoError(t, src1.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a1"), SequenceNumber: 1},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b2"), SequenceNumber: 2},
+		)))
+
+		require.NoError(t, src2.AppendEntries(util.SeqOf(
+			KeyValuePair{
+				Key: []byte("a"), Value: []byte("a3"), SequenceNumber: 3,
+				ExpiresAt: uint64(now.UnixNano()),
+			},
+			KeyValuePair{
+				Key: []byte("b"), Value: []byte("b4"), SequenceNumber: 4,
+				ExpiresAt: uint64(now.Add(time.Second).UnixNano()),
+			},
+		)))
+
+		for i, tc := range []struct {
+			name           string
+			dropTombstones bool
+			expected       []KeyValuePair
+		}{
+			{
+				// the expired version still shadows a1
+				name: "keep tombstones",
+				expected: []KeyValuePair{
+					{Key: []byte("a"), IsDeleted: true, SequenceNumber: 3},
+					{
+						Key: []byte("b"), Value: []byte("b4"), SequenceNumber: 4,
+						ExpiresAt: uint64(now.Add(time.Second).UnixNano()),
+					},
+				},
+			},
+			{
+				name:           "drop tombstones",
+				dropTombstones: true,
+				expected: []KeyValuePair{
+					{
+						Key: []byte("b"), Value: []byte("b4"), SequenceNumber: 4,
+						ExpiresAt: uint64(now.Add(time.Second).UnixNano()),
+					},
+				},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dst, err := Open(OpenArgs{
+					Path:   fmt.Sprintf("%s/expired_dst_%d.sst", dir, i),
+					Create: true,
+				})
+				require.NoError(t, err)
+				defer dst.Close()
+
+				require.NoError(t, dst.MergeTables(MergeTablesArgs{
+					Srcs:           []*SSTable{&src1, &src2},
+					DropTombstones: tc.dropTombstones,
+					Now:            util.Some(now),
+				}))
+
+				var kvps []KeyValuePair
+				for entry, err := range dst.Entries() {
+					require.NoError(t, err)
+					kvps = append(kvps, entry.ToKeyValuePair())
+				}
+				assert.Equal(t, tc.expected, kvps)
+			})
+		}
+	})
+
+	t.Run("merge operands", func(t *testing.T) {
+		src1, err := Open(OpenArgs{
+			Path:   dir + "/operands_1.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src1.Close()
+
+		src2, err := Open(OpenArgs{
+			Path:   dir + "/operands_2.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src2.Close()
+
+		require.NoError(t, src1.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a1"), SequenceNumber: 1},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b2"), SequenceNumber: 2, IsMergeOperand: true},
+			KeyValuePair{Key: []byte("c"), Value: []byte("c3"), SequenceNumber: 3},
+		)))
+
+		require.NoError(t, src2.AppendEntries(util.SeqOf(
+			KeyValuePair{Key: []byte("a"), Value: []byte("a5"), SequenceNumber: 5, IsMergeOperand: true},
+			KeyValuePair{Key: []byte("a"), Value: []byte("a4"), SequenceNumber: 4, IsMergeOperand: true},
+			KeyValuePair{Key: []byte("b"), Value: []byte("b6"), SequenceNumber: 6, IsMergeOperand: true},
+			KeyValuePair{Key: []byte("c"), Value: []byte("c7"), SequenceNumber: 7, IsMergeOperand: true},
+		)))
+
+		for i, tc := range []struct {
+			name           string
+			snapshots      []uint64
+			dropTombstones bool
+			expected       []KeyValuePair
+		}{
+			{
+				// b's operands may still apply to versions in other tables
+				name: "keep base-less operands",
+				expected: []KeyValuePair{
+					{Key: []byte("a"), Value: []byte("a1,a4,a5"), SequenceNumber: 5},
+					{Key: []byte("b"), Value: []byte("b2,b6"), SequenceNumber: 6, IsMergeOperand: true},
+					{Key: []byte("c"), Value: []byte("c3,c7"), SequenceNumber: 7},
+				},
+			},
+			{
+				name:           "oldest data",
+				dropTombstones: true,
+				expected: []KeyValuePair{
+					{Key: []byte("a"), Value: []byte("a1,a4,a5"), SequenceNumber: 5},
+					{Key: []byte("b"), Value: []byte("b2,b6"), SequenceNumber: 6},
+					{Key: []byte("c"), Value: []byte("c3,c7"), SequenceNumber: 7},
+				},
+			},
+			{
+				// operands are not merged across the snapshot at 4
+				name:      "snapshots",
+				snapshots: []uint64{4},
+				expected: []KeyValuePair{
+					{Key: []byte("a"), Value: []byte("a5"), SequenceNumber: 5, IsMergeOperand: true},
+					{Key: []byte("a"), Value: []byte("a1,a4"), SequenceNumber: 4},
+					{Key: []byte("b"), Value: []byte("b6"), SequenceNumber: 6, IsMergeOperand: true},
+					{Key: []byte("b"), Value: []byte("b2"), SequenceNumber: 2, IsMergeOperand: true},
+					{Key: []byte("c"), Value: []byte("c7"), SequenceNumber: 7, IsMergeOperand: true},
+					{Key: []byte("c"), Value: []byte("c3"), SequenceNumber: 3},
+				},
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dst, err := Open(OpenArgs{
+					Path:   fmt.Sprintf("%s/operands_dst_%d.sst", dir, i),
+					Create: true,
+				})
+				require.NoError(t, err)
+				defer dst.Close()
+
+				require.NoError(t, dst.MergeTables(MergeTablesArgs{
+					Srcs:           []*SSTable{&src1, &src2},
+					Snapshots:      tc.snapshots,
+					DropTombstones: tc.dropTombstones,
+					MergeOperator:  appendOperator{},
+				}))
+
+				var kvps []KeyValuePair
+				for entry, err := range dst.Entries() {
+					require.NoError(t, err)
+					kvps = append(kvps, entry.ToKeyValuePair())
+				}
+				assert.Equal(t, tc.expected, kvps)
+			})
+		}
+
+		for i, tc := range []struct {
+			name           string
+			operator       failingOperator
+			dropTombstones bool
+		}{
+			{
+				// a's operands are fully merged first, and b's can only be partially merged
+				name:     "failed partial merge",
+				operator: failingOperator{failPartialMerge: true},
+			},
+			{
+				name:           "failed full merge",
+				operator:       failingOperator{failFullMerge: true},
+				dropTombstones: true,
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				dst, err := Open(OpenArgs{
+					Path:   fmt.Sprintf("%s/failed_operands_dst_%d.sst", dir, i),
+					Create: true,
+				})
+				require.NoError(t, err)
+				defer dst.Close()
+
+				assert.ErrorIs(t, dst.MergeTables(MergeTablesArgs{
+					Srcs:           []*SSTable{&src1, &src2},
+					DropTombstones: tc.dropTombstones,
+					MergeOperator:  tc.operator,
+				}), errMergeFailed)
+			})
+		}
+	})
+
+	t.Run("short source table", func(t *testing.T) {
+		src, err := Open(OpenArgs{
+			Path:   dir + "/short_src.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer src.Close()
+
+		require.NoError(t, src.AppendEntries(func(yield func(KeyValuePair) bool) {
+			for i := range 100 {
+				if !yield(KeyValuePair{Key: []byte(fmt.Sprintf("%03d", i)), Value: []byte("src")}) {
+					return
+				}
+			}
+		}))
+		// the header still claims every entry, but the second half of them is gone
+		header := src.Header()
+		require.NoError(t, os.Truncate(src.Path(), int64(header.SizeOf()+
+			(header.FileSize-header.SizeOf())/2)))
+
+		dst, err := Open(OpenArgs{
+			Path:   dir + "/short_dst.sst",
+			Create: true,
+		})
+		require.NoError(t, err)
+		defer dst.Close()
+
+		assert.Error(t, dst.MergeTables(MergeTablesArgs{Srcs: []*SSTable{&src}}))
+	})
+}
+
+// appendOperator appends operands to values, separated by commas.
+type appendOperator struct{}
+
+func (appendOperator) Name() string {
+	return "append"
+}
+
+func (appendOperator) FullMerge(_, existing []byte, operands [][]byte) ([]byte, error) {
+	if existing != nil {
+		operands = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(operands, []byte(",")), nil
+}
+
+func (appendOperator) PartialMerge(_ []byte, operands [][]byte) ([]byte, error) {
+	return bytes.Join(operands, []byte(",")), nil
+}
+
+var errMergeFailed = errors.New("merge failed")
+
+// failingOperator is an appendOperator whose full or partial merges fail.
+type failingOperator struct {
+	appendOperator
+	failFullMerge    bool
+	failPartialMerge bool
+}
+
+func (me failingOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	if me.failFullMerge {
+		return nil, errMergeFailed
+	}
+	return me.appendOperator.FullMerge(key, existing, operands)
+}
+
+func (me failingOperator) PartialMerge(key []byte, operands [][]byte) ([]byte, error) {
+	if me.failPartialMerge {
+		return nil, errMergeFailed
+	}
+	return me.appendOperator.PartialMerge(key, operands)
 }
@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"iter"
 	_ "iter"
 	"log"
+	"math"
 	"os"
 	"slices"
 
@@ -17,33 +19,53 @@ const (
 	defaultChunkSize uint64 = 100
 )
 
-// SSTable in disk structure. It's a simple header (see header.go) and an implicit linked list of
-// variable-length entries (see entry.go).
-// ______________________________________________________
-// | 40 bytes  |      (Header.FileSize - 40) bytes      |
-// |----------------------------------------------------|
-// | Header    |      entry1, entry2, entry3...         |
-// |----------------------------------------------------|
+// SSTable in disk structure. It's a simple header of H bytes (see header.go), an implicit linked
+// list of variable-length entries (see entry.go), and an optional bloom filter over the keys (see
+// bloom.go).
+// ___________________________________________________________________
+// | H bytes | (Header.FileSize - H) bytes | Header.FilterSize bytes |
+// |-----------------------------------------------------------------|
+// | Header  | entry1, entry2, entry3...   | bloom filter            |
+// |-----------------------------------------------------------------|
 type SSTable struct {
 	path string
 
 	header Header
 
-	file    *os.File
-	index   SparseMemIndex
-	lastKey []byte
+	file     *os.File
+	index    SparseMemIndex
+	filter   BloomFilter
+	firstKey []byte
+	lastKey  []byte
+
+	bloomFilterBitsPerKey uint64
+	blockCache            *BlockCache
+	comparator            Comparator
+
+	lastSequenceNumber uint64
+	maxSequenceNumber  uint64
 }
 
 type OpenArgs struct {
 	Path           string
 	Create         bool
-	Version        uint64
 	IndexChunkSize util.Optional[uint64]
+	// Level of the table within an LSM tree; only used when creating a table
+	Level uint64
+	// Bits per key of the bloom filter written along with appended entries; defaults to 10, and 0
+	// omits the filter
+	BloomFilterBitsPerKey util.Optional[uint64]
+	// Cache to read entries through, which may be shared with other tables; if nil, entries are
+	// always read from disk
+	BlockCache *BlockCache
+	// Order of the keys; defaults to BytewiseComparator. An existing table must be opened with a
+	// comparator of the same name as the one it was created with.
+	Comparator util.Optional[Comparator]
 }
 
 // Open a new or existing SSTable file, build in-memory indexes, and deleted trailing data after
 // the header.
-func Open(args OpenArgs) (out SSTable, _ error) {
+func Open(args OpenArgs) (out SSTable, err error) {
 	flags := os.O_RDWR
 	if args.Create {
 		flags |= (os.O_CREATE | os.O_EXCL)
@@ -53,32 +75,54 @@ func Open(args OpenArgs) (out SSTable, _ error) {
 		return out, err
 	}
 
+	comparator := args.Comparator.Or(BytewiseComparator)
 	out = SSTable{
 		path: args.Path,
 
 		file: file,
 		index: SparseMemIndex{
-			ChunkSize: args.IndexChunkSize.Or(defaultChunkSize),
+			ChunkSize:  args.IndexChunkSize.Or(defaultChunkSize),
+			Comparator: comparator,
 		},
+		bloomFilterBitsPerKey: args.BloomFilterBitsPerKey.Or(defaultBloomFilterBitsPerKey),
+		blockCache:            args.BlockCache,
+		comparator:            comparator,
 	}
 
 	defer func() {
-		if args.Create && err != nil {
+		if err != nil {
 			_ = file.Close()
-			_ = os.Remove(args.Path)
+			if args.Create {
+				_ = os.Remove(args.Path)
+			}
 		}
 	}()
 
 	if args.Create {
 		out.header.ID = util.NewRandomUUIDBytes()
-		out.header.Version = args.Version
+		out.header.Version = FormatVersion
+		out.header.Level = args.Level
+		out.header.ComparatorName = comparator.Name()
 		out.header.FileSize = out.header.SizeOf()
 		if _, err := out.header.WriteTo(util.Ptr(out.fileWrapperAt(0))); err != nil {
 			return out, err
 		}
 	} else {
 		if _, err := out.header.ReadFrom(out.readBufferAt(0)); err != nil {
-			return out, err
+			return out, fmt.Errorf("SSTable %s: %w", args.Path, err)
+		}
+		// keys sorted by another comparator would be searched in the wrong order
+		if out.header.ComparatorName != comparator.Name() {
+			return out, fmt.Errorf(
+				"SSTable %s was created with comparator %q, but was opened with %q",
+				args.Path, out.header.ComparatorName, comparator.Name(),
+			)
+		}
+		if out.header.FilterSize > 0 {
+			reader := out.readBufferAt(out.header.FileSize)
+			if _, err := out.filter.readFrom(reader, out.header.FilterSize); err != nil {
+				return out, err
+			}
 		}
 	}
 
@@ -104,23 +148,46 @@ func (me *SSTable) Close() error {
 // Lookup an entry in the table by key. The resulting entry, if it exists, will indicate the
 // location of the entry in the file, the value, and whether it is deleted.
 func (me *SSTable) LookupEntry(key []byte) (out SSTableEntry, exists bool, _ error) {
-	location := me.index.LookupSearchLocation(key)
+	return me.LookupEntryAt(key, math.MaxUint64)
+}
 
-	for entry, err := range me.EntriesAt(location) {
-		if err != nil {
-			return out, false, err
+// Lookup the newest version of a key whose sequence number is at most the given sequence number.
+func (me *SSTable) LookupEntryAt(
+	key []byte, sequenceNumber uint64,
+) (out SSTableEntry, exists bool, _ error) {
+	for entry, err := range me.VersionsAt(key, sequenceNumber) {
+		return entry, err == nil, err
+	}
+	return out, false, nil
+}
+
+// Return an iterator over the versions of a key whose sequence numbers are at most the given
+// sequence number, newest first.
+func (me *SSTable) VersionsAt(key []byte, sequenceNumber uint64) iter.Seq2[SSTableEntry, error] {
+	return func(yield func(SSTableEntry, error) bool) {
+		if !me.filter.MayContain(key) {
+			return
 		}
-		switch bytes.Compare(key, entry.Key) {
-		case -1:
-			// key < entry.Key => no match found
-			return out, false, nil
-		case 0:
-			// key == entry.Key => match found
-			return entry, true, nil
+
+		location := me.index.LookupSearchLocation(key)
+
+		for entry, err := range me.EntriesAt(location) {
+			if err != nil {
+				yield(entry, err)
+				return
+			}
+			switch comp := me.comparator.Compare(key, entry.Key); {
+			case comp < 0:
+				// key < entry.Key => no more versions
+				return
+			case comp == 0:
+				// key == entry.Key => match found, unless the version is too new
+				if entry.SequenceNumber <= sequenceNumber && !yield(entry, nil) {
+					return
+				}
+			}
 		}
 	}
-
-	return out, false, nil
 }
 
 // Return an iterator over all entries in the SSTable, starting from the first entry.
@@ -137,12 +204,21 @@ func (me *SSTable) Entries() iter.Seq2[SSTableEntry, error] {
 //
 // This iterator will not load all entries into memory at once.
 func (me *SSTable) EntriesAt(location EntryLocation) iter.Seq2[SSTableEntry, error] {
+	return me.entriesAt(location, me.blockCache != nil)
+}
+
+// entriesAt is like EntriesAt, but optionally bypasses the block cache. Reindexing bypasses the
+// cache, so that scanning the whole table does not evict the blocks of other tables.
+func (me *SSTable) entriesAt(location EntryLocation, cached bool) iter.Seq2[SSTableEntry, error] {
 	if location.EntryNumber == 0 {
 		location.Offset = me.header.SizeOf()
 	}
 
 	return func(yield func(SSTableEntry, error) bool) {
-		buffer := me.readBufferAt(location.Offset)
+		var buffer io.Reader = me.readBufferAt(location.Offset)
+		if cached {
+			buffer = &blockReader{table: me, offset: location.Offset}
+		}
 
 		for location := location; location.Offset < me.header.FileSize; {
 			var entry internalSSTableEntry
@@ -162,11 +238,118 @@ func (me *SSTable) EntriesAt(location EntryLocation) iter.Seq2[SSTableEntry, err
 	}
 }
 
+// Return an iterator over all entries in the SSTable whose keys are greater than or equal to
+// the given key, using the sparse index to skip ahead. A nil key starts from the first entry.
+//
+// This iterator will not load all entries into memory at once.
+func (me *SSTable) EntriesFrom(key []byte) iter.Seq2[SSTableEntry, error] {
+	// the empty key does not sort first under every comparator
+	var location EntryLocation
+	if key != nil {
+		location = me.index.LookupSearchLocation(key)
+	}
+
+	return func(yield func(SSTableEntry, error) bool) {
+		for entry, err := range me.EntriesAt(location) {
+			if err != nil {
+				yield(entry, err)
+				return
+			}
+			if key != nil && me.comparator.Compare(entry.Key, key) < 0 {
+				continue
+			}
+			if !yield(entry, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Return an iterator over all entries in the SSTable whose keys are less than or equal to the
+// given key, in descending key order. A nil key starts from the last entry.
+//
+// Entries can only be decoded front to back, so each chunk of the sparse index is read forward
+// and then yielded in reverse. At most one chunk is loaded into memory at once. Versions of the
+// same key are still yielded newest first.
+func (me *SSTable) ReverseEntriesFrom(key []byte) iter.Seq2[SSTableEntry, error] {
+	chunkStarts := make([]EntryLocation, 0, len(me.index.IndexedEntries)+1)
+	chunkStarts = append(chunkStarts, EntryLocation{})
+	for _, indexEntry := range me.index.IndexedEntries {
+		chunkStarts = append(chunkStarts, indexEntry.Location)
+	}
+
+	lastChunk := len(chunkStarts) - 1
+	if key != nil {
+		// chunks after the one the search key would be in start with greater keys, and cannot
+		// contain any matches
+		lastChunk = slices.Index(chunkStarts, me.index.LookupSearchLocation(key))
+	}
+
+	return func(yield func(SSTableEntry, error) bool) {
+		for chunk := lastChunk; chunk >= 0; chunk-- {
+			endOffset := me.header.FileSize
+			if chunk+1 < len(chunkStarts) {
+				endOffset = chunkStarts[chunk+1].Offset
+			}
+
+			var entries []SSTableEntry
+			for entry, err := range me.EntriesAt(chunkStarts[chunk]) {
+				if err != nil {
+					yield(entry, err)
+					return
+				}
+				if entry.Location.Offset >= endOffset {
+					break
+				}
+				if key != nil && me.comparator.Compare(entry.Key, key) > 0 {
+					break
+				}
+				entries = append(entries, entry)
+			}
+
+			// chunks never split the versions of a key, so reverse the groups of versions
+			for groupEnd := len(entries); groupEnd > 0; {
+				groupStart := groupEnd - 1
+				for groupStart > 0 && bytes.Equal(entries[groupStart-1].Key, entries[groupEnd-1].Key) {
+					groupStart--
+				}
+				for _, entry := range entries[groupStart:groupEnd] {
+					if !yield(entry, nil) {
+						return
+					}
+				}
+				groupEnd = groupStart
+			}
+		}
+	}
+}
+
 // Append entries in bulk to the end of the SSTable and rebuild indexes. Keys must be appended
-// in sorted order or this method will return an error and abort all writes.
+// in sorted order, with versions of the same key in descending sequence number order, or this
+// method will return an error and abort all writes.
 //
 // This function will not return success until all writes have been fully committed to disk.
 func (me *SSTable) AppendEntries(keyValuePairs iter.Seq[KeyValuePair]) (err error) {
+	// the bloom filter cannot grow, so it is rebuilt from the hashes of every key
+	var keyHashes []uint64
+	if me.bloomFilterBitsPerKey > 0 && me.header.NumEntries > 0 {
+		for entry, err := range me.entriesAt(EntryLocation{}, false) {
+			if err != nil {
+				return err
+			}
+			keyHashes = append(keyHashes, bloomHash(entry.Key))
+		}
+	}
+
+	// new entries overwrite the existing filter, so drop it from the header first; otherwise a
+	// crash could leave the header pointing at a corrupted filter
+	if me.header.FilterSize > 0 {
+		if err := me.writeNewSize(me.header.FileSize, me.header.NumEntries, 0); err != nil {
+			return err
+		}
+		me.filter = BloomFilter{}
+	}
+
 	fileWrapper := util.NewFileWrapperAt(me.file, me.header.FileSize)
 
 	defer func() {
@@ -176,12 +359,18 @@ func (me *SSTable) AppendEntries(keyValuePairs iter.Seq[KeyValuePair]) (err erro
 	}()
 
 	var (
-		offset       int64
-		entriesAdded uint64
-		lastKey      = me.lastKey
+		offset             int64
+		entriesAdded       uint64
+		firstKey           = me.firstKey
+		lastKey            = me.lastKey
+		lastSequenceNumber = me.lastSequenceNumber
+		maxSequenceNumber  = me.maxSequenceNumber
 	)
 	for keyValuePair := range keyValuePairs {
-		if bytes.Compare(keyValuePair.Key, lastKey) != 1 {
+		isFirst := me.header.NumEntries == 0 && entriesAdded == 0
+		comp := me.comparator.Compare(keyValuePair.Key, lastKey)
+		isOlderVersion := comp == 0 && keyValuePair.SequenceNumber < lastSequenceNumber
+		if !isFirst && comp <= 0 && !isOlderVersion {
 			log.Printf("tried to append %v after last key %v", keyValuePair.Key, lastKey)
 			return fmt.Errorf("out of order entry append attempt")
 		}
@@ -192,8 +381,28 @@ func (me *SSTable) AppendEntries(keyValuePairs iter.Seq[KeyValuePair]) (err erro
 			return err
 		}
 		offset += n
+		if me.header.NumEntries == 0 && entriesAdded == 0 {
+			firstKey = entry.Key
+		}
 		entriesAdded++
+		if me.bloomFilterBitsPerKey > 0 {
+			keyHashes = append(keyHashes, bloomHash(entry.Key))
+		}
 		lastKey = entry.Key
+		lastSequenceNumber = entry.SequenceNumber
+		maxSequenceNumber = max(maxSequenceNumber, entry.SequenceNumber)
+	}
+
+	var (
+		filter     BloomFilter
+		filterSize uint64
+	)
+	if me.bloomFilterBitsPerKey > 0 {
+		filter = newBloomFilter(keyHashes, me.bloomFilterBitsPerKey)
+		if _, err := filter.WriteTo(&fileWrapper); err != nil {
+			return err
+		}
+		filterSize = filter.SizeOf()
 	}
 
 	// do a double sync on file contents and then header, to ensure disk doesn't write header first
@@ -205,28 +414,37 @@ func (me *SSTable) AppendEntries(keyValuePairs iter.Seq[KeyValuePair]) (err erro
 	newSize := me.header.FileSize + uint64(offset)
 	newEntries := me.header.NumEntries + entriesAdded
 
-	if err := me.writeNewSize(newSize, newEntries); err != nil {
+	if err := me.writeNewSize(newSize, newEntries, filterSize); err != nil {
 		return err
 	}
+	me.filter = filter
 
+	me.firstKey = firstKey
 	me.lastKey = lastKey
+	me.lastSequenceNumber = lastSequenceNumber
+	me.maxSequenceNumber = maxSequenceNumber
 	return me.partialReindex()
 }
 
 func (me *SSTable) Reindex() error {
 	var (
-		newEntries     []SparseMemIndexEntry
-		nextChunkStart = me.index.ChunkSize
-		numEntries     uint64
-		lastKey        []byte
+		newEntries         []SparseMemIndexEntry
+		nextChunkStart     = me.index.ChunkSize
+		numEntries         uint64
+		firstKey           []byte
+		lastKey            []byte
+		lastSequenceNumber uint64
+		maxSequenceNumber  uint64
 	)
-	for entry, err := range me.Entries() {
+	for entry, err := range me.entriesAt(EntryLocation{}, false) {
 		if err != nil {
 			return err
 		}
-		numEntries++
 
-		if entry.Location.Offset >= nextChunkStart {
+		// only start chunks on the newest version of a key, so that an exact index match is
+		// always the newest version
+		isNewKey := numEntries == 0 || !bytes.Equal(entry.Key, lastKey)
+		if entry.Location.Offset >= nextChunkStart && isNewKey {
 			newEntries = append(newEntries, SparseMemIndexEntry{
 				Location: entry.Location,
 				Key:      entry.Key,
@@ -234,13 +452,23 @@ func (me *SSTable) Reindex() error {
 			nextChunkStart = entry.Location.Offset + me.index.ChunkSize
 		}
 
+		if numEntries == 0 {
+			firstKey = entry.Key
+		}
+		numEntries++
 		lastKey = entry.Key
+		lastSequenceNumber = entry.SequenceNumber
+		maxSequenceNumber = max(maxSequenceNumber, entry.SequenceNumber)
 	}
 
+	me.firstKey = firstKey
 	me.lastKey = lastKey
+	me.lastSequenceNumber = lastSequenceNumber
+	me.maxSequenceNumber = maxSequenceNumber
 	me.index = SparseMemIndex{
 		ChunkSize:      me.index.ChunkSize,
 		IndexedEntries: newEntries,
+		Comparator:     me.comparator,
 	}
 
 	return nil
@@ -254,13 +482,37 @@ func (me *SSTable) Header() Header {
 	return me.header
 }
 
+// Return the comparator the table's keys are sorted by.
+func (me *SSTable) Comparator() Comparator {
+	return me.comparator
+}
+
 func (me *SSTable) NumEntries() uint64 {
 	return me.header.NumEntries
 }
 
+// Return the level of the table within an LSM tree.
+func (me *SSTable) Level() uint64 {
+	return me.header.Level
+}
+
+// Return the lowest and highest keys in the table. Both are nil if the table is empty.
+func (me *SSTable) KeyRange() (firstKey, lastKey []byte) {
+	if me.header.NumEntries == 0 {
+		return nil, nil
+	}
+	return me.firstKey, me.lastKey
+}
+
+// Return the highest sequence number of any entry in the table.
+func (me *SSTable) MaxSequenceNumber() uint64 {
+	return me.maxSequenceNumber
+}
+
 func (me *SSTable) Index() SparseMemIndex {
 	return SparseMemIndex{
-		ChunkSize: me.index.ChunkSize,
+		ChunkSize:  me.index.ChunkSize,
+		Comparator: me.comparator,
 		IndexedEntries: util.CloneSliceFunc(
 			me.index.IndexedEntries,
 			func(entry SparseMemIndexEntry) SparseMemIndexEntry {
@@ -292,12 +544,12 @@ func (me *SSTable) partialReindex() error {
 	var (
 		lastKey []byte
 	)
-	for entry, err := range me.EntriesAt(lastIndexEntry.Location) {
+	for entry, err := range me.entriesAt(lastIndexEntry.Location, false) {
 		if err != nil {
 			return err
 		}
 
-		if entry.Location.Offset > nextChunkStart {
+		if entry.Location.Offset > nextChunkStart && !bytes.Equal(entry.Key, lastKey) {
 			me.index.IndexedEntries = append(me.index.IndexedEntries, SparseMemIndexEntry{
 				Key:      entry.Key,
 				Location: entry.Location,
@@ -320,12 +572,12 @@ func (me *SSTable) fileWrapperAt(offset uint64) util.FileWrapper {
 }
 
 func (me *SSTable) truncateToHeader() error {
-	return me.file.Truncate(int64(me.header.FileSize))
+	return me.file.Truncate(int64(me.header.FileSize + me.header.FilterSize))
 }
 
-func (me *SSTable) writeNewSize(size, numEntries uint64) error {
+func (me *SSTable) writeNewSize(size, numEntries, filterSize uint64) error {
 	fileWrapper := me.fileWrapperAt(0)
-	newHeader := me.header.WithNewSize(size, numEntries)
+	newHeader := me.header.WithNewSize(size, numEntries, filterSize)
 
 	if _, err := newHeader.WriteTo(&fileWrapper); err != nil {
 		return err
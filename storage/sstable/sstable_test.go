@@ -1,7 +1,9 @@
 package sstable
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/navijation/njsimple/util"
@@ -22,25 +24,23 @@ func TestOpen_NoEntries(t *testing.T) {
 	require.Error(t, err)
 
 	file, err := Open(OpenArgs{
-		Path:    dir + "/sstable.sst",
-		Create:  true,
-		Version: 5,
+		Path:   dir + "/sstable.sst",
+		Create: true,
 	})
 	require.NoError(t, err)
 
-	assert.Equal(t, uint64(5), file.header.Version)
+	assert.Equal(t, FormatVersion, file.header.Version)
 	assert.NotZero(t, file.header.ID)
 	assert.Equal(t, uint64(0), file.header.NumEntries)
-	assert.Equal(t, uint64(40), file.header.FileSize)
+	assert.Equal(t, uint64(72), file.header.FileSize)
 	assert.Equal(t, defaultChunkSize, file.index.ChunkSize)
 	assert.Empty(t, file.index.IndexedEntries)
 
 	assert.NoError(t, file.Close())
 
 	_, err = Open(OpenArgs{
-		Path:    dir + "/sstable.sst",
-		Create:  true,
-		Version: 20,
+		Path:   dir + "/sstable.sst",
+		Create: true,
 	})
 	assert.Error(t, err, "re-creating an existing file must fail")
 
@@ -50,12 +50,25 @@ func TestOpen_NoEntries(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	assert.Equal(t, uint64(5), sameFile.header.Version)
+	assert.Equal(t, FormatVersion, sameFile.header.Version)
 	assert.Equal(t, uint64(0), sameFile.header.NumEntries)
-	assert.Equal(t, uint64(40), sameFile.header.FileSize)
+	assert.Equal(t, uint64(72), sameFile.header.FileSize)
 	assert.Equal(t, file.header.ID, sameFile.header.ID)
 	assert.Equal(t, uint64(5), sameFile.index.ChunkSize)
 	assert.Empty(t, sameFile.index.IndexedEntries)
+	assert.NoError(t, sameFile.Close())
+
+	t.Run("older version", func(t *testing.T) {
+		// the header of an empty table written before versions were checked
+		var buf bytes.Buffer
+		buf.Write(make([]byte, 16))
+		_, err := util.WriteUint64s(&buf, 0, 40, 0)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/old.sst", buf.Bytes(), 0o644))
+
+		_, err = Open(OpenArgs{Path: dir + "/old.sst"})
+		assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	})
 }
 
 func TestSSTable_AppendAndIterate(t *testing.T) {
@@ -67,7 +80,6 @@ func TestSSTable_AppendAndIterate(t *testing.T) {
 	file, err := Open(OpenArgs{
 		Path:           dir + "/sstable.sst",
 		Create:         true,
-		Version:        5,
 		IndexChunkSize: util.Some(uint64(5)),
 	})
 	require.NoError(t, err)
@@ -89,14 +101,14 @@ func TestSSTable_AppendAndIterate(t *testing.T) {
 		assert.Equal(t, uint64(15), entry1.KeySize)
 		assert.Equal(t, uint64(9), entry1.ValueSize)
 		assert.Equal(t, uint64(0), entry1.Location.EntryNumber)
-		assert.Equal(t, uint64(40), entry1.Location.Offset)
+		assert.Equal(t, uint64(72), entry1.Location.Offset)
 		assert.False(t, entry1.IsDeleted)
 
-		// 40 + 15 + 9 + 16 = 80
-		assert.Equal(t, uint64(80), file.header.FileSize)
+		// 72 + 15 + 9 + 24 = 120
+		assert.Equal(t, uint64(120), file.header.FileSize)
 		assert.NotZero(t, file.header.ID)
 		assert.Equal(t, uint64(1), file.header.NumEntries)
-		assert.Equal(t, uint64(5), file.header.Version)
+		assert.Equal(t, FormatVersion, file.header.Version)
 	})
 
 	err = file.AppendEntries(util.SeqOf(KeyValuePair{
@@ -115,14 +127,14 @@ func TestSSTable_AppendAndIterate(t *testing.T) {
 		assert.Equal(t, uint64(17), entry2.KeySize)
 		assert.Equal(t, uint64(15), entry2.ValueSize)
 		assert.Equal(t, uint64(1), entry2.Location.EntryNumber)
-		assert.Equal(t, uint64(80), entry2.Location.Offset)
+		assert.Equal(t, uint64(120), entry2.Location.Offset)
 		assert.True(t, entry2.IsDeleted)
 
-		// 80 + 17 + 15 + 16 = 128
-		assert.Equal(t, uint64(128), file.header.FileSize)
+		// 120 + 17 + 15 + 24 = 176
+		assert.Equal(t, uint64(176), file.header.FileSize)
 		assert.NotZero(t, file.header.ID)
 		assert.Equal(t, uint64(2), file.header.NumEntries)
-		assert.Equal(t, uint64(5), file.header.Version)
+		assert.Equal(t, FormatVersion, file.header.Version)
 	})
 
 	sameFile, err := Open(OpenArgs{
@@ -163,7 +175,6 @@ func TestSSTable_LookupEntry(t *testing.T) {
 	file, err := Open(OpenArgs{
 		Path:           dir + "/sstable.sst",
 		Create:         true,
-		Version:        2,
 		IndexChunkSize: util.Some(uint64(1000)),
 	})
 	require.NoError(t, err)
@@ -206,3 +217,106 @@ func TestSSTable_LookupEntry(t *testing.T) {
 		}
 	})
 }
+
+func TestSSTable_EntriesFrom(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestSSTable_EntriesFrom")
+	defer cleanup()
+
+	file, err := Open(OpenArgs{
+		Path:           dir + "/sstable.sst",
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, file.AppendEntries(func(yield func(KeyValuePair) bool) {
+		for i := range 100 {
+			if !yield(KeyValuePair{
+				Key:   []byte(fmt.Sprintf("key%03d", 2*i)),
+				Value: []byte(fmt.Sprintf("value%d", 2*i)),
+			}) {
+				return
+			}
+		}
+	}))
+
+	for _, tc := range []struct {
+		name     string
+		key      []byte
+		expected string
+		count    int
+	}{
+		{name: "nil key", key: nil, expected: "key000", count: 100},
+		{name: "existing key", key: []byte("key100"), expected: "key100", count: 50},
+		{name: "missing key", key: []byte("key101"), expected: "key102", count: 49},
+		{name: "past end", key: []byte("key999"), count: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []SSTableEntry
+			for entry, err := range file.EntriesFrom(tc.key) {
+				require.NoError(t, err)
+				entries = append(entries, entry)
+			}
+			if assert.Len(t, entries, tc.count) && tc.count > 0 {
+				assert.Equal(t, tc.expected, string(entries[0].Key))
+			}
+		})
+	}
+}
+
+func TestSSTable_ReverseEntriesFrom(t *testing.T) {
+	t.Parallel()
+
+	dir, cleanup := testing_util.MkdirTemp(t, "TestSSTable_ReverseEntriesFrom")
+	defer cleanup()
+
+	file, err := Open(OpenArgs{
+		Path:           dir + "/sstable.sst",
+		Create:         true,
+		IndexChunkSize: util.Some(uint64(100)),
+	})
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, file.AppendEntries(func(yield func(KeyValuePair) bool) {
+		for i := range 100 {
+			if !yield(KeyValuePair{
+				Key:   []byte(fmt.Sprintf("key%03d", 2*i)),
+				Value: []byte(fmt.Sprintf("value%d", 2*i)),
+			}) {
+				return
+			}
+		}
+	}))
+	require.NotEmpty(t, file.index.IndexedEntries)
+
+	for _, tc := range []struct {
+		name     string
+		key      []byte
+		expected string
+		count    int
+	}{
+		{name: "nil key", key: nil, expected: "key198", count: 100},
+		{name: "existing key", key: []byte("key100"), expected: "key100", count: 51},
+		{name: "missing key", key: []byte("key101"), expected: "key100", count: 51},
+		{name: "before start", key: []byte("a"), count: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var entries []SSTableEntry
+			for entry, err := range file.ReverseEntriesFrom(tc.key) {
+				require.NoError(t, err)
+				entries = append(entries, entry)
+			}
+			if assert.Len(t, entries, tc.count) && tc.count > 0 {
+				assert.Equal(t, tc.expected, string(entries[0].Key))
+				assert.Equal(t, "key000", string(entries[len(entries)-1].Key))
+				for i := 1; i < len(entries); i++ {
+					assert.Equal(t, entries[i-1].Location.EntryNumber-1, entries[i].Location.EntryNumber)
+				}
+			}
+		})
+	}
+}
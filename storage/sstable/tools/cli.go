@@ -46,6 +46,12 @@ func main() {
 			{
 				Name: "merge",
 				Action: mergeSSTables,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "drop-tombstones",
+						Usage: "omit deleted keys; only safe if the sources hold the oldest data",
+					},
+				},
 			},
 		},
 	}
@@ -13,7 +13,7 @@ import (
 func mergeSSTables(_ context.Context, cmd *cli.Command) error {
 	if cmd.Args().Len() < 2 {
 		fmt.Printf("%d\n", cmd.Args().Len())
-		return errors.New("usage: merge dest_path src_path1 [src_path_2 ...]")
+		return errors.New("usage: merge [--drop-tombstones] dest_path src_path1 [src_path_2 ...]")
 	}
 
 	destPath := cmd.Args().Get(0)
@@ -50,7 +50,8 @@ func mergeSSTables(_ context.Context, cmd *cli.Command) error {
 	}
 
 	if err := file.MergeTables(sstable.MergeTablesArgs{
-		Srcs: srcFiles,
+		Srcs:           srcFiles,
+		DropTombstones: cmd.Bool("drop-tombstones"),
 	}); err != nil {
 		return err
 	}
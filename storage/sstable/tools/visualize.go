@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/navijation/njsimple/storage/sstable"
 	"github.com/navijation/njsimple/util"
@@ -38,11 +39,15 @@ func visualizeSSTableFileHelper(file *sstable.SSTable) error {
 			"  ID: %s\n"+
 			"  Version: %d\n"+
 			"  Size: %d\n"+
-			"  Entries: %d\n\n",
+			"  Entries: %d\n"+
+			"  Level: %d\n"+
+			"  Filter Size: %d\n\n",
 		util.UUIDFromBytes(header.ID).String(),
 		header.Version,
 		header.FileSize,
 		header.NumEntries,
+		header.Level,
+		header.FilterSize,
 	)
 
 	index := file.Index()
@@ -71,15 +76,20 @@ func visualizeSSTableFileHelper(file *sstable.SSTable) error {
 		keySize := entry.KeySize
 		value := entry.Value
 		valueSize := entry.ValueSize
+		sequenceNumber := entry.SequenceNumber
 
 		if nextIndex < len(index.IndexedEntries) &&
 			index.IndexedEntries[nextIndex].Location.EntryNumber == entryNumber {
 			fmt.Printf("-----\n")
 			nextIndex++
 		}
-		fmt.Printf("  - #%d @%d: %q (%d bytes) -> %q (%d bytes)\n",
-			entryNumber, offset, key, keySize, value, valueSize,
+		fmt.Printf("  - #%d @%d: %q (%d bytes) [seq %d] -> %q (%d bytes)",
+			entryNumber, offset, key, keySize, sequenceNumber, value, valueSize,
 		)
+		if entry.ExpiresAt != 0 {
+			fmt.Printf(" [expires %s]", time.Unix(0, int64(entry.ExpiresAt)).UTC().Format(time.RFC3339))
+		}
+		fmt.Printf("\n")
 	}
 
 	return nil
@@ -5,7 +5,7 @@ import (
 	"testing"
 )
 
-func MkdirTemp(t *testing.T, prefix string) (path string, cleanup func()) {
+func MkdirTemp(t testing.TB, prefix string) (path string, cleanup func()) {
 	out, err := os.MkdirTemp(os.TempDir(), prefix)
 	if err != nil {
 		t.Fatalf("failed to create temporary directory: %v", err)